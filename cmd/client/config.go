@@ -10,13 +10,18 @@ import (
 )
 
 type config struct {
-	RemoteAddr string `json:"remote_addr"`
-	RemoteKey  string `json:"remote_key"`
-	Secret     string `json:"secret"`
-	MTU        uint16 `json:"mtu"`
+	RemoteAddr string   `json:"remote_addr"`
+	RemoteKey  string   `json:"remote_key"`
+	Secret     string   `json:"secret"`
+	MTU        uint16   `json:"mtu"`
+	Methods    []string `json:"methods"`
+	Mode       string   `json:"mode"`
 
 	ConnTimeout string `json:"connect_timeout"`
 	timeout     time.Duration
+
+	Rehandshake string `json:"rehandshake_interval"`
+	rehandshake time.Duration
 }
 
 func readConfig(fname string) (*config, error) {
@@ -52,6 +57,19 @@ func (c *config) Validate() error {
 			return fmt.Errorf("config.connection_timeout is invalid: %v", e)
 		}
 	}
+	if c.Rehandshake != "" {
+		var e error
+		if c.rehandshake, e = time.ParseDuration(c.Rehandshake); e != nil {
+			return fmt.Errorf("config.rehandshake_interval is invalid: %v", e)
+		}
+	}
+	switch c.Mode {
+	case "":
+		c.Mode = "tun"
+	case "tun", "tap":
+	default:
+		return fmt.Errorf("config.mode must be tun or tap, got %q", c.Mode)
+	}
 	if c.MTU <= fastd.MinMTU || c.MTU > 1500 {
 		return fmt.Errorf("config.mtu must be in (%d..1500), got %d", fastd.MinMTU, c.MTU)
 	}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bytes"
 	"encoding/hex"
 	"flag"
 	"log"
@@ -9,7 +8,6 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
-	"time"
 
 	"github.com/digineo/fastd/fastd"
 )
@@ -18,7 +16,7 @@ var (
 	configFile = "./config.json"
 	verbose    = false
 	tunnel     Interface
-	udpConn    *net.UDPConn
+	session    *fastd.ClientSession
 )
 
 func main() {
@@ -36,149 +34,79 @@ func main() {
 		log.Fatalf("error validating config: %v", err)
 	}
 
-	tunnel, err = newTunDevice()
-	if err != nil {
-		log.Fatalf("error creating tun device: %v", err)
-	}
-	defer tunnel.Close()
-
-	addr, err := net.ResolveUDPAddr("udp", cfg.RemoteAddr)
-	if err != nil {
-		log.Fatalf("unable to resolve %q: %v", cfg.RemoteAddr, err)
-	}
-	log.Printf("resolved %q to %s", cfg.RemoteAddr, addr)
-
-	udpConn, err = net.DialUDP("udp", nil, addr)
-	if err != nil {
-		log.Fatalf("DialUDP failed: %v", err)
-	}
-
 	secret, err := hex.DecodeString(cfg.Secret)
 	if err != nil {
 		log.Fatalf("unable to decode secret: %v", err)
 	}
-	keyPair := fastd.NewKeyPair(secret)
 
 	peerKey, err := hex.DecodeString(cfg.RemoteKey)
 	if err != nil {
 		log.Fatalf("unable to decode peer key: %v", err)
 	}
 
-	hsKey := fastd.RandomKeypair()
-
-	// create handshake request 0x01
-	request := fastd.Message{Type: 0x01}
-	request.Records.
-		SetHandshakeType(fastd.HandshakeRequest).
-		SetMode(fastd.ModeTUN).
-		SetProtocolName("ec25519-fhmqvc").
-		SetSenderKey(keyPair.Public()).
-		SetVersionName("v18").
-		SetRecipientKey(peerKey).
-		SetSenderHandshakeKey(hsKey.Public())
-
-	if hostname, _ := os.Hostname(); hostname != "" {
-		request.Records.SetHostname(hostname)
+	hostname, _ := os.Hostname()
+	client, err := fastd.NewClient(fastd.ClientConfig{
+		Remote:   cfg.RemoteAddr,
+		PeerKey:  peerKey,
+		Secret:   secret,
+		MTU:      cfg.MTU,
+		Methods:  cfg.Methods,
+		Hostname: hostname,
+		TAP:      cfg.Mode == "tap",
+		Timeout:  cfg.timeout,
+
+		RehandshakeInterval: cfg.rehandshake,
+		RehandshakeJitter:   cfg.rehandshake / 10,
+	})
+	if err != nil {
+		log.Fatalf("invalid client config: %v", err)
 	}
 
-	log.Println("sending fastd handshake request")
-	if verbose {
-		log.Println("sending payload:", request.Records)
+	tunnel, err = newTunDevice(cfg.Mode == "tap")
+	if err != nil {
+		log.Fatalf("error creating tun device: %v", err)
 	}
+	defer tunnel.Close()
 
-	pkt := request.Marshal(false)
-	n, err := udpConn.Write(pkt)
+	log.Printf("connecting to %s", cfg.RemoteAddr)
+	session, err = client.Connect()
 	if err != nil {
-		log.Fatalf("unable to write to UDP socket: %v", err)
+		log.Fatalf("handshake failed: %v", err)
 	}
-	if n != len(pkt) {
-		log.Fatalf("expected to have written %d bytes, wrote %d", len(pkt), n)
-	}
-
-	log.Println("waiting for fastd handshake reply")
-	reply := waitForPacket(cfg.timeout)
+	defer session.Close()
 
 	if verbose {
-		log.Println("received payload:", reply.Records)
-	}
-	local4, e := reply.Records.IPv4Addr()
-	if e != nil {
-		log.Fatalf("%v", e)
+		log.Printf("shared key: %x", session.SharedKey())
 	}
-	remote4, e := reply.Records.IPv4DstAddr()
-	if e != nil {
-		log.Fatalf("%v", e)
-	}
-	prefix4, e := reply.Records.IPv4PrefixLen()
-	if e != nil {
+
+	prefix4 := session.IPv4PrefixLen
+	if prefix4 == 0 {
 		prefix4 = 31
-		log.Printf("%v, assuming /%d", e, prefix4)
-	}
-	local6, e := reply.Records.IPv6Addr()
-	if e != nil {
-		log.Fatalf("%v", e)
 	}
-	remote6, e := reply.Records.IPv6DstAddr()
-	if e != nil {
-		log.Fatalf("%v", e)
-	}
-	prefix6, e := reply.Records.IPv6PrefixLen()
-	if e != nil {
+	prefix6 := session.IPv6PrefixLen
+	if prefix6 == 0 {
 		prefix6 = 127
-		log.Printf("%v, assuming /%d", e, prefix6)
 	}
 
-	log.Printf("local   %s/%d   %s/%d", local4, prefix4, local6, prefix6)
-	log.Printf("remote  %s/%d   %s/%d", remote4, prefix4, remote6, prefix6)
+	log.Printf("using method %q", session.Method())
+	log.Printf("local   %s/%d   %s/%d", session.IPv4.LocalAddr, prefix4, session.IPv6.LocalAddr, prefix6)
+	log.Printf("remote  %s/%d   %s/%d", session.IPv4.DestAddr, prefix4, session.IPv6.DestAddr, prefix6)
 
-	if typ, e := reply.Records.HandshakeType(); e != nil || typ != fastd.HandshakeReply {
-		log.Fatalf("expected finish handshake packet, received %v (err %v)", typ, e)
+	var addresses []*net.IPNet
+	if ip := session.IPv4.LocalAddr; ip != nil {
+		addresses = append(addresses, &net.IPNet{IP: ip, Mask: net.CIDRMask(int(prefix4), 32)})
 	}
-	if code, e := reply.Records.ReplyCode(); e != nil || code != fastd.ReplySuccess {
-		log.Fatalf("expected finish reply type, received %v (err %v)", code, e)
+	if ip := session.IPv6.LocalAddr; ip != nil {
+		addresses = append(addresses, &net.IPNet{IP: ip, Mask: net.CIDRMask(int(prefix6), 128)})
 	}
-
-	recipientHSKey, err := reply.Records.RecipientHandshakeKey()
-	if err != nil || bytes.Compare(hsKey.Public(), recipientHSKey) != 0 {
-		log.Fatalf("recipient handshake key mismatch (err %v)", err)
+	if err = tunnel.Configure(session.MTU, addresses...); err != nil {
+		log.Fatalf("unable to configure tun device: %v", err)
 	}
 
-	senderHSKey, err := reply.Records.SenderHandshakeKey()
-	if err != nil || len(senderHSKey) != fastd.KEYSIZE {
-		log.Fatalf("invalid sender handshake key size: %d (err %v)", len(senderHSKey), err)
-	}
-
-	hs := fastd.NewInitiatingHandshake(keyPair, hsKey, peerKey, senderHSKey)
-	reply.SignKey = hs.SharedKey()
-
-	if !reply.VerifySignature() {
-		log.Fatal("invalid signature")
-	}
-
-	// create handshake finish 0x03
-	finish := reply.NewReply()
-	finish.Records.
-		SetSenderKey(keyPair.Public()).
-		SetRecipientKey(peerKey).
-		SetSenderHandshakeKey(hsKey.Public()).
-		SetRecipientHandshakeKey(senderHSKey).
-		SetMTU(cfg.MTU).
-		SetMethodName("null")
-
-	finish.SignKey = hs.SharedKey()
-
-	udpConn.Write(finish.Marshal(false))
-
-	tunnel.Configure(
-		cfg.MTU,
-		&net.IPNet{IP: local4, Mask: net.CIDRMask(int(prefix4), 32)},
-		&net.IPNet{IP: local6, Mask: net.CIDRMask(int(prefix6), 128)},
-	)
-
 	go tunnelToUDP()
 	go udpToTunnel()
 
-	ch := make(chan os.Signal)
+	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
 	log.Printf("[interrupt received] %s", <-ch)
 }
@@ -186,19 +114,17 @@ func main() {
 // from fastd tunnel to UDP
 func tunnelToUDP() {
 	var buf [1500]byte
-	buf[0] = byte(fastd.TypeData)
 	for {
-		n, err := tunnel.Read(buf[1:])
+		n, err := tunnel.Read(buf[:])
 		if err != nil {
 			log.Println(err)
-			continue
+			return
 		}
 		if verbose {
 			log.Printf("got %d bytes from Tunnel", n)
 		}
 
-		_, err = udpConn.Write(buf[:n+1])
-		if err != nil {
+		if err = session.WritePacket(buf[:n]); err != nil {
 			log.Println(err)
 		}
 	}
@@ -206,49 +132,19 @@ func tunnelToUDP() {
 
 // from UDP to fastd tunnel
 func udpToTunnel() {
-	// disable timeout
-	udpConn.SetReadDeadline(time.Time{})
-
-	var buf [1500]byte
+	buf := make([]byte, 0, 1500)
 	for {
-		n, _, err := udpConn.ReadFromUDP(buf[:])
+		payload, err := session.ReadPacket(buf[:0])
 		if err != nil {
 			log.Println(err)
-			continue
+			return
 		}
 		if verbose {
-			log.Printf("got %d bytes from UDP", n)
+			log.Printf("got %d bytes from UDP", len(payload))
 		}
 
-		_, err = tunnel.Write(buf[1 : n+1])
-		if err != nil {
+		if _, err = tunnel.Write(payload); err != nil {
 			log.Println(err)
 		}
 	}
 }
-
-func waitForPacket(timeout time.Duration) *fastd.Message {
-	buf := make([]byte, 1500)
-
-	udpConn.SetReadDeadline(time.Now().Add(timeout))
-	for {
-		n, _, err := udpConn.ReadFromUDP(buf)
-		if verbose {
-			log.Printf("got %d bytes", n)
-		}
-		if err != nil {
-			if e, ok := err.(net.Error); !ok || !e.Timeout() {
-				log.Fatalf("error reading from UDP socket: %v", err)
-			}
-			log.Print("reached timeout")
-			return nil
-		}
-
-		msg, err := fastd.ParseMessage(buf[:n], false)
-		if err != nil {
-			log.Println("unable to parse message:", err)
-		} else {
-			return msg
-		}
-	}
-}
@@ -47,8 +47,11 @@ func (tun *linuxTunIface) Write(p []byte) (n int, err error) {
 	return tun.iface.Write(p)
 }
 
-func newTunDevice() (Interface, error) {
+func newTunDevice(tap bool) (Interface, error) {
 	config := water.Config{DeviceType: water.TUN}
+	if tap {
+		config.DeviceType = water.TAP
+	}
 
 	if name, err := findName("fastd"); err == nil {
 		config.Name = name
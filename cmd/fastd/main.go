@@ -1,17 +1,25 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
+	fastdconfig "github.com/digineo/fastd/config"
 	"github.com/digineo/fastd/fastd"
 	"github.com/digineo/fastd/ifconfig"
+	"github.com/digineo/fastd/pool"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
 )
 
 func main() {
@@ -25,60 +33,200 @@ func main() {
 
 	switch cmd {
 	case "server":
-		var listenAddr, implName, secret string
+		var configFile, peerDir, listenAddr, implName, secret, methods, statusSocket, managementSocket, metricsAddr string
+		var ipv4Pool, ipv6Pool, leaseFile, stateFile string
+		var stateKeys bool
+		var leaseTime time.Duration
 		var listenPort uint
 		var timeout uint
+		var rehandshake, hookTimeout time.Duration
+		var hooks [6]string
+		var verifyAsync bool
+		var handshakeLimit, sourceHandshakeLimit fastd.RateLimit
+		var maxPendingHandshakes, maxPeers, maxEndpointsPerKey int
 
 		// Parse flags
 		flags := flag.NewFlagSet("fastd", flag.ExitOnError)
+		flags.StringVar(&configFile, "config", "", "Configuration file in fastd syntax, replaces -address, -port, -secret and -methods")
+		flags.StringVar(&peerDir, "peers", "", "Directory with peer files in fastd syntax, only known peers are accepted")
 		flags.StringVar(&implName, "impl", "udp", "Implementation type: udp or kernel")
 		flags.StringVar(&listenAddr, "address", "127.0.0.1", "Listening address")
 		flags.StringVar(&secret, "secret", "", "Secret key")
+		flags.StringVar(&methods, "methods", "", "Comma-separated list of allowed methods (default: all supported)")
 		flags.UintVar(&timeout, "timeout", 60, "Peer timeout in seconds")
 		flags.UintVar(&listenPort, "port", 10000, "Listening port")
+		flags.DurationVar(&rehandshake, "rehandshake", 0, "Interval between handshakes with established peers (0 disables)")
+		flags.StringVar(&statusSocket, "status-socket", "", "Path of the status socket (empty disables it)")
+		flags.StringVar(&managementSocket, "management-socket", "", "Path of the management socket used by the peers, kick and reload commands (empty disables it)")
+		flags.StringVar(&metricsAddr, "metrics", "", "Listening address for Prometheus metrics on /metrics, e.g. :9281 (empty disables it)")
+		flags.StringVar(&stateFile, "state-file", "", "File with snapshots of the established peers, restored on start (empty disables it)")
+		flags.BoolVar(&stateKeys, "state-keys", false, "Store session keys in the state file, restored sessions need no new handshake")
+		flags.StringVar(&ipv4Pool, "ipv4-pool", "", "IPv4 prefix for tunnel addresses, split into /31 networks (empty disables it)")
+		flags.StringVar(&ipv6Pool, "ipv6-pool", "", "IPv6 prefix for tunnel addresses, split into /127 networks (empty disables it)")
+		flags.StringVar(&leaseFile, "leases", "", "File persisting the assigned tunnel addresses (empty keeps them in memory)")
+		flags.DurationVar(&leaseTime, "lease-time", pool.DefaultLeaseTime, "Time the addresses of a removed peer are kept in the lease file")
+		flags.StringVar(&hooks[0], "on-up", "", "Command executed after the interface of a peer has been created")
+		flags.StringVar(&hooks[1], "on-down", "", "Command executed before the interface of a peer is destroyed")
+		flags.StringVar(&hooks[2], "on-verify", "", "Command verifying unknown peers, a non-zero exit status rejects them")
+		flags.StringVar(&hooks[3], "on-establish", "", "Command executed when a peer has been established")
+		flags.StringVar(&hooks[4], "on-disestablish", "", "Command executed when an established peer has been removed")
+		flags.StringVar(&hooks[5], "on-reject", "", "Command executed when a handshake has been rejected by -max-peers or -max-endpoints-per-key")
+		flags.BoolVar(&verifyAsync, "verify-async", false, "Answer handshakes when the verify command has finished instead of blocking the server")
+		flags.DurationVar(&hookTimeout, "hook-timeout", fastd.DefaultHookTimeout, "Maximum runtime of hook commands")
+		flags.Float64Var(&handshakeLimit.Rate, "handshake-rate", 0, "Handshake requests accepted per second from all sources (0 disables the limit)")
+		flags.IntVar(&handshakeLimit.Burst, "handshake-burst", 0, "Handshake requests accepted at once from all sources")
+		flags.Float64Var(&sourceHandshakeLimit.Rate, "source-handshake-rate", 0, "Handshake requests accepted per second from a source IP (0 disables the limit)")
+		flags.IntVar(&sourceHandshakeLimit.Burst, "source-handshake-burst", 0, "Handshake requests accepted at once from a source IP")
+		flags.IntVar(&maxPendingHandshakes, "max-pending-handshakes", 0, "Maximum number of unfinished handshakes (0 disables the limit)")
+		flags.IntVar(&maxPeers, "max-peers", 0, "Maximum number of peers, further handshakes are rejected (0 keeps the peer limit of the config file)")
+		flags.IntVar(&maxEndpointsPerKey, "max-endpoints-per-key", 0, "Maximum number of addresses a key is used from at once, 1 disables roaming until the previous session has timed out (0 disables the limit)")
 		flags.Parse(args)
 
-		// Initialize secret key
-		if secret == "" {
-			fmt.Println("secret key missing")
-			flags.PrintDefaults()
-			os.Exit(1)
+		var config *fastd.Config
+		if configFile != "" {
+			file, err := fastdconfig.Load(configFile)
+			if err != nil {
+				fmt.Println("unable to load config:", err)
+				os.Exit(1)
+			}
+			if config, err = file.ServerConfig(); err != nil {
+				fmt.Printf("invalid config %s: %v\n", configFile, err)
+				os.Exit(1)
+			}
+			if level, ok := file.Level(); ok {
+				logrus.SetLevel(level)
+			}
+		} else {
+			// Initialize secret key
+			if secret == "" {
+				fmt.Println("secret key missing")
+				flags.PrintDefaults()
+				os.Exit(1)
+			}
+
+			config = &fastd.Config{
+				Bind: []fastd.Sockaddr{{IP: net.ParseIP(listenAddr), Port: uint16(listenPort)}},
+			}
+
+			if methods != "" {
+				config.Methods = strings.Split(methods, ",")
+			}
+
+			err := config.SetServerKey(secret)
+			if err != nil {
+				panic(err)
+			}
 		}
 
-		config := fastd.Config{
-			Bind:    []fastd.Sockaddr{{net.ParseIP(listenAddr), uint16(listenPort)}},
-			Timeout: time.Duration(timeout) * time.Second,
-			AssignAddresses: func(peer *fastd.Peer) {
-				// Generate addresses for test purposes
-				index, _ := strconv.Atoi(peer.Ifname[5:])
-				if index > 128 {
-					panic("interface index out of range")
-				}
-				peer.IPv4.LocalAddr = net.IPv4(192, 168, 23, byte(index)*2)
-				peer.IPv4.DestAddr = net.IPv4(192, 168, 23, byte(index)*2+1)
+		config.Timeout = time.Duration(timeout) * time.Second
+		config.RehandshakeInterval = rehandshake
+		config.RehandshakeJitter = rehandshake / 10
+		if statusSocket != "" {
+			config.StatusSocket = statusSocket
+		}
+		config.ManagementSocket = managementSocket
+		config.StateFile = stateFile
+		config.StateKeys = stateKeys
+		config.HandshakeLimit = handshakeLimit
+		config.SourceHandshakeLimit = sourceHandshakeLimit
+		config.MaxPendingHandshakes = maxPendingHandshakes
+		if maxPeers > 0 {
+			config.MaxPeers = maxPeers
+		}
+		config.MaxEndpointsPerKey = maxEndpointsPerKey
 
-				peer.IPv6.LocalAddr = net.ParseIP("fe80::1")
-				peer.IPv6.DestAddr = net.ParseIP("fe80::2")
-			},
+		if ipv4Pool != "" || ipv6Pool != "" {
+			addresses, err := newPool(ipv4Pool, ipv6Pool, leaseFile, leaseTime)
+			if err != nil {
+				fmt.Println("invalid address pool:", err)
+				os.Exit(1)
+			}
+			config.AssignAddresses = addresses.Assign
+			config.ReleaseAddresses = addresses.Release
 		}
 
-		err := config.SetServerKey(secret)
-		if err != nil {
-			panic(err)
+		// Hooks given by flags replace the ones of the config file
+		for i, target := range []**fastd.Hook{
+			&config.Hooks.Up,
+			&config.Hooks.Down,
+			&config.Hooks.Verify,
+			&config.Hooks.Establish,
+			&config.Hooks.Disestablish,
+			&config.Hooks.Reject,
+		} {
+			if hooks[i] != "" {
+				*target = &fastd.Hook{Command: hooks[i]}
+			}
+		}
+		if verifyAsync && config.Hooks.Verify != nil {
+			config.Hooks.Verify.Async = true
+		}
+		config.Hooks.Timeout = hookTimeout
+
+		// Load known peers
+		reloadPeers := func() error {
+			peers, err := loadPeers(configFile, peerDir)
+			if err != nil {
+				return err
+			}
+			config.Peers.Replace(peers)
+			fmt.Printf("loaded %d peers\n", len(peers))
+			return nil
+		}
+		if configFile != "" || peerDir != "" {
+			config.Peers = fastd.NewPeerStore(nil)
+			if err := reloadPeers(); err != nil {
+				fmt.Println("unable to load peers:", err)
+				os.Exit(1)
+			}
+			config.OnReload = reloadPeers
+		} else {
+			fmt.Println("no peers configured, accepting all keys")
 		}
 
-		srv, err := fastd.NewServer(implName, &config)
+		config.OnError = func(err error) {
+			fmt.Println("transport error:", err)
+		}
+
+		srv, err := fastd.NewServer(implName, config)
 		if err != nil {
 			fmt.Println("unable to start server:", err)
 			os.Exit(1)
 		}
 
-		// Wait for SIGINT or SIGTERM
+		if metricsAddr != "" {
+			prometheus.MustRegister(srv)
+			http.Handle("/metrics", promhttp.Handler())
+			go func() {
+				if err := http.ListenAndServe(metricsAddr, nil); err != nil {
+					fmt.Println("unable to start metrics listener:", err)
+					os.Exit(1)
+				}
+			}()
+		}
+
+		// Reload peers on SIGHUP, stop on SIGINT or SIGTERM
+		ctx, cancel := context.WithCancel(context.Background())
 		sigs := make(chan os.Signal, 1)
-		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-		<-sigs
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+		go func() {
+			for sig := range sigs {
+				if sig != syscall.SIGHUP {
+					cancel()
+					return
+				}
+				if err := srv.Reload(); err != nil && err != fastd.ErrReloadUnsupported {
+					fmt.Println("unable to reload peers:", err)
+				}
+			}
+		}()
 
-		srv.Stop()
+		if err := srv.Run(ctx); err != nil {
+			fmt.Println("server failed:", err)
+			os.Exit(1)
+		}
+	case "peers", "kick", "reload":
+		manage(cmd, args)
 	case "remote":
 		port, _ := strconv.Atoi(args[2])
 		fastd.SetRemote(args[0], fastd.Sockaddr{IP: net.ParseIP(args[1]), Port: uint16(port)}, nil, false)
@@ -125,3 +273,48 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// newPool returns an address pool for the given prefixes and lease file
+func newPool(ipv4, ipv6, leaseFile string, leaseTime time.Duration) (*pool.Pool, error) {
+	config := pool.Config{
+		LeaseFile: leaseFile,
+		LeaseTime: leaseTime,
+	}
+	var err error
+
+	if ipv4 != "" {
+		if _, config.IPv4, err = net.ParseCIDR(ipv4); err != nil {
+			return nil, err
+		}
+	}
+	if ipv6 != "" {
+		if _, config.IPv6, err = net.ParseCIDR(ipv6); err != nil {
+			return nil, err
+		}
+	}
+
+	return pool.New(config)
+}
+
+// loadPeers reads the peers of the configuration file and the peer directory
+func loadPeers(configFile, peerDir string) ([]fastd.KnownPeer, error) {
+	var peers []*fastdconfig.Peer
+
+	if configFile != "" {
+		file, err := fastdconfig.Load(configFile)
+		if err != nil {
+			return nil, err
+		}
+		peers = file.Peers
+	}
+
+	if peerDir != "" {
+		dirPeers, err := fastdconfig.LoadPeerDir(peerDir)
+		if err != nil {
+			return nil, err
+		}
+		peers = append(peers, dirPeers...)
+	}
+
+	return fastdconfig.KnownPeers(peers), nil
+}
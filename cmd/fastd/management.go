@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/digineo/fastd/fastd"
+)
+
+// manage executes a command of the management API:
+//
+//	fastd peers -socket <path> [key or ifname]
+//	fastd kick -socket <path> <key or ifname>
+//	fastd reload -socket <path>
+func manage(cmd string, args []string) {
+	var socket string
+
+	flags := flag.NewFlagSet("fastd "+cmd, flag.ExitOnError)
+	flags.StringVar(&socket, "socket", "", "Path of the management socket")
+	flags.Parse(args)
+
+	if socket == "" {
+		fmt.Println("management socket missing")
+		flags.PrintDefaults()
+		os.Exit(1)
+	}
+
+	client := fastd.NewManagementClient(socket)
+	var err error
+
+	switch cmd {
+	case "peers":
+		if flags.NArg() > 0 {
+			err = showPeer(client, flags.Arg(0))
+		} else {
+			err = listPeers(client)
+		}
+	case "kick":
+		if flags.NArg() != 1 {
+			fmt.Println("usage: fastd kick -socket <path> <key or ifname>")
+			os.Exit(1)
+		}
+		err = client.Kick(flags.Arg(0))
+	case "reload":
+		err = client.Reload()
+	}
+
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+// listPeers prints a table of all peers
+func listPeers(client *fastd.ManagementClient) error {
+	peers, err := client.Peers()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tNAME\tINTERFACE\tADDRESS\tHANDSHAKE\tESTABLISHED")
+	for _, peer := range peers {
+		name := "-"
+		if peer.Name != nil {
+			name = *peer.Name
+		}
+		established := "-"
+		if conn := peer.Connection; conn != nil {
+			established = (time.Duration(conn.Established) * time.Millisecond).Round(time.Second).String()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", peer.PublicKey, name, peer.Interface, peer.Address, peer.Handshake, established)
+	}
+	return w.Flush()
+}
+
+// showPeer prints a peer as JSON
+func showPeer(client *fastd.ManagementClient, id string) error {
+	peer, err := client.Peer(id)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(peer)
+}
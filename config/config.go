@@ -0,0 +1,131 @@
+// Package config reads configuration files in the syntax of the
+// reference fastd implementation.
+package config
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/digineo/fastd/fastd"
+	"github.com/sirupsen/logrus"
+)
+
+// Config is a parsed configuration file.
+type Config struct {
+	Bind         []fastd.Sockaddr
+	Secret       string // hex encoded secret key
+	MTU          uint16
+	Methods      []string     // methods in order of preference
+	Modes        []fastd.Mode // empty if no mode is configured
+	LogLevel     string       // level of the reference implementation, empty if none is configured
+	StatusSocket string
+	PeerLimit    int      // maximum number of peers, zero if no limit is configured
+	PeerDirs     []string // directories included with "include peers from"
+	Peers        []*Peer
+	Hooks        fastd.Hooks // commands of the "on <event>" statements
+}
+
+// logLevels maps the log levels of the reference implementation
+var logLevels = map[string]logrus.Level{
+	"fatal":   logrus.FatalLevel,
+	"error":   logrus.ErrorLevel,
+	"warn":    logrus.WarnLevel,
+	"info":    logrus.InfoLevel,
+	"verbose": logrus.DebugLevel,
+	"debug":   logrus.DebugLevel,
+	"debug2":  logrus.TraceLevel,
+}
+
+// Peer is a configured peer.
+type Peer struct {
+	Name    string
+	Key     []byte   // public key
+	Remotes []string // host:port
+	Float   bool
+
+	file string // location of the key statement
+	line int
+}
+
+// ParseError is an error in a configuration file.
+type ParseError struct {
+	File string
+	Line int
+	Msg  string
+}
+
+func (err *ParseError) Error() string {
+	return fmt.Sprintf("%s:%d: %s", err.File, err.Line, err.Msg)
+}
+
+// Load reads a configuration file and the files included by it.
+func Load(path string) (*Config, error) {
+	config := &Config{}
+	if err := config.include(path, 0); err != nil {
+		return nil, err
+	}
+	if err := checkPeers(config.Peers); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// ServerConfig returns the configuration of a fastd server.
+func (c *Config) ServerConfig() (*fastd.Config, error) {
+	if c.Secret == "" {
+		return nil, errors.New("secret missing")
+	}
+	if len(c.Bind) == 0 {
+		return nil, errors.New("bind address missing")
+	}
+
+	config := &fastd.Config{
+		Bind:         c.Bind,
+		MTU:          c.MTU,
+		Methods:      c.Methods,
+		Modes:        c.Modes,
+		StatusSocket: c.StatusSocket,
+		MaxPeers:     c.PeerLimit,
+		Peers:        fastd.NewPeerStore(KnownPeers(c.Peers)),
+		Hooks:        c.Hooks,
+	}
+	if err := config.SetServerKey(c.Secret); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Level returns the log level of the "log level" statement and whether
+// it is configured.
+func (c *Config) Level() (logrus.Level, bool) {
+	level, ok := logLevels[c.LogLevel]
+	return level, ok
+}
+
+// KnownPeers converts peers for a fastd.PeerStore.
+func KnownPeers(peers []*Peer) []fastd.KnownPeer {
+	known := make([]fastd.KnownPeer, len(peers))
+	for i, peer := range peers {
+		known[i] = fastd.KnownPeer{Name: peer.Name, PublicKey: peer.Key}
+	}
+	return known
+}
+
+// checkPeers rejects peers with the same key
+func checkPeers(peers []*Peer) error {
+	names := make(map[string]string)
+	for _, peer := range peers {
+		if peer.Key == nil {
+			continue
+		}
+		if other, ok := names[string(peer.Key)]; ok {
+			return &ParseError{
+				File: peer.file,
+				Line: peer.line,
+				Msg:  fmt.Sprintf("key of peer %q already used by peer %q", peer.Name, other),
+			}
+		}
+		names[string(peer.Key)] = peer.Name
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package config
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/digineo/fastd/fastd"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoad(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	config, err := Load("testdata/fastd.conf")
+	require.NoError(err)
+
+	assert.Equal([]fastd.Sockaddr{
+		{IP: net.ParseIP("0.0.0.0"), Port: 10000},
+		{IP: net.ParseIP("::"), Port: 10001},
+		{IP: net.ParseIP("192.0.2.1"), Port: 10002},
+	}, config.Bind)
+	assert.Equal([]string{"salsa2012+umac", "null"}, config.Methods)
+	assert.Equal([]fastd.Mode{fastd.ModeTAP}, config.Modes)
+	assert.EqualValues(1406, config.MTU)
+	assert.Equal("800e8ff23adcc5df5f6b911581667821ebecf1ecd95b10b6b5f92f4ebef7704c", config.Secret)
+	assert.Equal("verbose", config.LogLevel)
+	assert.Equal("/var/run/fastd.sock", config.StatusSocket)
+	assert.Equal(100, config.PeerLimit)
+
+	assert.Equal(&fastd.Hook{Command: "ip link set up $INTERFACE"}, config.Hooks.Up)
+	assert.Equal(&fastd.Hook{Command: "true", Async: true}, config.Hooks.Verify)
+	assert.Equal(&fastd.Hook{Command: `echo "$PEER_NAME" established`}, config.Hooks.Establish)
+	assert.Equal(&fastd.Hook{Command: "logger -t fastd rejected $PEER_KEY: $REJECT_REASON", Async: true}, config.Hooks.Reject)
+	assert.Nil(config.Hooks.Down)
+
+	assert.Equal([]string{"testdata/peers"}, config.PeerDirs)
+	require.Len(config.Peers, 2)
+	assert.Equal("node1", config.Peers[0].Name)
+	assert.Len(config.Peers[0].Key, fastd.KEYSIZE)
+
+	gateway := config.Peers[1]
+	assert.Equal("gateway", gateway.Name)
+	assert.Equal([]string{"gw.example.com:10000", "[2001:db8::1]:10000"}, gateway.Remotes)
+	assert.True(gateway.Float)
+
+	server, err := config.ServerConfig()
+	require.NoError(err)
+	assert.Equal(config.Bind, server.Bind)
+	assert.Equal(config.Methods, server.Methods)
+	assert.EqualValues(1406, server.MTU)
+	assert.Equal(100, server.MaxPeers)
+	assert.Equal(config.Hooks, server.Hooks)
+
+	level, ok := config.Level()
+	assert.True(ok)
+	assert.Equal(logrus.DebugLevel, level)
+
+	name, ok := server.Peers.Lookup(config.Peers[0].Key)
+	assert.True(ok)
+	assert.Equal("node1", name)
+}
+
+func TestLoadErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fastd-config")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	key := `"0a6fb9e12ea1b0f6b66f4d1b22c1c2e3e1a4c6b2d5b43c7bd8d7e9a6e6b2f5a1"`
+	ioutil.WriteFile(filepath.Join(dir, "invalid.conf"), []byte("\n\nfoo;\n"), 0644)
+
+	tests := []struct {
+		config string
+		err    string
+	}{
+		{"bind 0.0.0.0:10000", "fastd.conf:1: expected ';', got end of file"},
+		{"\nbind foo:1;", "fastd.conf:2: invalid IP address 'foo'"},
+		{"bind 1.2.3.4:1 port 2;", "fastd.conf:1: port given twice"},
+		{"mtu 100;", "fastd.conf:1: invalid number '100', expected 576 to 65535"},
+		{"method \"foo\";", `fastd.conf:1: unknown method "foo"`},
+		{"mode bar;", "fastd.conf:1: unknown mode 'bar'"},
+		{"secret \"00\";", "fastd.conf:1: invalid key, expected 32 hex encoded bytes"},
+		{"on foo \"true\";", "fastd.conf:1: unknown event 'foo'"},
+		{"interface \"mesh-vpn\";", "fastd.conf:1: interface names are not supported"},
+		{"log level trace;", "fastd.conf:1: unknown log level 'trace'"},
+		{"/* comment\n\n", "fastd.conf:1: unterminated comment"},
+		{"\n\"foo", "fastd.conf:2: unterminated string"},
+		{"peer \"a\" {\n}", `fastd.conf:2: peer "a" has no key`},
+		{"peer \"a\" {\nkey " + key + ";\n", `fastd.conf:3: missing '}' of peer "a"`},
+		{"peer \"a\" { key " + key + "; }\npeer \"b\" {\nkey " + key + "; }", `fastd.conf:3: key of peer "b" already used by peer "a"`},
+		{"peer \"a\" { remote \"foo\"; }", `fastd.conf:1: port of remote "foo" missing`},
+		{"include \"invalid.conf\";", "invalid.conf:3: unknown statement 'foo'"},
+		{"\ninclude \"missing.conf\";", "fastd.conf:2: unable to include \"missing.conf\": open"},
+	}
+
+	for _, test := range tests {
+		path := filepath.Join(dir, "fastd.conf")
+		require.NoError(t, ioutil.WriteFile(path, []byte(test.config), 0644))
+
+		_, err := Load(path)
+		if assert.Error(t, err, test.config) {
+			assert.Contains(t, err.Error(), test.err)
+		}
+	}
+}
+
+func TestServerConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := (&Config{}).ServerConfig()
+	assert.EqualError(err, "secret missing")
+
+	_, err = (&Config{Secret: "00"}).ServerConfig()
+	assert.EqualError(err, "bind address missing")
+
+	_, ok := (&Config{}).Level()
+	assert.False(ok)
+}
@@ -0,0 +1,187 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenWord
+	tokenString
+	tokenSemicolon
+	tokenOpen  // {
+	tokenClose // }
+)
+
+func (kind tokenKind) String() string {
+	switch kind {
+	case tokenEOF:
+		return "end of file"
+	case tokenWord:
+		return "word"
+	case tokenString:
+		return "string"
+	case tokenSemicolon:
+		return "';'"
+	case tokenOpen:
+		return "'{'"
+	case tokenClose:
+		return "'}'"
+	default:
+		return fmt.Sprintf("token %d", int(kind))
+	}
+}
+
+type token struct {
+	kind  tokenKind
+	value string
+	line  int
+}
+
+func (tok token) String() string {
+	switch tok.kind {
+	case tokenWord:
+		return fmt.Sprintf("'%s'", tok.value)
+	case tokenString:
+		return fmt.Sprintf("%q", tok.value)
+	default:
+		return tok.kind.String()
+	}
+}
+
+// lexer splits a configuration file into tokens. It skips whitespace
+// and comments in shell (#), C (/* */) and C++ (//) style.
+type lexer struct {
+	file string
+	data string
+	pos  int
+	line int
+}
+
+func newLexer(file, data string) *lexer {
+	return &lexer{file: file, data: data, line: 1}
+}
+
+func (l *lexer) errorf(line int, format string, args ...interface{}) error {
+	return &ParseError{File: l.file, Line: line, Msg: fmt.Sprintf(format, args...)}
+}
+
+// tokens returns all tokens of the file, terminated by tokenEOF
+func (l *lexer) tokens() ([]token, error) {
+	var tokens []token
+	for {
+		tok, err := l.next()
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, tok)
+		if tok.kind == tokenEOF {
+			return tokens, nil
+		}
+	}
+}
+
+func (l *lexer) next() (token, error) {
+	if err := l.skip(); err != nil {
+		return token{}, err
+	}
+	if l.pos >= len(l.data) {
+		return token{kind: tokenEOF, line: l.line}, nil
+	}
+
+	switch c := l.data[l.pos]; c {
+	case ';':
+		l.pos++
+		return token{kind: tokenSemicolon, line: l.line}, nil
+	case '{':
+		l.pos++
+		return token{kind: tokenOpen, line: l.line}, nil
+	case '}':
+		l.pos++
+		return token{kind: tokenClose, line: l.line}, nil
+	case '"':
+		return l.string()
+	default:
+		return l.word(), nil
+	}
+}
+
+// skip skips whitespace and comments
+func (l *lexer) skip() error {
+	for l.pos < len(l.data) {
+		switch c := l.data[l.pos]; {
+		case c == '\n':
+			l.line++
+			l.pos++
+		case c == ' ' || c == '\t' || c == '\r':
+			l.pos++
+		case c == '#' || strings.HasPrefix(l.data[l.pos:], "//"):
+			for l.pos < len(l.data) && l.data[l.pos] != '\n' {
+				l.pos++
+			}
+		case strings.HasPrefix(l.data[l.pos:], "/*"):
+			start := l.line
+			end := strings.Index(l.data[l.pos+2:], "*/")
+			if end < 0 {
+				return l.errorf(start, "unterminated comment")
+			}
+			comment := l.data[l.pos : l.pos+end+4]
+			l.line += strings.Count(comment, "\n")
+			l.pos += len(comment)
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// string reads a quoted string with backslash escapes
+func (l *lexer) string() (token, error) {
+	start := l.line
+	var b strings.Builder
+
+	for l.pos++; l.pos < len(l.data); l.pos++ {
+		c := l.data[l.pos]
+		switch c {
+		case '"':
+			l.pos++
+			return token{kind: tokenString, value: b.String(), line: start}, nil
+		case '\n':
+			l.line++
+		case '\\':
+			l.pos++
+			if l.pos >= len(l.data) {
+				break
+			}
+			switch c = l.data[l.pos]; c {
+			case 'n':
+				c = '\n'
+			case 't':
+				c = '\t'
+			case '\n':
+				l.line++
+			}
+		}
+		b.WriteByte(c)
+	}
+
+	return token{}, l.errorf(start, "unterminated string")
+}
+
+// word reads an unquoted word like a keyword, a number or an address
+func (l *lexer) word() token {
+	start := l.pos
+	for l.pos < len(l.data) {
+		c := l.data[l.pos]
+		if c == ' ' || c == '\t' || c == '\r' || c == '\n' ||
+			c == ';' || c == '{' || c == '}' || c == '"' || c == '#' ||
+			strings.HasPrefix(l.data[l.pos:], "//") || strings.HasPrefix(l.data[l.pos:], "/*") {
+			break
+		}
+		l.pos++
+	}
+	return token{kind: tokenWord, value: l.data[start:l.pos], line: l.line}
+}
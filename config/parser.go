@@ -0,0 +1,617 @@
+package config
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/digineo/fastd/fastd"
+)
+
+// maxIncludeDepth limits nested includes to detect loops
+const maxIncludeDepth = 10
+
+type parser struct {
+	config *Config
+	file   string
+	tokens []token
+	pos    int
+	depth  int
+}
+
+// newParser reads and tokenizes a file
+func newParser(config *Config, file string, depth int) (*parser, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens, err := newLexer(file, string(data)).tokens()
+	if err != nil {
+		return nil, err
+	}
+
+	return &parser{
+		config: config,
+		file:   file,
+		tokens: tokens,
+		depth:  depth,
+	}, nil
+}
+
+// include parses a configuration file into the config
+func (c *Config) include(file string, depth int) error {
+	p, err := newParser(c, file, depth)
+	if err != nil {
+		return err
+	}
+
+	for p.peek().kind != tokenEOF {
+		if err := p.statement(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadPeerDir reads the peers of a directory. Every file configures a
+// peer named after the file, hidden files and backups are skipped.
+func LoadPeerDir(dir string) ([]*Peer, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	var peers []*Peer
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") || strings.HasSuffix(name, "~") {
+			continue
+		}
+
+		peer, err := loadPeer(filepath.Join(dir, name), name)
+		if err != nil {
+			return nil, err
+		}
+		peers = append(peers, peer)
+	}
+
+	if err := checkPeers(peers); err != nil {
+		return nil, err
+	}
+	return peers, nil
+}
+
+// loadPeer reads a file with peer statements
+func loadPeer(file, name string) (*Peer, error) {
+	p, err := newParser(&Config{}, file, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	peer := &Peer{Name: name}
+	for p.peek().kind != tokenEOF {
+		if err := p.peerStatement(peer); err != nil {
+			return nil, err
+		}
+	}
+
+	if peer.Key == nil {
+		return nil, p.errorf(p.peek(), "peer %q has no key", name)
+	}
+	return peer, nil
+}
+
+func (p *parser) errorf(tok token, format string, args ...interface{}) error {
+	return &ParseError{File: p.file, Line: tok.line, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokenEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// expect returns the next token if it is of the given kind
+func (p *parser) expect(kind tokenKind) (token, error) {
+	tok := p.next()
+	if tok.kind != kind {
+		return tok, p.errorf(tok, "expected %v, got %v", kind, tok)
+	}
+	return tok, nil
+}
+
+// keyword consumes the given word
+func (p *parser) keyword(word string) error {
+	tok := p.next()
+	if tok.kind != tokenWord || tok.value != word {
+		return p.errorf(tok, "expected '%s', got %v", word, tok)
+	}
+	return nil
+}
+
+// value returns a string or a word
+func (p *parser) value() (token, error) {
+	tok := p.next()
+	if tok.kind != tokenString && tok.kind != tokenWord {
+		return tok, p.errorf(tok, "expected value, got %v", tok)
+	}
+	return tok, nil
+}
+
+// end consumes the semicolon at the end of a statement
+func (p *parser) end() error {
+	_, err := p.expect(tokenSemicolon)
+	return err
+}
+
+// path resolves a path relative to the current file
+func (p *parser) path(name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(filepath.Dir(p.file), name)
+}
+
+// number parses an integer in the given range
+func (p *parser) number(min, max int) (int, error) {
+	tok, err := p.expect(tokenWord)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.Atoi(tok.value)
+	if err != nil || n < min || n > max {
+		return 0, p.errorf(tok, "invalid number %v, expected %d to %d", tok, min, max)
+	}
+	return n, nil
+}
+
+// boolean parses yes or no
+func (p *parser) boolean() (bool, error) {
+	tok, err := p.expect(tokenWord)
+	if err != nil {
+		return false, err
+	}
+	switch tok.value {
+	case "yes":
+		return true, nil
+	case "no":
+		return false, nil
+	default:
+		return false, p.errorf(tok, "expected 'yes' or 'no', got %v", tok)
+	}
+}
+
+// key parses a hex encoded key
+func (p *parser) key() ([]byte, token, error) {
+	tok, err := p.expect(tokenString)
+	if err != nil {
+		return nil, tok, err
+	}
+	key, err := hex.DecodeString(tok.value)
+	if err != nil || len(key) != fastd.KEYSIZE {
+		return nil, tok, p.errorf(tok, "invalid key, expected %d hex encoded bytes", fastd.KEYSIZE)
+	}
+	return key, tok, nil
+}
+
+// statement parses a top level statement
+func (p *parser) statement() error {
+	tok, err := p.expect(tokenWord)
+	if err != nil {
+		return err
+	}
+
+	switch tok.value {
+	case "bind":
+		return p.bind()
+	case "secret":
+		_, tok, err := p.key()
+		if err != nil {
+			return err
+		}
+		p.config.Secret = tok.value
+		return p.end()
+	case "mtu":
+		mtu, err := p.number(fastd.MinMTU, 65535)
+		if err != nil {
+			return err
+		}
+		p.config.MTU = uint16(mtu)
+		return p.end()
+	case "method":
+		return p.method()
+	case "mode":
+		return p.mode()
+	case "include":
+		return p.include()
+	case "on":
+		return p.hook()
+	case "peer":
+		return p.peer()
+	case "interface":
+		// the interfaces of the peers are named by the server
+		return p.errorf(tok, "interface names are not supported")
+	case "log":
+		if err := p.keyword("level"); err != nil {
+			return err
+		}
+		level, err := p.expect(tokenWord)
+		if err != nil {
+			return err
+		}
+		if _, ok := logLevels[level.value]; !ok {
+			return p.errorf(level, "unknown log level %v", level)
+		}
+		p.config.LogLevel = level.value
+		return p.end()
+	case "status":
+		if err := p.keyword("socket"); err != nil {
+			return err
+		}
+		path, err := p.expect(tokenString)
+		if err != nil {
+			return err
+		}
+		p.config.StatusSocket = p.path(path.value)
+		return p.end()
+	case "secure":
+		// handshakes are always secure
+		if err := p.keyword("handshakes"); err != nil {
+			return err
+		}
+		if _, err := p.boolean(); err != nil {
+			return err
+		}
+		return p.end()
+	default:
+		return p.errorf(tok, "unknown statement %v", tok)
+	}
+}
+
+// bind parses "bind <address>[:<port>]" and "bind <address> port <port>"
+func (p *parser) bind() error {
+	tok, err := p.expect(tokenWord)
+	if err != nil {
+		return err
+	}
+
+	host, port, err := splitAddress(tok.value)
+	if err != nil {
+		return p.errorf(tok, "invalid address %v: %v", tok, err)
+	}
+
+	if next := p.peek(); next.kind == tokenWord && next.value == "port" {
+		p.next()
+		if port >= 0 {
+			return p.errorf(next, "port given twice")
+		}
+		if port, err = p.number(0, 65535); err != nil {
+			return err
+		}
+	}
+	if port < 0 {
+		port = 0
+	}
+
+	var ip net.IP
+	if host == "any" {
+		ip = net.IPv4zero
+	} else if ip = net.ParseIP(host); ip == nil {
+		return p.errorf(tok, "invalid IP address '%s'", host)
+	}
+
+	p.config.Bind = append(p.config.Bind, fastd.Sockaddr{IP: ip, Port: uint16(port)})
+	return p.end()
+}
+
+// splitAddress splits an address with an optional port. The port is -1
+// if it is missing.
+func splitAddress(addr string) (string, int, error) {
+	if strings.HasPrefix(addr, "[") {
+		end := strings.Index(addr, "]")
+		if end < 0 {
+			return "", 0, fmt.Errorf("missing ']'")
+		}
+		if end == len(addr)-1 {
+			return addr[1:end], -1, nil
+		}
+	} else if strings.Count(addr, ":") != 1 {
+		return addr, -1, nil
+	}
+
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid port '%s'", portStr)
+	}
+	return host, int(port), nil
+}
+
+// method parses "method <name>"
+func (p *parser) method() error {
+	tok, err := p.value()
+	if err != nil {
+		return err
+	}
+
+	known := false
+	for _, name := range fastd.MethodNames() {
+		known = known || name == tok.value
+	}
+	if !known {
+		return p.errorf(tok, "unknown method %v", tok)
+	}
+
+	p.config.Methods = append(p.config.Methods, tok.value)
+	return p.end()
+}
+
+// mode parses "mode tun|tap|multitap". Every peer gets its own
+// interface, so tap and multitap are equivalent.
+func (p *parser) mode() error {
+	tok, err := p.expect(tokenWord)
+	if err != nil {
+		return err
+	}
+
+	switch tok.value {
+	case "tun":
+		p.config.Modes = []fastd.Mode{fastd.ModeTUN}
+	case "tap", "multitap":
+		p.config.Modes = []fastd.Mode{fastd.ModeTAP}
+	default:
+		return p.errorf(tok, "unknown mode %v", tok)
+	}
+	return p.end()
+}
+
+// include parses "include <file>", "include peer <file> [as <name>]"
+// and "include peers from <dir>"
+func (p *parser) include() error {
+	tok := p.next()
+
+	switch {
+	case tok.kind == tokenString:
+		if err := p.end(); err != nil {
+			return err
+		}
+		if p.depth >= maxIncludeDepth {
+			return p.errorf(tok, "includes nested too deeply")
+		}
+		if err := p.config.include(p.path(tok.value), p.depth+1); err != nil {
+			return wrapIncludeError(err, p.errorf(tok, "unable to include %v", tok))
+		}
+		return nil
+
+	case tok.kind == tokenWord && tok.value == "peer":
+		file, err := p.expect(tokenString)
+		if err != nil {
+			return err
+		}
+		name := filepath.Base(file.value)
+		if next := p.peek(); next.kind == tokenWord && next.value == "as" {
+			p.next()
+			tok, err := p.expect(tokenString)
+			if err != nil {
+				return err
+			}
+			name = tok.value
+		}
+		if err := p.end(); err != nil {
+			return err
+		}
+
+		peer, err := loadPeer(p.path(file.value), name)
+		if err != nil {
+			return wrapIncludeError(err, p.errorf(file, "unable to include peer %v", file))
+		}
+		p.config.Peers = append(p.config.Peers, peer)
+		return nil
+
+	case tok.kind == tokenWord && tok.value == "peers":
+		if err := p.keyword("from"); err != nil {
+			return err
+		}
+		dir, err := p.expect(tokenString)
+		if err != nil {
+			return err
+		}
+		if err := p.end(); err != nil {
+			return err
+		}
+
+		path := p.path(dir.value)
+		peers, err := LoadPeerDir(path)
+		if err != nil {
+			return wrapIncludeError(err, p.errorf(dir, "unable to include peers from %v", dir))
+		}
+		p.config.PeerDirs = append(p.config.PeerDirs, path)
+		p.config.Peers = append(p.config.Peers, peers...)
+		return nil
+
+	default:
+		return p.errorf(tok, "expected file name, 'peer' or 'peers', got %v", tok)
+	}
+}
+
+// wrapIncludeError returns parse errors of included files and adds the
+// location of the include statement to other errors
+func wrapIncludeError(err error, location error) error {
+	if _, ok := err.(*ParseError); ok {
+		return err
+	}
+	perr := location.(*ParseError)
+	perr.Msg += ": " + err.Error()
+	return perr
+}
+
+// hook parses "on <event> [sync|async] <command>"
+func (p *parser) hook() error {
+	event, err := p.expect(tokenWord)
+	if err != nil {
+		return err
+	}
+
+	var target **fastd.Hook
+	switch event.value {
+	case "up":
+		target = &p.config.Hooks.Up
+	case "down":
+		target = &p.config.Hooks.Down
+	case "verify":
+		target = &p.config.Hooks.Verify
+	case "establish":
+		target = &p.config.Hooks.Establish
+	case "disestablish":
+		target = &p.config.Hooks.Disestablish
+	case "reject":
+		target = &p.config.Hooks.Reject
+	default:
+		return p.errorf(event, "unknown event %v", event)
+	}
+
+	hook := &fastd.Hook{}
+	if next := p.peek(); next.kind == tokenWord {
+		switch next.value {
+		case "sync":
+		case "async":
+			hook.Async = true
+		default:
+			return p.errorf(next, "expected 'sync', 'async' or command, got %v", next)
+		}
+		p.next()
+	}
+
+	cmd, err := p.expect(tokenString)
+	if err != nil {
+		return err
+	}
+	hook.Command = cmd.value
+
+	*target = hook
+	return p.end()
+}
+
+// peer parses "peer <name> { ... }" and "peer limit <n>"
+func (p *parser) peer() error {
+	tok := p.next()
+
+	if tok.kind == tokenWord && tok.value == "limit" {
+		limit, err := p.number(0, 1<<31-1)
+		if err != nil {
+			return err
+		}
+		p.config.PeerLimit = limit
+		return p.end()
+	}
+	if tok.kind != tokenString {
+		return p.errorf(tok, "expected peer name or 'limit', got %v", tok)
+	}
+
+	if _, err := p.expect(tokenOpen); err != nil {
+		return err
+	}
+
+	peer := &Peer{Name: tok.value}
+	for p.peek().kind != tokenClose {
+		if p.peek().kind == tokenEOF {
+			return p.errorf(p.peek(), "missing '}' of peer %q", peer.Name)
+		}
+		if err := p.peerStatement(peer); err != nil {
+			return err
+		}
+	}
+	end := p.next()
+
+	if peer.Key == nil {
+		return p.errorf(end, "peer %q has no key", peer.Name)
+	}
+	p.config.Peers = append(p.config.Peers, peer)
+	return nil
+}
+
+// peerStatement parses a statement of a peer block or file
+func (p *parser) peerStatement(peer *Peer) error {
+	tok, err := p.expect(tokenWord)
+	if err != nil {
+		return err
+	}
+
+	switch tok.value {
+	case "key":
+		key, keyTok, err := p.key()
+		if err != nil {
+			return err
+		}
+		if peer.Key != nil {
+			return p.errorf(keyTok, "peer %q has more than one key", peer.Name)
+		}
+		peer.Key = key
+		peer.file = p.file
+		peer.line = keyTok.line
+		return p.end()
+	case "remote":
+		return p.remote(peer)
+	case "float":
+		float, err := p.boolean()
+		if err != nil {
+			return err
+		}
+		peer.Float = float
+		return p.end()
+	default:
+		return p.errorf(tok, "unknown peer statement %v", tok)
+	}
+}
+
+// remote parses "remote [ipv4|ipv6] <host> port <port>" and
+// "remote <address>:<port>"
+func (p *parser) remote(peer *Peer) error {
+	if next := p.peek(); next.kind == tokenWord && (next.value == "ipv4" || next.value == "ipv6") {
+		p.next()
+	}
+
+	tok, err := p.value()
+	if err != nil {
+		return err
+	}
+
+	host, port := tok.value, -1
+	if tok.kind == tokenWord {
+		if host, port, err = splitAddress(tok.value); err != nil {
+			return p.errorf(tok, "invalid address %v: %v", tok, err)
+		}
+	}
+
+	if next := p.peek(); next.kind == tokenWord && next.value == "port" {
+		p.next()
+		if port >= 0 {
+			return p.errorf(next, "port given twice")
+		}
+		if port, err = p.number(1, 65535); err != nil {
+			return err
+		}
+	}
+	if port < 0 {
+		return p.errorf(tok, "port of remote %v missing", tok)
+	}
+
+	peer.Remotes = append(peer.Remotes, net.JoinHostPort(host, strconv.Itoa(port)))
+	return p.end()
+}
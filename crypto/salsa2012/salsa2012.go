@@ -0,0 +1,96 @@
+// Package salsa2012 implements the Salsa20/12 stream cipher, the
+// reduced-round variant of Salsa20 selected by the eSTREAM portfolio.
+package salsa2012
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+const (
+	// KeySize is the size of a key in bytes.
+	KeySize = 32
+
+	// NonceSize is the size of a nonce in bytes.
+	NonceSize = 8
+
+	// BlockSize is the size of a keystream block in bytes.
+	BlockSize = 64
+
+	rounds = 12
+)
+
+// sigma is the constant "expand 32-byte k"
+var sigma = [4]uint32{0x61707865, 0x3320646e, 0x79622d32, 0x6b206574}
+
+// XORKeyStream crypts bytes from in to out using the given key and
+// nonce. The block counter starts at zero. In and out must overlap
+// entirely or not at all.
+func XORKeyStream(out, in []byte, nonce *[NonceSize]byte, key *[KeySize]byte) {
+	xorKeyStream(out, in, nonce, key, rounds)
+}
+
+func xorKeyStream(out, in []byte, nonce *[NonceSize]byte, key *[KeySize]byte, rounds int) {
+	if len(out) < len(in) {
+		panic("salsa2012: output smaller than input")
+	}
+
+	var state [16]uint32
+	state[0] = sigma[0]
+	state[5] = sigma[1]
+	state[10] = sigma[2]
+	state[15] = sigma[3]
+	for i := 0; i < 4; i++ {
+		state[1+i] = binary.LittleEndian.Uint32(key[4*i:])
+		state[11+i] = binary.LittleEndian.Uint32(key[16+4*i:])
+	}
+	state[6] = binary.LittleEndian.Uint32(nonce[0:])
+	state[7] = binary.LittleEndian.Uint32(nonce[4:])
+
+	var block [BlockSize]byte
+	for counter := uint64(0); len(in) > 0; counter++ {
+		state[8] = uint32(counter)
+		state[9] = uint32(counter >> 32)
+		core(&block, &state, rounds)
+
+		n := len(in)
+		if n > BlockSize {
+			n = BlockSize
+		}
+		for i := 0; i < n; i++ {
+			out[i] = in[i] ^ block[i]
+		}
+		in = in[n:]
+		out = out[n:]
+	}
+}
+
+// core computes a keystream block from the given state
+func core(out *[BlockSize]byte, state *[16]uint32, rounds int) {
+	x := *state
+
+	for i := 0; i < rounds; i += 2 {
+		// column round
+		quarterRound(&x, 0, 4, 8, 12)
+		quarterRound(&x, 5, 9, 13, 1)
+		quarterRound(&x, 10, 14, 2, 6)
+		quarterRound(&x, 15, 3, 7, 11)
+
+		// row round
+		quarterRound(&x, 0, 1, 2, 3)
+		quarterRound(&x, 5, 6, 7, 4)
+		quarterRound(&x, 10, 11, 8, 9)
+		quarterRound(&x, 15, 12, 13, 14)
+	}
+
+	for i := range x {
+		binary.LittleEndian.PutUint32(out[4*i:], x[i]+state[i])
+	}
+}
+
+func quarterRound(x *[16]uint32, a, b, c, d int) {
+	x[b] ^= bits.RotateLeft32(x[a]+x[d], 7)
+	x[c] ^= bits.RotateLeft32(x[b]+x[a], 9)
+	x[d] ^= bits.RotateLeft32(x[c]+x[b], 13)
+	x[a] ^= bits.RotateLeft32(x[d]+x[c], 18)
+}
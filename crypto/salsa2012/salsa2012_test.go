@@ -0,0 +1,61 @@
+package salsa2012
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/salsa20"
+)
+
+func testInput() (key [KeySize]byte, nonce [NonceSize]byte, in []byte) {
+	for i := range key {
+		key[i] = byte(i)
+	}
+	for i := range nonce {
+		nonce[i] = byte(0xf0 + i)
+	}
+	in = make([]byte, 3*BlockSize+17)
+	for i := range in {
+		in[i] = byte(i * 7)
+	}
+	return
+}
+
+// The implementation with 20 rounds must match the reference Salsa20.
+func TestSalsa20(t *testing.T) {
+	key, nonce, in := testInput()
+
+	expected := make([]byte, len(in))
+	salsa20.XORKeyStream(expected, in, nonce[:], &key)
+
+	out := make([]byte, len(in))
+	xorKeyStream(out, in, &nonce, &key, 20)
+
+	assert.Equal(t, expected, out)
+}
+
+func TestXORKeyStream(t *testing.T) {
+	assert := assert.New(t)
+	key, nonce, in := testInput()
+
+	out := make([]byte, len(in))
+	XORKeyStream(out, in, &nonce, &key)
+	assert.NotEqual(in, out)
+
+	// reduced rounds differ from Salsa20
+	salsa := make([]byte, len(in))
+	salsa20.XORKeyStream(salsa, in, nonce[:], &key)
+	assert.NotEqual(salsa, out)
+
+	// in-place decryption
+	XORKeyStream(out, out, &nonce, &key)
+	assert.Equal(in, out)
+
+	// the keystream is independent of the chunk size
+	chunked := make([]byte, BlockSize)
+	XORKeyStream(chunked, in[:BlockSize], &nonce, &key)
+	full := make([]byte, len(in))
+	XORKeyStream(full, in, &nonce, &key)
+	assert.True(bytes.Equal(chunked, full[:BlockSize]))
+}
@@ -0,0 +1,238 @@
+// Package umac implements UHASH, the universal hash function of UMAC
+// as specified in RFC 4418.
+//
+// The package does not include the AES based key and pad derivation of
+// RFC 4418. Callers provide the key material and mask the hash with a
+// pad of their own, as done by the fastd umac methods.
+package umac
+
+import (
+	"encoding/binary"
+	"math/big"
+	"math/bits"
+)
+
+const (
+	l1KeyLen  = 1024 // L1-KEY-LEN in bytes
+	l2KeyLen  = 24   // L2 key size per stream
+	l3Key1Len = 64   // L3 key 1 size per stream
+	l3Key2Len = 4    // L3 key 2 size per stream
+
+	p36 = 1<<36 - 5
+	p64 = 0xffffffffffffffc5 // 2^64 - 59
+
+	mask64 = 0x01ffffff01ffffff
+
+	poly64Words = 1 << 14 // number of L1 outputs hashed by POLY-64
+)
+
+var (
+	p128         = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 128), big.NewInt(159))
+	maxWord128   = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 128), new(big.Int).Lsh(big.NewInt(1), 96))
+	offset128    = big.NewInt(159)
+	marker128    = new(big.Int).Sub(p128, big.NewInt(1))
+	mask128      = new(big.Int).SetBytes([]byte{0x01, 0xff, 0xff, 0xff, 0x01, 0xff, 0xff, 0xff, 0x01, 0xff, 0xff, 0xff, 0x01, 0xff, 0xff, 0xff})
+	maxWordRange = uint64(1<<64 - 1<<32)
+)
+
+// KeySize returns the size of the key for the given tag size in bytes.
+func KeySize(tagSize int) int {
+	iters := tagSize / 4
+	return l1KeyLen + (iters-1)*16 + iters*(l2KeyLen+l3Key1Len+l3Key2Len)
+}
+
+// Hash is a keyed UHASH instance.
+type Hash struct {
+	iters  int
+	l1Key  []uint32 // L1 key, shifted by 4 words per stream
+	l2Key  []uint64 // k64 per stream
+	l2Big  []*big.Int
+	l3Key1 [][8]uint64
+	l3Key2 []uint32
+}
+
+// New creates a UHASH instance producing tags of tagSize bytes, which
+// must be one of 4, 8, 12 or 16. The key is the concatenation of the
+// L1, L2, L3-1 and L3-2 keys and must be KeySize(tagSize) bytes long.
+func New(key []byte, tagSize int) *Hash {
+	if tagSize%4 != 0 || tagSize < 4 || tagSize > 16 {
+		panic("umac: invalid tag size")
+	}
+	if len(key) != KeySize(tagSize) {
+		panic("umac: invalid key size")
+	}
+
+	iters := tagSize / 4
+	h := &Hash{
+		iters:  iters,
+		l1Key:  make([]uint32, (l1KeyLen+(iters-1)*16)/4),
+		l2Key:  make([]uint64, iters),
+		l2Big:  make([]*big.Int, iters),
+		l3Key1: make([][8]uint64, iters),
+		l3Key2: make([]uint32, iters),
+	}
+
+	for i := range h.l1Key {
+		h.l1Key[i] = binary.BigEndian.Uint32(key)
+		key = key[4:]
+	}
+	for i := 0; i < iters; i++ {
+		h.l2Key[i] = binary.BigEndian.Uint64(key) & mask64
+		h.l2Big[i] = new(big.Int).And(new(big.Int).SetBytes(key[8:24]), mask128)
+		key = key[l2KeyLen:]
+	}
+	for i := 0; i < iters; i++ {
+		for j := range h.l3Key1[i] {
+			h.l3Key1[i][j] = binary.BigEndian.Uint64(key) % p36
+			key = key[8:]
+		}
+	}
+	for i := 0; i < iters; i++ {
+		h.l3Key2[i] = binary.BigEndian.Uint32(key)
+		key = key[l3Key2Len:]
+	}
+
+	return h
+}
+
+// Size returns the tag size in bytes.
+func (h *Hash) Size() int {
+	return 4 * h.iters
+}
+
+// Sum appends the hash of msg to out and returns the resulting slice.
+func (h *Hash) Sum(out, msg []byte) []byte {
+	var y [4]byte
+	for i := 0; i < h.iters; i++ {
+		key := h.l1Key[4*i : 4*i+l1KeyLen/4]
+
+		var hi, lo uint64
+		if len(msg) <= l1KeyLen {
+			lo = l1Hash(key, msg)
+		} else {
+			hi, lo = h.l2Hash(i, key, msg)
+		}
+
+		binary.BigEndian.PutUint32(y[:], h.l3Hash(i, hi, lo))
+		out = append(out, y[:]...)
+	}
+	return out
+}
+
+// l1Hash computes NH over a message of at most 1024 bytes
+func l1Hash(key []uint32, msg []byte) uint64 {
+	var buf [l1KeyLen]byte
+	n := copy(buf[:], msg)
+
+	// zero-pad to a positive multiple of 32 bytes
+	padded := (n + 31) &^ 31
+	if padded == 0 {
+		padded = 32
+	}
+
+	return nh(key, buf[:padded]) + uint64(n)*8
+}
+
+// nh is the NH hash function of the L1 layer
+func nh(key []uint32, msg []byte) (y uint64) {
+	for i := 0; len(msg) > 0; i += 8 {
+		var m [8]uint32
+		for j := range m {
+			m[j] = binary.LittleEndian.Uint32(msg[4*j:])
+		}
+		for j := 0; j < 4; j++ {
+			y += uint64(m[j]+key[i+j]) * uint64(m[j+4]+key[i+j+4])
+		}
+		msg = msg[32:]
+	}
+	return
+}
+
+// l2Hash computes the L1 hash for every 1024 byte chunk and compresses
+// the result using POLY.
+func (h *Hash) l2Hash(stream int, key []uint32, msg []byte) (hi, lo uint64) {
+	var words []uint64
+	for len(msg) > l1KeyLen {
+		words = append(words, nh(key, msg[:l1KeyLen])+l1KeyLen*8)
+		msg = msg[l1KeyLen:]
+	}
+	words = append(words, l1Hash(key, msg))
+
+	// POLY(64, 2^64 - 2^32, k64, M_1) for the first 2^14 L1 outputs
+	n := len(words)
+	if n > poly64Words {
+		n = poly64Words
+	}
+
+	y := uint64(1)
+	k := h.l2Key[stream]
+	for _, m := range words[:n] {
+		if m >= maxWordRange {
+			y = poly64(y, k, p64-1)
+			y = poly64(y, k, m-(1<<64-p64))
+		} else {
+			y = poly64(y, k, m)
+		}
+	}
+
+	if n == len(words) {
+		return 0, y
+	}
+
+	// POLY(128, 2^128 - 2^96, k128, uint2str(y, 16) || M_2)
+	rest := append([]uint64{0, y}, words[n:]...)
+	if len(rest)%2 == 0 {
+		rest = append(rest, 1<<63, 0)
+	} else {
+		rest = append(rest, 1<<63)
+	}
+
+	k128 := h.l2Big[stream]
+	y128 := big.NewInt(1)
+	m := new(big.Int)
+	low := new(big.Int)
+	for i := 0; i < len(rest); i += 2 {
+		m.SetUint64(rest[i])
+		m.Lsh(m, 64)
+		m.Or(m, low.SetUint64(rest[i+1]))
+
+		if m.Cmp(maxWord128) >= 0 {
+			y128.Mul(y128, k128).Add(y128, marker128).Mod(y128, p128)
+			m.Sub(m, offset128)
+		}
+		y128.Mul(y128, k128).Add(y128, m).Mod(y128, p128)
+	}
+
+	var buf [16]byte
+	b := y128.Bytes()
+	copy(buf[16-len(b):], b)
+	return binary.BigEndian.Uint64(buf[:8]), binary.BigEndian.Uint64(buf[8:])
+}
+
+// poly64 returns (k*y + m) mod p64
+func poly64(y, k, m uint64) uint64 {
+	hi, lo := bits.Mul64(k, y)
+	_, r := bits.Div64(hi, lo, p64)
+
+	r, carry := bits.Add64(r, m, 0)
+	if carry != 0 {
+		r += 1<<64 - p64
+	}
+	if r >= p64 {
+		r -= p64
+	}
+	return r
+}
+
+// l3Hash compresses the 16 byte L2 output into 32 bits
+func (h *Hash) l3Hash(stream int, hi, lo uint64) uint32 {
+	var y uint64
+	key := &h.l3Key1[stream]
+
+	for i := 0; i < 4; i++ {
+		y += uint64(uint16(hi>>(48-16*i))) * key[i]
+		y += uint64(uint16(lo>>(48-16*i))) * key[4+i]
+	}
+
+	return uint32(y%p36) ^ h.l3Key2[stream]
+}
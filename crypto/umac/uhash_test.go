@@ -0,0 +1,118 @@
+package umac
+
+import (
+	"crypto/aes"
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// kdf is the AES based key derivation function of RFC 4418
+func kdf(key []byte, index uint64, length int) []byte {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+
+	var in [16]byte
+	out := make([]byte, (length+15)&^15)
+	for i := 0; i < len(out)/16; i++ {
+		binary.BigEndian.PutUint64(in[:8], index)
+		binary.BigEndian.PutUint64(in[8:], uint64(i+1))
+		block.Encrypt(out[16*i:], in[:])
+	}
+	return out[:length]
+}
+
+// pdf is the AES based pad derivation function of RFC 4418
+func pdf(key, nonce []byte, tagSize int) []byte {
+	var index int
+	switch tagSize {
+	case 4:
+		index = int(nonce[len(nonce)-1] & 3)
+	case 8:
+		index = int(nonce[len(nonce)-1] & 1)
+	}
+
+	var in [16]byte
+	copy(in[:], nonce)
+	in[len(nonce)-1] ^= byte(index)
+
+	block, err := aes.NewCipher(kdf(key, 0, 16))
+	if err != nil {
+		panic(err)
+	}
+	var out [16]byte
+	block.Encrypt(out[:], in[:])
+
+	return out[index*tagSize : (index+1)*tagSize]
+}
+
+// testUMAC computes an RFC 4418 UMAC tag
+func testUMAC(key, nonce []byte, tagSize int, msg []byte) string {
+	iters := tagSize / 4
+	var uhashKey []byte
+	uhashKey = append(uhashKey, kdf(key, 1, l1KeyLen+(iters-1)*16)...)
+	uhashKey = append(uhashKey, kdf(key, 2, iters*l2KeyLen)...)
+	uhashKey = append(uhashKey, kdf(key, 3, iters*l3Key1Len)...)
+	uhashKey = append(uhashKey, kdf(key, 4, iters*l3Key2Len)...)
+
+	tag := New(uhashKey, tagSize).Sum(nil, msg)
+	pad := pdf(key, nonce, tagSize)
+	for i := range tag {
+		tag[i] ^= pad[i]
+	}
+	return strings.ToUpper(hex.EncodeToString(tag))
+}
+
+// Test vectors from RFC 4418, appendix
+func TestRFC4418(t *testing.T) {
+	key := []byte("abcdefghijklmnop")
+	nonce := []byte("bcdefghi")
+
+	tests := []struct {
+		msg    string
+		umac32 string
+		umac64 string
+		umac96 string
+	}{
+		{"", "113145FB", "6E155FAD26900BE1", "32FEDB100C79AD58F07FF764"},
+		{strings.Repeat("a", 3), "3B91D102", "44B5CB542F220104", "185E4FE905CBA7BD85E4C2DC"},
+		{strings.Repeat("a", 1<<10), "599B350B", "26BF2F5D60118BD9", "7A54ABE04AF82D60FB298C3C"},
+		{strings.Repeat("a", 1<<15), "58DCF532", "27F8EF643B0D118D", "7B136BD911E4B734286EF2BE"},
+		{strings.Repeat("a", 1<<20), "DB6364D1", "A4477E87E9F55853", "F8ACFA3AC31CFEEA047F7B11"},
+		{strings.Repeat("a", 1<<25), "85EE5CAE", "FACA46F856E9B45F", "A621C2457C0012E64F3FDAE9"},
+		{"abc", "ABF3A3A0", "D4D7B9F6BD4FBFCF", "883C3D4B97A61976FFCF2323"},
+		{strings.Repeat("abc", 500), "ABEB3C8B", "D4CF26DDEFD5C01A", "8824A260C53C66A36C9260A6"},
+	}
+
+	for _, test := range tests {
+		msg := []byte(test.msg)
+		assert.Equal(t, test.umac32, testUMAC(key, nonce, 4, msg), "UMAC-32 of %d bytes", len(msg))
+		assert.Equal(t, test.umac64, testUMAC(key, nonce, 8, msg), "UMAC-64 of %d bytes", len(msg))
+		assert.Equal(t, test.umac96, testUMAC(key, nonce, 12, msg), "UMAC-96 of %d bytes", len(msg))
+	}
+}
+
+func TestInvalidParameters(t *testing.T) {
+	assert.PanicsWithValue(t, "umac: invalid tag size", func() {
+		New(nil, 6)
+	})
+	assert.PanicsWithValue(t, "umac: invalid key size", func() {
+		New(make([]byte, 100), 16)
+	})
+}
+
+func BenchmarkSum(b *testing.B) {
+	h := New(make([]byte, KeySize(16)), 16)
+	msg := make([]byte, 1400)
+	out := make([]byte, 0, 16)
+
+	b.SetBytes(int64(len(msg)))
+	for n := 0; n < b.N; n++ {
+		h.Sum(out, msg)
+	}
+}
@@ -0,0 +1,618 @@
+package fastd
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Errors returned by the client.
+var (
+	ErrHandshakeTimeout = errors.New("handshake timed out")
+	ErrInvalidReply     = errors.New("invalid handshake reply")
+	ErrInvalidSignature = errors.New("invalid signature")
+	ErrNoCommonMethod   = errors.New("no common method")
+)
+
+// HandshakeError is returned if the server rejected the handshake.
+// Servers sign error replies once the handshake key is known, unsigned
+// ones may have been sent by anyone.
+type HandshakeError struct {
+	Code     ReplyCode // reply code of the server
+	Detail   TLVKey    // record causing the error
+	Verified bool      // whether the reply was signed with the handshake key
+}
+
+func (err *HandshakeError) Error() string {
+	return fmt.Sprintf("handshake rejected: %v (%v)", err.Code, err.Detail)
+}
+
+// newHandshakeError returns the error of an error reply
+func newHandshakeError(reply *Message, verified bool) *HandshakeError {
+	code, _ := reply.Records.ReplyCode()
+	detail, _ := reply.Records.ErrorDetail()
+	return &HandshakeError{Code: code, Detail: detail, Verified: verified}
+}
+
+// handshakeFinishError is the type of an error reply to a finish message
+const handshakeFinishError = HandshakeFinish + 1
+
+// ClientConfig is the configuration of a fastd client.
+type ClientConfig struct {
+	Remote   string        // address of the server as host:port
+	PeerKey  []byte        // public key of the server
+	Secret   []byte        // our secret key
+	MTU      uint16        // tunnel MTU
+	Methods  []string      // acceptable methods in order of preference, defaults to all registered
+	Hostname string        // optional hostname sent to the server
+	TAP      bool          // use TAP (layer 2) instead of TUN mode
+	Timeout  time.Duration // handshake timeout, defaults to 5 seconds
+
+	RehandshakeInterval time.Duration // interval between handshakes, zero disables them
+	RehandshakeJitter   time.Duration // maximum random amount subtracted from the interval
+	SessionGrace        time.Duration // validity of the previous session after a handshake, defaults to DefaultSessionGrace
+}
+
+func (config *ClientConfig) mode() Mode {
+	if config.TAP {
+		return ModeTAP
+	}
+	return ModeTUN
+}
+
+// Client performs the initiator side of the fastd handshake.
+type Client struct {
+	config ClientConfig
+	keys   *KeyPair
+}
+
+// ClientSession is an established session of a client. Handshakes
+// started by either side are processed while reading packets.
+type ClientSession struct {
+	replay ReplayStats // packets rejected by the replay protection
+
+	Remote *net.UDPAddr
+	MTU    uint16
+	Vars   []byte // Vars sent by the server
+
+	IPv4          AddressConfig
+	IPv4PrefixLen uint8 // zero if not sent by the server
+	IPv6          AddressConfig
+	IPv6PrefixLen uint8 // zero if not sent by the server
+
+	client *Client
+	conn   *net.UDPConn
+	buf    []byte
+
+	session     *Session
+	previous    *Session   // replaced session during the grace window
+	handshake   *Handshake // handshake in progress
+	sharedKey   []byte
+	established time.Time
+	timer       *time.Timer
+	closed      bool
+	mtx         sync.Mutex
+}
+
+// NewClient validates the configuration and creates a client.
+func NewClient(config ClientConfig) (*Client, error) {
+	if config.Remote == "" {
+		return nil, errors.New("remote address missing")
+	}
+	if len(config.PeerKey) != KEYSIZE {
+		return nil, fmt.Errorf("wrong peer key size: expected=%d actual=%d", KEYSIZE, len(config.PeerKey))
+	}
+	if len(config.Secret) != KEYSIZE {
+		return nil, fmt.Errorf("wrong secret size: expected=%d actual=%d", KEYSIZE, len(config.Secret))
+	}
+	if config.MTU < MinMTU {
+		return nil, fmt.Errorf("MTU invalid: %d", config.MTU)
+	}
+	if len(config.Methods) == 0 {
+		config.Methods = MethodNames()
+	}
+	if config.Timeout == 0 {
+		config.Timeout = 5 * time.Second
+	}
+	if config.SessionGrace == 0 {
+		config.SessionGrace = DefaultSessionGrace
+	}
+
+	return &Client{
+		config: config,
+		keys:   NewKeyPair(config.Secret),
+	}, nil
+}
+
+// Connect performs the handshake with the server and returns the
+// established session.
+func (c *Client) Connect() (*ClientSession, error) {
+	addr, err := net.ResolveUDPAddr("udp", c.config.Remote)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to resolve %s", c.config.Remote)
+	}
+
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := c.handshake(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	session.Remote = addr
+	session.scheduleHandshake()
+
+	return session, nil
+}
+
+func (c *Client) handshake(conn *net.UDPConn) (*ClientSession, error) {
+	hs := &Handshake{initiator: true, ourHandshakeKey: RandomKeypair()}
+
+	if err := writeMessage(conn, c.newRequest(hs)); err != nil {
+		return nil, errors.Wrap(err, "unable to send handshake request")
+	}
+
+	reply, err := waitForReply(conn, time.Now().Add(c.config.Timeout))
+	if err != nil {
+		return nil, err
+	}
+
+	session, finish, err := completeHandshake(reply, hs, c.keys, c.config.PeerKey, c.config.Methods)
+	if err != nil {
+		return nil, err
+	}
+	finish.Records.SetMTU(c.config.MTU)
+
+	if err := writeMessage(conn, finish); err != nil {
+		return nil, errors.Wrap(err, "unable to send handshake finish")
+	}
+
+	result := &ClientSession{
+		MTU:         c.config.MTU,
+		client:      c,
+		conn:        conn,
+		buf:         make([]byte, maxPacketSize),
+		session:     session,
+		sharedKey:   hs.SharedKey(),
+		established: time.Now(),
+	}
+	session.stats = &result.replay
+	result.Vars, _ = reply.Records.Vars()
+	result.IPv4.LocalAddr, _ = reply.Records.IPv4Addr()
+	result.IPv4.DestAddr, _ = reply.Records.IPv4DstAddr()
+	result.IPv4PrefixLen, _ = reply.Records.IPv4PrefixLen()
+	result.IPv6.LocalAddr, _ = reply.Records.IPv6Addr()
+	result.IPv6.DestAddr, _ = reply.Records.IPv6DstAddr()
+	result.IPv6PrefixLen, _ = reply.Records.IPv6PrefixLen()
+
+	return result, nil
+}
+
+// newRequest creates a handshake request for our side of hs
+func (c *Client) newRequest(hs *Handshake) *Message {
+	request := newHandshakeRequest(c.keys, hs.ourHandshakeKey, c.config.PeerKey, c.config.mode())
+	if c.config.Hostname != "" {
+		request.Records.SetHostname(c.config.Hostname)
+	}
+	return request
+}
+
+// newHandshakeRequest creates the first message of a handshake
+func newHandshakeRequest(ourKey, ourHandshakeKey *KeyPair, peerKey []byte, mode Mode) *Message {
+	request := &Message{Type: TypeHandshake}
+	request.Records.
+		SetHandshakeType(HandshakeRequest).
+		SetMode(mode).
+		SetProtocolName(protocolName).
+		SetVersionName("v18").
+		SetSenderKey(ourKey.Public()).
+		SetRecipientKey(peerKey).
+		SetSenderHandshakeKey(ourHandshakeKey.Public())
+
+	return request
+}
+
+// completeHandshake verifies the reply to a handshake we initiated. It
+// returns the session with our most preferred method offered by the peer
+// and the signed finish message.
+func completeHandshake(reply *Message, hs *Handshake, ourKey *KeyPair, peerKey []byte, methods []string) (*Session, *Message, error) {
+	code, err := reply.Records.ReplyCode()
+	if err != nil {
+		return nil, nil, errors.Wrap(ErrInvalidReply, "reply code missing")
+	}
+	if code != ReplySuccess && reply.Records[RecordTLVMAC] == nil {
+		return nil, nil, newHandshakeError(reply, false)
+	}
+
+	if key, _ := reply.Records.RecipientHandshakeKey(); !bytes.Equal(key, hs.ourHandshakeKey.Public()) {
+		return nil, nil, errors.Wrap(ErrInvalidReply, "recipient handshake key mismatch")
+	}
+
+	peerHandshakeKey, _ := reply.Records.SenderHandshakeKey()
+	if len(peerHandshakeKey) != KEYSIZE {
+		return nil, nil, errors.Wrap(ErrInvalidReply, "invalid sender handshake key")
+	}
+
+	hs.peerHandshakeKey = peerHandshakeKey
+	if !hs.makeSharedKey(true, ourKey, peerKey) {
+		return nil, nil, errors.Wrap(ErrInvalidReply, "unable to make shared handshake key")
+	}
+
+	reply.SignKey = hs.sharedKey
+	if !reply.VerifySignature() {
+		return nil, nil, ErrInvalidSignature
+	}
+	if code != ReplySuccess {
+		return nil, nil, newHandshakeError(reply, true)
+	}
+
+	method := selectMethod(methods, reply)
+	if method == "" {
+		return nil, nil, ErrNoCommonMethod
+	}
+
+	session, err := hs.NewSession(method)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	finish := reply.NewReply()
+	finish.SignKey = hs.sharedKey
+	finish.Records.
+		SetSenderKey(ourKey.Public()).
+		SetRecipientKey(peerKey).
+		SetSenderHandshakeKey(hs.ourHandshakeKey.Public()).
+		SetRecipientHandshakeKey(hs.peerHandshakeKey).
+		SetMethodName(method)
+
+	return session, finish, nil
+}
+
+// selectMethod returns our most preferred method offered in the reply
+func selectMethod(methods []string, reply *Message) string {
+	offered, _ := reply.Records.MethodList()
+	for _, method := range methods {
+		if contains(offered, method) {
+			return method
+		}
+	}
+	return ""
+}
+
+// waitForReply reads from conn until a handshake reply arrives
+func waitForReply(conn *net.UDPConn, deadline time.Time) (*Message, error) {
+	buf := make([]byte, maxPacketSize)
+
+	conn.SetReadDeadline(deadline)
+	defer conn.SetReadDeadline(time.Time{})
+
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Timeout() {
+				return nil, ErrHandshakeTimeout
+			}
+			return nil, err
+		}
+		if n == 0 || buf[0] != byte(TypeHandshake) {
+			continue
+		}
+
+		msg, err := ParseMessage(buf[:n], false)
+		if err != nil {
+			log.WithError(err).Debug("unable to parse message")
+			continue
+		}
+
+		if typ, _ := msg.Records.HandshakeType(); typ == HandshakeReply {
+			return msg, nil
+		}
+	}
+}
+
+// Method returns the name of the current method.
+func (s *ClientSession) Method() string {
+	return s.current().Method()
+}
+
+// SharedKey returns the shared key of the last handshake.
+func (s *ClientSession) SharedKey() []byte {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.sharedKey
+}
+
+// Age returns the time since the last handshake.
+func (s *ClientSession) Age() time.Duration {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return time.Since(s.established)
+}
+
+// ReplayStats returns the number of data packets rejected by the replay
+// protection.
+func (s *ClientSession) ReplayStats() ReplayStats {
+	return s.replay.load()
+}
+
+// Close closes the connection to the server.
+func (s *ClientSession) Close() error {
+	s.mtx.Lock()
+	s.closed = true
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	s.mtx.Unlock()
+
+	return s.conn.Close()
+}
+
+func (s *ClientSession) current() *Session {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.session
+}
+
+// WritePacket encrypts the payload and sends it to the server. An
+// empty payload is sent as keepalive.
+func (s *ClientSession) WritePacket(payload []byte) error {
+	session := s.current()
+
+	pkt := make([]byte, 1, 1+len(payload)+session.Overhead())
+	pkt[0] = byte(TypeData)
+
+	_, err := s.conn.Write(session.Encrypt(pkt, payload))
+	return err
+}
+
+// ReadPacket reads the next data packet from the server and appends
+// the decrypted payload to dst. Packets that fail to decrypt and
+// keepalives are skipped, handshake packets are processed. A handshake
+// rejected by a signed error reply is returned as *HandshakeError.
+// ReadPacket must not be called concurrently.
+func (s *ClientSession) ReadPacket(dst []byte) ([]byte, error) {
+	for {
+		n, err := s.conn.Read(s.buf)
+		if err != nil {
+			return nil, err
+		}
+		if n < 1 {
+			continue
+		}
+
+		switch MessageType(s.buf[0]) {
+		case TypeHandshake:
+			if err := s.handleHandshake(s.buf[:n]); err != nil {
+				if rejected, ok := err.(*HandshakeError); ok && rejected.Verified {
+					return nil, err
+				}
+				log.WithFields(logrus.Fields{
+					logrus.ErrorKey: err,
+					"remote":        s.Remote.String(),
+				}).Error("handshake failed")
+			}
+		case TypeData:
+			if payload := s.decrypt(dst, s.buf[1:n]); len(payload) > len(dst) {
+				return payload, nil
+			}
+		}
+	}
+}
+
+// decrypt tries the current and the previous session
+func (s *ClientSession) decrypt(dst, data []byte) []byte {
+	s.mtx.Lock()
+	session, previous := s.session, s.previous
+	s.mtx.Unlock()
+
+	payload, err := session.Decrypt(dst, data)
+	if err != nil && previous != nil {
+		payload, err = previous.Decrypt(dst, data)
+	}
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			logrus.ErrorKey: err,
+			"remote":        s.Remote.String(),
+		}).Debug("dropping data packet")
+		return nil
+	}
+	return payload
+}
+
+// Rehandshake starts a new handshake with the server. The handshake is
+// completed by ReadPacket.
+func (s *ClientSession) Rehandshake() error {
+	hs := &Handshake{
+		initiator:       true,
+		ourHandshakeKey: RandomKeypair(),
+		timeout:         time.Now().Add(s.client.config.Timeout),
+	}
+
+	s.mtx.Lock()
+	s.handshake = hs
+	s.mtx.Unlock()
+
+	return writeMessage(s.conn, s.client.newRequest(hs))
+}
+
+// scheduleHandshake starts the timer for the next handshake
+func (s *ClientSession) scheduleHandshake() {
+	config := &s.client.config
+	if config.RehandshakeInterval <= 0 {
+		return
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.closed {
+		return
+	}
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+
+	s.timer = time.AfterFunc(rehandshakeDelay(config.RehandshakeInterval, config.RehandshakeJitter), func() {
+		if err := s.Rehandshake(); err != nil {
+			log.WithError(err).Error("unable to send handshake request")
+		}
+	})
+}
+
+// activate replaces the current session
+func (s *ClientSession) activate(session *Session, hs *Handshake) {
+	session.stats = &s.replay
+
+	s.mtx.Lock()
+	s.session.expireAt(time.Now().Add(s.client.config.SessionGrace))
+	s.previous = s.session
+	s.session = session
+	s.handshake = nil
+	s.sharedKey = hs.SharedKey()
+	s.established = time.Now()
+	s.mtx.Unlock()
+
+	s.scheduleHandshake()
+}
+
+// handleHandshake processes a handshake packet of the server
+func (s *ClientSession) handleHandshake(buf []byte) error {
+	msg, err := ParseMessage(buf, false)
+	if err != nil {
+		return err
+	}
+
+	// Unsigned error replies come without keys
+	if code, _ := msg.Records.ReplyCode(); code != ReplySuccess && msg.Records[RecordTLVMAC] == nil {
+		return newHandshakeError(msg, false)
+	}
+
+	config := &s.client.config
+	if key, _ := msg.Records.SenderKey(); !bytes.Equal(key, config.PeerKey) {
+		return errors.New("sender key mismatch")
+	}
+	if key, _ := msg.Records.RecipientKey(); !bytes.Equal(key, s.client.keys.Public()) {
+		return errors.New("recipient key mismatch")
+	}
+
+	s.mtx.Lock()
+	hs := s.handshake
+	s.mtx.Unlock()
+
+	typ, _ := msg.Records.HandshakeType()
+	switch typ {
+	case HandshakeRequest:
+		return s.respond(msg)
+
+	case HandshakeReply:
+		if hs == nil || !hs.initiator {
+			return errors.New("no handshake started")
+		}
+		if hs.timeout.Before(time.Now()) {
+			return ErrHandshakeTimeout
+		}
+
+		session, finish, err := completeHandshake(msg, hs, s.client.keys, config.PeerKey, config.Methods)
+		if err != nil {
+			return err
+		}
+		finish.Records.SetMTU(s.MTU)
+
+		if err := writeMessage(s.conn, finish); err != nil {
+			return err
+		}
+		s.activate(session, hs)
+
+	case HandshakeFinish:
+		if hs == nil || hs.initiator {
+			return errors.New("no handshake started")
+		}
+		if hs.timeout.Before(time.Now()) {
+			return ErrHandshakeTimeout
+		}
+		if key, _ := msg.Records.RecipientHandshakeKey(); !bytes.Equal(key, hs.ourHandshakeKey.Public()) {
+			return errors.New("recipient handshake key mismatch")
+		}
+
+		msg.SignKey = hs.sharedKey
+		if !msg.VerifySignature() {
+			return ErrInvalidSignature
+		}
+
+		method, _ := msg.Records.MethodName()
+		if !contains(config.Methods, method) {
+			return fmt.Errorf("method name invalid: %s", method)
+		}
+
+		session, err := hs.NewSession(method)
+		if err != nil {
+			return err
+		}
+		s.activate(session, hs)
+
+	case handshakeFinishError:
+		// the server rejected our last finish message
+		msg.SignKey = s.SharedKey()
+		if !msg.VerifySignature() {
+			return ErrInvalidSignature
+		}
+		return newHandshakeError(msg, true)
+
+	default:
+		return fmt.Errorf("unexpected handshake type: %d", typ)
+	}
+
+	return nil
+}
+
+// respond answers a handshake request of the server
+func (s *ClientSession) respond(msg *Message) error {
+	config := &s.client.config
+
+	peerHandshakeKey, _ := msg.Records.SenderHandshakeKey()
+	if len(peerHandshakeKey) != KEYSIZE {
+		return errors.New("invalid sender handshake key")
+	}
+
+	hs := NewRespondingHandshake(s.client.keys, config.PeerKey, peerHandshakeKey)
+	if hs == nil {
+		return errors.New("unable to make shared handshake key")
+	}
+	hs.timeout = time.Now().Add(config.Timeout)
+
+	reply := msg.NewReply()
+	reply.SignKey = hs.sharedKey
+	reply.Records.
+		SetReplyCode(ReplySuccess).
+		SetMethodList(config.Methods...).
+		SetVersionName("v18").
+		SetSenderKey(s.client.keys.Public()).
+		SetSenderHandshakeKey(hs.ourHandshakeKey.Public()).
+		SetRecipientKey(config.PeerKey).
+		SetRecipientHandshakeKey(peerHandshakeKey).
+		SetMTU(s.MTU)
+
+	s.mtx.Lock()
+	s.handshake = hs
+	s.mtx.Unlock()
+
+	return writeMessage(s.conn, reply)
+}
+
+// writeMessage marshals and sends a handshake message
+func writeMessage(conn *net.UDPConn, msg *Message) error {
+	buf, err := msg.Marshal(false)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(buf)
+	return err
+}
@@ -0,0 +1,384 @@
+package fastd
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testServerSecretHex = "800e8ff23adcc5df5f6b911581667821ebecf1ecd95b10b6b5f92f4ebef7704c"
+	testClientSecretHex = "d82638e3bf436fe92c54649c33aca36064534d4171d7746b7ee36c822b8da149"
+)
+
+// startTestServer starts a UDP server on a random local port
+func startTestServer(t *testing.T, config Config) (*Server, string) {
+	config.Bind = []Sockaddr{{IP: net.ParseIP("127.0.0.1")}}
+	require.NoError(t, config.SetServerKey(testServerSecretHex))
+
+	srv, err := NewServer("udp", &config)
+	require.NoError(t, err)
+
+	return srv, srv.impl.(*UDPServer).connections[0].conn.LocalAddr().String()
+}
+
+func testClientConfig(remote string) ClientConfig {
+	return ClientConfig{
+		Remote:  remote,
+		PeerKey: testServerSecret.Public(),
+		Secret:  MustDecodeHex(testClientSecretHex),
+		MTU:     1400,
+		Timeout: time.Second,
+	}
+}
+
+func TestClient(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	tun, restore := withTestTun()
+	defer restore()
+
+	established := make(chan *Peer, 1)
+	srv, remote := startTestServer(t, Config{
+		AssignAddresses: func(peer *Peer) error {
+			peer.IPv4.LocalAddr = net.ParseIP("10.0.0.1")
+			peer.IPv4.DestAddr = net.ParseIP("10.0.0.2")
+			peer.IPv4PrefixLen = 31
+			return nil
+		},
+		OnEstablished: func(peer *Peer) {
+			established <- peer
+		},
+	})
+	defer srv.Stop()
+
+	config := testClientConfig(remote)
+	config.Methods = []string{"null+salsa2012+umac", "salsa2012+umac"}
+	client, err := NewClient(config)
+	require.NoError(err)
+
+	session, err := client.Connect()
+	require.NoError(err)
+	defer session.Close()
+
+	assert.Equal("null+salsa2012+umac", session.Method())
+	assert.EqualValues(1400, session.MTU)
+	assert.Len(session.SharedKey(), 32)
+	assert.Equal("10.0.0.2", session.IPv4.LocalAddr.String())
+	assert.Equal("10.0.0.1", session.IPv4.DestAddr.String())
+	assert.EqualValues(31, session.IPv4PrefixLen)
+	assert.Nil(session.IPv6.LocalAddr)
+
+	var peer *Peer
+	select {
+	case peer = <-established:
+		assert.Equal(testClientSecret.Public(), peer.PublicKey)
+	case <-time.After(time.Second):
+		t.Fatal("session not established")
+	}
+
+	// client → tunnel
+	require.NoError(session.WritePacket([]byte{0x45, 0x01}))
+	assert.Equal([]byte{0x45, 0x01}, receive(t, tun.toLocal))
+
+	// replayed packets are dropped
+	pkt := session.current().Encrypt([]byte{byte(TypeData)}, []byte{0x45, 0x02})
+	for i := 0; i < 2; i++ {
+		_, err = session.conn.Write(pkt)
+		require.NoError(err)
+	}
+	require.NoError(session.WritePacket([]byte{0x45, 0x03}))
+	assert.Equal([]byte{0x45, 0x02}, receive(t, tun.toLocal))
+	assert.Equal([]byte{0x45, 0x03}, receive(t, tun.toLocal))
+	assert.Equal(ReplayStats{Duplicate: 1}, peer.ReplayStats())
+
+	// tunnel → client
+	tun.toRemote <- []byte{0x60, 0x02}
+	session.conn.SetReadDeadline(time.Now().Add(time.Second))
+	payload, err := session.ReadPacket(nil)
+	require.NoError(err)
+	assert.Equal([]byte{0x60, 0x02}, payload)
+}
+
+func TestClientTAP(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	tun, restore := withTestTun()
+	defer restore()
+
+	srv, session, peer := connectTestClient(t, Config{}, func(config *ClientConfig) {
+		config.TAP = true
+	})
+	defer srv.Stop()
+	defer session.Close()
+
+	assert.Equal(ModeTAP, peer.Mode)
+	assert.Equal(ModeTAP, tun.mode)
+
+	// Ethernet frames are forwarded
+	frame := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x02, 0, 0, 0, 0, 1, 0x08, 0x06}
+	require.NoError(session.WritePacket(frame))
+	assert.Equal(frame, receive(t, tun.toLocal))
+
+	tun.toRemote <- frame
+	session.conn.SetReadDeadline(time.Now().Add(time.Second))
+	payload, err := session.ReadPacket(nil)
+	require.NoError(err)
+	assert.Equal(frame, payload)
+}
+
+func TestClientErrors(t *testing.T) {
+	assert := assert.New(t)
+	_, restore := withTestTun()
+	defer restore()
+
+	srv, remote := startTestServer(t, Config{Methods: []string{"null"}})
+	defer srv.Stop()
+
+	// wrong server key
+	config := testClientConfig(remote)
+	config.PeerKey = testClientSecret.Public()
+	client, err := NewClient(config)
+	assert.NoError(err)
+
+	_, err = client.Connect()
+	assert.Equal(&HandshakeError{Code: ReplyUnacceptableValue, Detail: RecordRecipientKey}, err)
+	assert.EqualError(err, "handshake rejected: unacceptable value (recipient_key)")
+
+	// signed rejection
+	srv2, remote2 := startTestServer(t, Config{MTU: 1280})
+	defer srv2.Stop()
+	client, err = NewClient(testClientConfig(remote2))
+	assert.NoError(err)
+
+	_, err = client.Connect()
+	assert.Equal(&HandshakeError{Code: ReplyUnacceptableValue, Detail: RecordMTU, Verified: true}, err)
+
+	// no common method
+	config = testClientConfig(remote)
+	config.Methods = []string{"salsa2012+umac"}
+	client, err = NewClient(config)
+	assert.NoError(err)
+
+	_, err = client.Connect()
+	assert.Equal(ErrNoCommonMethod, err)
+
+	// no answer
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	assert.NoError(err)
+	defer conn.Close()
+
+	config = testClientConfig(conn.LocalAddr().String())
+	config.Timeout = 100 * time.Millisecond
+	client, err = NewClient(config)
+	assert.NoError(err)
+
+	_, err = client.Connect()
+	assert.Equal(ErrHandshakeTimeout, err)
+}
+
+func TestNewClient(t *testing.T) {
+	assert := assert.New(t)
+
+	config := testClientConfig("")
+	_, err := NewClient(config)
+	assert.EqualError(err, "remote address missing")
+
+	config = testClientConfig("127.0.0.1:10000")
+	config.PeerKey = nil
+	_, err = NewClient(config)
+	assert.EqualError(err, "wrong peer key size: expected=32 actual=0")
+
+	config = testClientConfig("127.0.0.1:10000")
+	config.MTU = 100
+	_, err = NewClient(config)
+	assert.EqualError(err, "MTU invalid: 100")
+}
+
+// readPackets reads data packets of the session into a channel
+func readPackets(session *ClientSession) chan []byte {
+	ch := make(chan []byte, 10)
+	go func() {
+		for {
+			payload, err := session.ReadPacket(nil)
+			if err != nil {
+				close(ch)
+				return
+			}
+			ch <- payload
+		}
+	}()
+	return ch
+}
+
+// connectTestClient starts a server and connects a client
+func connectTestClient(t *testing.T, config Config, clientConfig func(*ClientConfig)) (*Server, *ClientSession, *Peer) {
+	established := make(chan *Peer, 1)
+	config.OnEstablished = func(peer *Peer) {
+		established <- peer
+	}
+	srv, remote := startTestServer(t, config)
+
+	cc := testClientConfig(remote)
+	if clientConfig != nil {
+		clientConfig(&cc)
+	}
+	client, err := NewClient(cc)
+	require.NoError(t, err)
+
+	session, err := client.Connect()
+	require.NoError(t, err)
+
+	select {
+	case peer := <-established:
+		return srv, session, peer
+	case <-time.After(time.Second):
+		t.Fatal("session not established")
+	}
+	return nil, nil, nil
+}
+
+// waitForKeyChange waits until the shared key of the session changes
+func waitForKeyChange(t *testing.T, session *ClientSession, old []byte) {
+	for i := 0; i < 100; i++ {
+		if !bytes.Equal(old, session.SharedKey()) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("no handshake")
+}
+
+func TestClientRehandshake(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	tun, restore := withTestTun()
+	defer restore()
+
+	srv, session, peer := connectTestClient(t, Config{SessionGrace: 100 * time.Millisecond}, nil)
+	defer srv.Stop()
+	defer session.Close()
+	packets := readPackets(session)
+
+	oldKey := session.SharedKey()
+	oldSession := session.current()
+	time.Sleep(20 * time.Millisecond)
+	age := peer.SessionAge()
+
+	require.NoError(session.Rehandshake())
+	waitForKeyChange(t, session, oldKey)
+
+	// wait for the server to process the finish
+	for i := 0; i < 100 && peer.SessionAge() >= age; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(peer.SessionAge() < age)
+
+	// the old session is valid during the grace period
+	pkt := oldSession.Encrypt([]byte{byte(TypeData)}, []byte{0x45, 0x01})
+	_, err := session.conn.Write(pkt)
+	require.NoError(err)
+	assert.Equal([]byte{0x45, 0x01}, receive(t, tun.toLocal))
+
+	// and rejected afterwards
+	time.Sleep(150 * time.Millisecond)
+	pkt = oldSession.Encrypt([]byte{byte(TypeData)}, []byte{0x45, 0x02})
+	_, err = session.conn.Write(pkt)
+	require.NoError(err)
+
+	// the new session is used in both directions
+	require.NoError(session.WritePacket([]byte{0x45, 0x03}))
+	assert.Equal([]byte{0x45, 0x03}, receive(t, tun.toLocal))
+
+	tun.toRemote <- []byte{0x60, 0x04}
+	assert.Equal([]byte{0x60, 0x04}, receive(t, packets))
+}
+
+func TestServerRehandshake(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	tun, restore := withTestTun()
+	defer restore()
+
+	rehandshakeCheckInterval = 10 * time.Millisecond
+	defer func() { rehandshakeCheckInterval = time.Second }()
+
+	srv, session, peer := connectTestClient(t, Config{
+		RehandshakeInterval: 200 * time.Millisecond,
+		RehandshakeJitter:   50 * time.Millisecond,
+	}, nil)
+	defer srv.Stop()
+	defer session.Close()
+	packets := readPackets(session)
+
+	oldKey := session.SharedKey()
+	waitForKeyChange(t, session, oldKey)
+	assert.True(peer.SessionAge() < 200*time.Millisecond)
+	assert.True(session.Age() < 200*time.Millisecond)
+
+	require.NoError(session.WritePacket([]byte{0x45, 0x02}))
+	assert.Equal([]byte{0x45, 0x02}, receive(t, tun.toLocal))
+
+	tun.toRemote <- []byte{0x60, 0x03}
+	assert.Equal([]byte{0x60, 0x03}, receive(t, packets))
+}
+
+func TestClientScheduledRehandshake(t *testing.T) {
+	_, restore := withTestTun()
+	defer restore()
+
+	srv, session, _ := connectTestClient(t, Config{}, func(config *ClientConfig) {
+		config.RehandshakeInterval = 100 * time.Millisecond
+		config.RehandshakeJitter = 50 * time.Millisecond
+	})
+	defer srv.Stop()
+	defer session.Close()
+	readPackets(session)
+
+	waitForKeyChange(t, session, session.SharedKey())
+}
+
+func TestClientRoaming(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	tun, restore := withTestTun()
+	defer restore()
+
+	srv, session, peer := connectTestClient(t, Config{}, nil)
+	defer srv.Stop()
+	session.Close()
+
+	// reconnect from a new source port
+	client, err := NewClient(testClientConfig(srv.impl.(*UDPServer).connections[0].conn.LocalAddr().String()))
+	require.NoError(err)
+	session, err = client.Connect()
+	require.NoError(err)
+	defer session.Close()
+	packets := readPackets(session)
+
+	local := session.conn.LocalAddr().(*net.UDPAddr)
+	remote := func() Sockaddr {
+		srv.peersMtx.RLock()
+		defer srv.peersMtx.RUnlock()
+		return peer.Remote
+	}
+	for i := 0; i < 100 && int(remote().Port) != local.Port; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the peer and its interface are migrated
+	assert.EqualValues(local.Port, remote().Port)
+	assert.Equal(1, srv.PeersCount())
+	assert.Equal(srv.GetPeers()[0], peer)
+	assert.Equal("fastd0", peer.Ifname)
+
+	require.NoError(session.WritePacket([]byte{0x45, 0x01}))
+	assert.Equal([]byte{0x45, 0x01}, receive(t, tun.toLocal))
+
+	tun.toRemote <- []byte{0x60, 0x02}
+	assert.Equal([]byte{0x60, 0x02}, receive(t, packets))
+}
@@ -3,6 +3,7 @@ package fastd
 import (
 	"encoding/hex"
 	"fmt"
+	"math/rand"
 	"time"
 
 	"github.com/pkg/errors"
@@ -11,15 +12,55 @@ import (
 
 // Config is the configuration of a fastd server instance
 type Config struct {
-	Bind            []Sockaddr
-	serverKeys      *KeyPair
-	Timeout         time.Duration
-	AssignAddresses func(*Peer)
-	OnVerify        func(*Peer) error
-	OnEstablished   func(*Peer)
-	OnTimeout       func(*Peer)
+	Bind       []Sockaddr
+	serverKeys *KeyPair
+	Timeout    time.Duration
+	Methods    []string // allowed methods in order of preference, defaults to all supported ones
+	Modes      []Mode   // allowed tunnel modes, defaults to all supported ones
+	MTU        uint16   // required tunnel MTU, zero accepts any MTU
+
+	RehandshakeInterval time.Duration // interval between handshakes with established peers, zero disables them
+	RehandshakeJitter   time.Duration // maximum random amount subtracted from the interval
+	SessionGrace        time.Duration // validity of the previous session after a handshake, defaults to DefaultSessionGrace
+
+	HandshakeLimit       RateLimit // limit of handshake requests of all sources
+	SourceHandshakeLimit RateLimit // limit of handshake requests per source IP
+	MaxPendingHandshakes int       // maximum number of unfinished handshakes, zero disables the limit
+
+	MaxPeers int // maximum number of peers, zero disables the limit
+
+	// MaxEndpointsPerKey limits the endpoints a key is used from at once:
+	// the one of its peer and those of unfinished handshakes from other
+	// endpoints, each of which moves the session of the peer when it is
+	// finished. One rejects handshakes from other endpoints while the peer
+	// is established, so a peer that has changed its address is accepted
+	// again after its session has timed out. Zero disables the limit.
+	MaxEndpointsPerKey int
+
+	StatusSocket     string // path of the Unix socket for status queries, empty disables it
+	ManagementSocket string // path of the Unix socket for the management API, empty disables it
+
+	StateFile     string        // snapshots of the established peers restored on start, empty disables them
+	StateKeys     bool          // whether snapshots contain the session keys, which avoids handshakes after a restart
+	StateInterval time.Duration // interval between snapshots, defaults to DefaultStateInterval
+
+	Peers *PeerStore // known peers, accepted without calling OnVerify
+	Hooks Hooks      // shell commands executed on peer events
+
+	AssignAddresses  func(*Peer) error // an error rejects the handshake
+	ReleaseAddresses func(*Peer)       // called when a peer is removed
+	OnVerify         func(*Peer) error // verifies unknown peers, all peers are accepted without store and verifiers
+	OnEstablished    func(*Peer)
+	OnTimeout        func(*Peer)
+	OnError          func(error)        // called for non-fatal transport errors, possibly concurrently
+	OnReload         func() error       // reloads the configuration on request of the management API
+	OnReject         func(*Peer, error) // called for handshakes rejected by MaxPeers or MaxEndpointsPerKey with ErrPeerLimit or ErrKeyInUse
 }
 
+// DefaultSessionGrace is the default time a replaced session stays valid
+// for packets in flight.
+const DefaultSessionGrace = 30 * time.Second
+
 var log = logrus.WithField("prefix", "fastd")
 
 // SetServerKey sets the server's key
@@ -34,3 +75,18 @@ func (c *Config) SetServerKey(secretHex string) error {
 	c.serverKeys = NewKeyPair(secret)
 	return nil
 }
+
+func (c *Config) sessionGrace() time.Duration {
+	if c.SessionGrace > 0 {
+		return c.SessionGrace
+	}
+	return DefaultSessionGrace
+}
+
+// rehandshakeDelay returns the interval reduced by a random jitter
+func rehandshakeDelay(interval, jitter time.Duration) time.Duration {
+	if jitter > 0 {
+		interval -= time.Duration(rand.Int63n(int64(jitter)))
+	}
+	return interval
+}
@@ -0,0 +1,163 @@
+package fastd
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EventBufferSize is the number of events buffered for a subscription.
+const EventBufferSize = 64
+
+// EventType is the type of a peer lifecycle event.
+type EventType int
+
+// Types of peer lifecycle events
+const (
+	EventHandshakeStarted EventType = iota + 1 // a handshake request has been received or sent
+	EventEstablished                           // the first session of a peer has been established
+	EventRoamed                                // a peer has changed its remote address
+	EventRemoved                               // a peer has been removed, also sent after EventTimedOut
+	EventTimedOut                              // a peer has timed out
+	EventHandshakeFailed                       // a handshake has failed
+)
+
+func (typ EventType) String() string {
+	switch typ {
+	case EventHandshakeStarted:
+		return "handshake_started"
+	case EventEstablished:
+		return "established"
+	case EventRoamed:
+		return "roamed"
+	case EventRemoved:
+		return "removed"
+	case EventTimedOut:
+		return "timed_out"
+	case EventHandshakeFailed:
+		return "handshake_failed"
+	default:
+		return fmt.Sprintf("EventType(%d)", int(typ))
+	}
+}
+
+// Event is a peer lifecycle event. It contains a copy of the peer's
+// attributes at the time of the event.
+type Event struct {
+	Type      EventType
+	Time      time.Time
+	PublicKey []byte // nil if a malformed handshake has no key
+	Name      string
+	Ifname    string
+	Remote    Sockaddr
+	Previous  Sockaddr      // previous remote address of EventRoamed
+	Reason    FailureReason // reason of EventHandshakeFailed
+}
+
+// Subscription delivers events to a consumer. Events are dropped if the
+// consumer does not keep up with the buffer.
+type Subscription struct {
+	C <-chan Event
+
+	ch      chan Event
+	dropped uint64 // accessed atomically
+	srv     *Server
+}
+
+// events holds the subscriptions of a server
+type events struct {
+	subscriptions map[*Subscription]struct{}
+	closed        bool // set by Stop
+	mtx           sync.RWMutex
+}
+
+// Subscribe returns a new subscription for all events of the server. It
+// is closed by Close or when the server is stopped.
+func (srv *Server) Subscribe() *Subscription {
+	ch := make(chan Event, EventBufferSize)
+	sub := &Subscription{C: ch, ch: ch, srv: srv}
+
+	srv.events.mtx.Lock()
+	defer srv.events.mtx.Unlock()
+
+	if srv.events.closed {
+		close(ch)
+		return sub
+	}
+	if srv.events.subscriptions == nil {
+		srv.events.subscriptions = make(map[*Subscription]struct{})
+	}
+	srv.events.subscriptions[sub] = struct{}{}
+	return sub
+}
+
+// Close ends the subscription and closes its channel.
+func (sub *Subscription) Close() {
+	events := &sub.srv.events
+	events.mtx.Lock()
+	defer events.mtx.Unlock()
+
+	if _, ok := events.subscriptions[sub]; ok {
+		delete(events.subscriptions, sub)
+		close(sub.ch)
+	}
+}
+
+// Dropped returns the number of events dropped due to a full buffer.
+func (sub *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&sub.dropped)
+}
+
+// closeSubscriptions closes all subscriptions of a stopped server
+func (srv *Server) closeSubscriptions() {
+	srv.events.mtx.Lock()
+	defer srv.events.mtx.Unlock()
+
+	for sub := range srv.events.subscriptions {
+		close(sub.ch)
+	}
+	srv.events.subscriptions = nil
+	srv.events.closed = true
+}
+
+// emit passes the event to all subscriptions without blocking
+func (srv *Server) emit(event Event) {
+	srv.events.mtx.RLock()
+	defer srv.events.mtx.RUnlock()
+
+	if len(srv.events.subscriptions) == 0 {
+		return
+	}
+
+	event.Time = time.Now()
+	for sub := range srv.events.subscriptions {
+		select {
+		case sub.ch <- event:
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+		}
+	}
+}
+
+// emitPeer emits an event with the attributes of the peer
+func (srv *Server) emitPeer(typ EventType, peer *Peer) {
+	srv.emit(Event{
+		Type:      typ,
+		PublicKey: peer.PublicKey,
+		Name:      peer.Name,
+		Ifname:    peer.Ifname,
+		Remote:    peer.Remote,
+	})
+}
+
+// handshakeFailed counts the failure and emits EventHandshakeFailed
+func (srv *Server) handshakeFailed(remote Sockaddr, pubkey []byte, reason FailureReason) {
+	srv.metrics.handshakeFailed(reason)
+	srv.emit(Event{
+		Type:      EventHandshakeFailed,
+		PublicKey: pubkey,
+		Remote:    remote,
+		Reason:    reason,
+	})
+}
@@ -0,0 +1,84 @@
+package fastd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func nextEvent(t *testing.T, sub *Subscription) Event {
+	select {
+	case event := <-sub.C:
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("no event")
+	}
+	return Event{}
+}
+
+func TestEvents(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_, restore := withTestTun()
+	defer restore()
+
+	srv, remote := startTestServer(t, Config{})
+	sub := srv.Subscribe()
+
+	client, err := NewClient(testClientConfig(remote))
+	require.NoError(err)
+	session, err := client.Connect()
+	require.NoError(err)
+	defer session.Close()
+
+	event := nextEvent(t, sub)
+	assert.Equal(EventHandshakeStarted, event.Type)
+	assert.Equal(testClientSecret.Public(), event.PublicKey)
+
+	event = nextEvent(t, sub)
+	assert.Equal(EventEstablished, event.Type)
+	assert.Equal("fastd0", event.Ifname)
+	assert.Equal(session.conn.LocalAddr().String(), event.Remote.String())
+
+	// removed peers
+	srv.call(func() { srv.RemovePeer(srv.GetPeers()[0]) })
+	assert.Equal(EventRemoved, nextEvent(t, sub).Type)
+
+	// failed handshakes
+	config := testClientConfig(remote)
+	config.PeerKey = testClientSecret.Public()
+	config.Timeout = 100 * time.Millisecond
+	client, err = NewClient(config)
+	require.NoError(err)
+	_, err = client.Connect()
+	assert.Error(err)
+
+	event = nextEvent(t, sub)
+	assert.Equal(EventHandshakeFailed, event.Type)
+	assert.Equal(FailureRecipientKey, event.Reason)
+
+	// subscriptions are closed by Stop
+	srv.Stop()
+	_, ok := <-sub.C
+	assert.False(ok)
+	_, ok = <-srv.Subscribe().C
+	assert.False(ok)
+}
+
+func TestSubscriptionDropped(t *testing.T) {
+	assert := assert.New(t)
+	srv := newTestServer(&testServerImpl{})
+
+	sub := srv.Subscribe()
+	for i := 0; i <= EventBufferSize; i++ {
+		srv.emitPeer(EventRemoved, &Peer{})
+	}
+	assert.EqualValues(1, sub.Dropped())
+	assert.Len(sub.C, EventBufferSize)
+
+	sub.Close()
+	sub.Close()
+	srv.emitPeer(EventRemoved, &Peer{})
+}
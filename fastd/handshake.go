@@ -5,9 +5,11 @@ import (
 	"fmt"
 	"reflect"
 	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/digineo/fastd/ifconfig"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
@@ -15,11 +17,24 @@ import (
 // support a tunnel MTU of this size.
 const MinMTU = 576
 
+// handshakeTimeout is the time to finish a started handshake
+const handshakeTimeout = 3 * time.Second
+
+// protocolName is the name of the only supported handshake protocol
+const protocolName = "ec25519-fhmqvc"
+
 // Handshake is used between two peers to exchange a secret.
 type Handshake struct {
 	sharedKey        []byte
+	prk              []byte   // pseudorandom key for the method keys
+	keyInfo          []byte   // public keys for the method keys
+	initiator        bool     // whether we initiated the handshake
 	peerHandshakeKey []byte   // public handshake key from Alice
 	ourHandshakeKey  *KeyPair // our handshake key
+	remote           Sockaddr // endpoint of the peer, differs from the peer's remote when roaming
+	local            Sockaddr // our address used by the peer
+	mode             Mode     // tunnel mode requested by the peer
+	compactHeader    bool     // whether the peer supports the compact header
 	timeout          time.Time
 }
 
@@ -35,6 +50,7 @@ func NewRespondingHandshake(ourKey *KeyPair, peerPublicKey, peerHandshakeKey []b
 
 func newHandshake(initiator bool, ourKey, ourHandshakeKey *KeyPair, peerPublicKey, peerHandshakeKey []byte) *Handshake {
 	hs := Handshake{
+		initiator:        initiator,
 		peerHandshakeKey: peerHandshakeKey,
 		ourHandshakeKey:  ourHandshakeKey,
 	}
@@ -60,22 +76,27 @@ func (srv *Server) handlePacket(msg *Message) (reply *Message) {
 	handshakeType, err := records.HandshakeType()
 	if err != nil {
 		llog.WithError(err).Error("handshake type missing")
+		srv.handshakeFailed(msg.Src, nil, FailureMalformed)
 		return
 	}
+	srv.metrics.handshakesReceived.WithLabelValues(handshakeType.String()).Inc()
 
 	senderKey, err := records.SenderKey()
 	if err != nil {
 		llog.WithError(err).Error("sender key missing")
+		srv.handshakeFailed(msg.Src, senderKey, FailureMalformed)
 		return
 	}
 	recipientKey, err := records.RecipientKey()
 	if err != nil {
 		llog.WithError(err).Error("recipient key missing")
+		srv.handshakeFailed(msg.Src, senderKey, FailureMalformed)
 		return
 	}
 	senderHandshakeKey, err := records.SenderHandshakeKey()
 	if err != nil {
 		llog.WithError(err).Error("sender handshake type missing")
+		srv.handshakeFailed(msg.Src, senderKey, FailureMalformed)
 		return
 	}
 
@@ -85,73 +106,136 @@ func (srv *Server) handlePacket(msg *Message) (reply *Message) {
 		"hostname": string(records[RecordHostname]),
 		"pubkey":   fmt.Sprintf("%x", senderKey),
 	})
+
+	// Dropped requests are not logged above debug level, a flood would
+	// fill the log otherwise
+	if handshakeType == HandshakeRequest {
+		if reason, ok := srv.allowHandshake(msg, senderKey, time.Now()); !ok {
+			llog.WithField("reason", reason).Debug("handshake request dropped")
+			srv.metrics.handshakesDropped.WithLabelValues(reason).Inc()
+			return nil
+		}
+	}
 	llog.Info("received handshake")
 
 	if reflect.DeepEqual(msg.Src, msg.Dst) {
 		llog.WithField("dst", msg.Dst.String()).
 			Error("source address equals destination address")
+		srv.handshakeFailed(msg.Src, senderKey, FailureMalformed)
 		return
 	}
 
-	reply = msg.NewReply()
+	// Error replies are never answered
+	if code, err := records.ReplyCode(); err == nil && code != ReplySuccess {
+		detail, _ := records.ErrorDetail()
+		llog.WithFields(logrus.Fields{
+			"code":   code.String(),
+			"detail": detail.String(),
+		}).Error("handshake rejected by peer")
+		srv.handshakeFailed(msg.Src, senderKey, FailureHandshakeReply)
+		return
+	}
 
 	if recipientKey == nil {
 		llog.Error("recipient key missing")
-		reply.SetError(ReplyRecordMissing, RecordRecipientKey)
-		return
+		srv.handshakeFailed(msg.Src, senderKey, FailureMalformed)
+		return srv.rejectHandshake(msg, nil, ReplyRecordMissing, RecordRecipientKey)
 	}
 
 	if !bytes.Equal(recipientKey, srv.config.serverKeys.public[:]) {
 		llog.WithField("rcptkey", fmt.Sprintf("%x", recipientKey)).
 			Error("recipient key invalid")
-		reply.SetError(ReplyUnacceptableValue, RecordRecipientKey)
-		return
+		srv.handshakeFailed(msg.Src, senderKey, FailureRecipientKey)
+		return srv.rejectHandshake(msg, nil, ReplyUnacceptableValue, RecordRecipientKey)
 	}
 
 	if senderKey == nil {
 		llog.Error("sender key missing")
-		reply.SetError(ReplyRecordMissing, RecordSenderKey)
-		return
+		srv.handshakeFailed(msg.Src, senderKey, FailureMalformed)
+		return srv.rejectHandshake(msg, nil, ReplyRecordMissing, RecordSenderKey)
 	}
 
 	if senderHandshakeKey == nil {
 		llog.Error("sender handshake key missing")
-		reply.SetError(ReplyRecordMissing, RecordSenderHandshakeKey)
-		return
+		srv.handshakeFailed(msg.Src, senderKey, FailureMalformed)
+		return srv.rejectHandshake(msg, nil, ReplyRecordMissing, RecordSenderHandshakeKey)
+	}
+
+	if handshakeType == HandshakeReply {
+		finish, err := srv.handleReply(msg)
+		if err != nil {
+			llog.WithError(err).Error("handshake failed")
+		}
+		return finish
+	}
+
+	if reason, err := srv.checkPeerLimits(msg.Src, senderKey, handshakeType); err != nil {
+		llog.WithError(err).Error("handshake rejected")
+		srv.rejectPeer(msg.Src, senderKey, reason, err)
+		return srv.rejectHandshake(msg, nil, ReplyUnacceptableValue, RecordSenderKey)
 	}
 
-	peer, created := srv.getPeer(msg.Src)
-	if peer.PublicKey == nil {
-		peer.PublicKey = senderKey
-	} else if !bytes.Equal(peer.PublicKey, senderKey) {
+	peer, created := srv.getPeer(msg.Src, senderKey, handshakeType == HandshakeRequest)
+	if peer == nil {
+		llog.Error("no handshake started")
+		srv.handshakeFailed(msg.Src, senderKey, FailureNoHandshake)
+		return srv.rejectHandshake(msg, nil, ReplyUnacceptableValue, RecordRecipientHandshakeKey)
+	}
+	if !bytes.Equal(peer.PublicKey, senderKey) {
 		llog.WithFields(logrus.Fields{
 			"old": fmt.Sprintf("%x", peer.PublicKey),
 			"new": fmt.Sprintf("%x", senderKey),
 		}).Error("peer changed public key")
-		return nil
+		srv.handshakeFailed(msg.Src, senderKey, FailurePublicKey)
+		return srv.rejectHandshake(msg, nil, ReplyUnacceptableValue, RecordSenderKey)
+	}
+
+	if peer.Name != "" {
+		llog = llog.WithField("peer", peer.Name)
 	}
 
 	hs := peer.handshake
 
 	// start new handshake?
 	if handshakeType == HandshakeRequest {
+		if peer.verifying {
+			llog.Debug("verify hook still running")
+			return nil
+		}
 		hs = NewRespondingHandshake(srv.config.serverKeys, senderKey, senderHandshakeKey)
 		if hs == nil {
-			llog.WithError(err).Error("unable to make shared handshake key")
-			return nil
+			llog.Error("unable to make shared handshake key")
+			srv.handshakeFailed(msg.Src, senderKey, FailureMalformed)
+			srv.abortHandshake(peer, created)
+			return srv.rejectHandshake(msg, nil, ReplyUnacceptableValue, RecordSenderHandshakeKey)
 		}
+		hs.remote = msg.Src
+		hs.local = msg.Dst
 		peer.handshake = hs
-	} else if hs == nil {
-		log.Error("no handshake started")
-		return nil
+		srv.emitPeer(EventHandshakeStarted, peer)
+	} else if hs == nil || hs.initiator || !hs.remote.Equal(&msg.Src) {
+		llog.Error("no handshake started")
+		srv.handshakeFailed(msg.Src, senderKey, FailureNoHandshake)
+		return srv.rejectHandshake(msg, nil, ReplyUnacceptableValue, RecordRecipientHandshakeKey)
 	}
 
 	peer.lastSeen = time.Now()
+	peer.local = msg.Dst
+
+	if handshakeType == HandshakeFinish {
+		msg.SignKey = hs.sharedKey
+		reply, err := srv.handleFinishHandshake(msg, peer)
+		if err != nil {
+			llog.WithError(err).Error("handshake failed")
+		}
+		return reply
+	}
 
+	reply = msg.NewReply()
 	reply.SignKey = hs.sharedKey
 	reply.Records.
 		SetReplyCode(ReplySuccess).
-		SetMethodList("null").
+		SetMethodList(srv.methods()...).
 		SetVersionName("v20").
 		SetSenderKey(srv.config.serverKeys.public[:]).
 		SetSenderHandshakeKey(hs.ourHandshakeKey.public[:]).
@@ -163,99 +247,297 @@ func (srv *Server) handlePacket(msg *Message) (reply *Message) {
 
 	switch handshakeType {
 	case HandshakeRequest:
-		if err := srv.verifyPeer(peer); err != nil {
-			llog.WithError(err).Error("verify failed")
-			if created {
-				srv.RemovePeer(peer)
-			}
-			return nil
+		if code, detail, ok := checkProtocol(records); !ok {
+			llog.WithField("protocol", string(records[RecordProtocolName])).Error("unsupported protocol")
+			srv.handshakeFailed(msg.Src, senderKey, FailureProtocol)
+			srv.abortHandshake(peer, created)
+			return srv.rejectHandshake(msg, hs, code, detail)
 		}
 
-		var useCompactHeader bool
-		if records[RecordVersionName] != nil && len(records[RecordVersionName]) > 1 {
-			val, err := strconv.Atoi(string(records[RecordVersionName])[1:])
-
-			useCompactHeader = err == nil && val >= 20
+		mode, ok := srv.requestedMode(records)
+		if !ok {
+			llog.WithField("mode", records[RecordMode]).Error("unsupported mode")
+			srv.handshakeFailed(msg.Src, senderKey, FailureMode)
+			srv.abortHandshake(peer, created)
+			return srv.rejectHandshake(msg, hs, ReplyUnacceptableValue, RecordMode)
 		}
 
-		// Assign interface and addresses
-		var err error
-		if peer.Ifname == "" {
-			peer.Ifname, err = Clone(msg.Src, senderKey, useCompactHeader)
+		if mtu, err := records.MTU(); srv.config.MTU != 0 && (err != nil || mtu != srv.config.MTU) {
+			llog.WithField("mtu", records[RecordMTU]).Error("MTU mismatch")
+			srv.handshakeFailed(msg.Src, senderKey, FailureMTU)
+			srv.abortHandshake(peer, created)
+			return srv.rejectHandshake(msg, hs, ReplyUnacceptableValue, RecordMTU)
+		}
 
+		// Unverified peers get no error reply
+		deferred := reply // the named result is cleared by returning nil
+		err := srv.verifyPeer(peer, func(err error) {
 			if err != nil {
-				llog.WithError(err).Error("cloning failed")
-				if created {
-					srv.RemovePeer(peer)
-				}
-				return nil
+				llog.WithError(err).Error("verify failed")
+				srv.abortHandshake(peer, created)
+				return
 			}
+			// the peer may have timed out meanwhile
+			if peer.handshake != hs || (srv.getPeerByKey(peer.PublicKey) != peer && !srv.isPending(peer)) {
+				return
+			}
+			if reply := srv.acceptRequest(msg, deferred, peer, mode, created, llog); reply != nil {
+				srv.write(reply)
+			}
+		})
+		if err == errVerifyPending {
+			llog.Debug("waiting for verify hook")
+			return nil
 		}
-
-		if f := srv.config.AssignAddresses; f != nil {
-			f(peer)
+		if err != nil {
+			llog.WithError(err).Error("verify failed")
+			srv.abortHandshake(peer, created)
+			return nil
 		}
+		return srv.acceptRequest(msg, reply, peer, mode, created, llog)
+	default:
+		llog.Error("unsupported handshake type")
+		srv.handshakeFailed(msg.Src, senderKey, FailureMalformed)
+		return srv.rejectHandshake(msg, hs, ReplyUnacceptableValue, RecordHandshakeType)
+	}
+}
+
+// acceptRequest assigns the interface and addresses of a verified peer
+// and completes the reply. It returns the reply to send, an error reply
+// if no addresses could be assigned or nil if the request is dropped.
+// A pending peer gets the addresses of the known peer with its key.
+func (srv *Server) acceptRequest(msg, reply *Message, peer *Peer, mode Mode, created bool, llog *logrus.Entry) *Message {
+	records := msg.Records
+	if peer.Name != "" {
+		llog = llog.WithField("peer", peer.Name)
+	}
+
+	// The compact header is only used for IP packets
+	var useCompactHeader bool
+	if records[RecordVersionName] != nil && len(records[RecordVersionName]) > 1 && mode == ModeTUN {
+		val, err := strconv.Atoi(string(records[RecordVersionName])[1:])
+
+		useCompactHeader = err == nil && val >= 20
+	}
+
+	// An existing interface is replaced after the sender has proven the
+	// ownership of its key in the finish message
+	if hs := peer.handshake; hs != nil {
+		hs.mode = mode
+		hs.compactHeader = useCompactHeader
+	}
+
+	if srv.isPending(peer) {
+		return srv.replyAddresses(reply, peer)
+	}
 
-		// Copy Vars
-		if peer.Vars != nil {
-			reply.Records.SetVars(peer.Vars)
+	// Assign interface and addresses
+	var err error
+	if peer.Ifname == "" {
+		peer.Ifname, err = srv.impl.Clone(msg.Src, peer.PublicKey, mode, useCompactHeader)
+		peer.Mode = mode
+		peer.compactHeader = useCompactHeader
+
+		if err != nil {
+			llog.WithError(err).Error("cloning failed")
+			srv.handshakeFailed(msg.Src, peer.PublicKey, FailureClone)
+			srv.abortHandshake(peer, created)
+			return nil
 		}
+		srv.runHook("up", srv.config.Hooks.Up, peer)
+	}
 
-		// Copy IPv4 addresses into response
-		if peer.IPv4.LocalAddr != nil && peer.IPv4.DestAddr != nil {
-			reply.Records.SetIPv4Addr(peer.IPv4.DestAddr)
-			reply.Records.SetIPv4DstAddr(peer.IPv4.LocalAddr)
+	if f := srv.config.AssignAddresses; f != nil {
+		if err := f(peer); err != nil {
+			llog.WithError(err).Error("unable to assign addresses")
+			srv.handshakeFailed(msg.Src, peer.PublicKey, FailureAddresses)
+			hs := peer.handshake
+			srv.abortHandshake(peer, created)
+			return srv.rejectHandshake(msg, hs, ReplyUnacceptableValue, RecordSenderKey)
 		}
+	}
+
+	return srv.replyAddresses(reply, peer)
+}
 
-		// Copy IPv6 addresses into response
-		if peer.IPv6.LocalAddr != nil && peer.IPv6.DestAddr != nil {
-			reply.Records.SetIPv6Addr(peer.IPv6.DestAddr)
-			reply.Records.SetIPv6DstAddr(peer.IPv6.LocalAddr)
+// replyAddresses copies the vars and addresses of the peer into the reply
+func (srv *Server) replyAddresses(reply *Message, peer *Peer) *Message {
+	// Copy Vars
+	if peer.Vars != nil {
+		reply.Records.SetVars(peer.Vars)
+	}
+
+	// Copy IPv4 addresses into response
+	if peer.IPv4.LocalAddr != nil && peer.IPv4.DestAddr != nil {
+		reply.Records.SetIPv4Addr(peer.IPv4.DestAddr)
+		reply.Records.SetIPv4DstAddr(peer.IPv4.LocalAddr)
+		if peer.IPv4PrefixLen != 0 {
+			reply.Records.SetIPv4PrefixLen(peer.IPv4PrefixLen)
 		}
-	case HandshakeFinish:
-		// don't reply to the finish message
-		reply = nil
+	}
 
-		msg.SignKey = hs.sharedKey
-		if err := srv.handleFinishHandshake(msg, reply, peer); err != nil {
-			llog.WithError(err).Error("handshake failed")
-			return nil
+	// Copy IPv6 addresses into response
+	if peer.IPv6.LocalAddr != nil && peer.IPv6.DestAddr != nil {
+		reply.Records.SetIPv6Addr(peer.IPv6.DestAddr)
+		reply.Records.SetIPv6DstAddr(peer.IPv6.LocalAddr)
+		if peer.IPv6PrefixLen != 0 {
+			reply.Records.SetIPv6PrefixLen(peer.IPv6PrefixLen)
 		}
+	}
+	return reply
+}
+
+// rejectHandshake returns an error reply to the message. If a handshake
+// is given, the reply is signed with its shared key and contains the keys
+// needed to verify it.
+func (srv *Server) rejectHandshake(msg *Message, hs *Handshake, code ReplyCode, detail TLVKey) *Message {
+	reply := msg.NewReply()
+	reply.SetError(code, detail)
+
+	if hs != nil {
+		senderKey, _ := msg.Records.SenderKey()
+		reply.SignKey = hs.sharedKey
+		reply.Records.
+			SetSenderKey(srv.config.serverKeys.public[:]).
+			SetSenderHandshakeKey(hs.ourHandshakeKey.public[:]).
+			SetRecipientKey(senderKey).
+			SetRecipientHandshakeKey(hs.peerHandshakeKey)
+	}
+	return reply
+}
+
+// checkProtocol checks the protocol name of a handshake request
+func checkProtocol(records Records) (ReplyCode, TLVKey, bool) {
+	switch name, _ := records.ProtocolName(); name {
+	case protocolName:
+		return ReplySuccess, 0, true
+	case "":
+		return ReplyRecordMissing, RecordProtocolName, false
 	default:
-		llog.Error("unsupported handshake type")
+		return ReplyUnacceptableValue, RecordProtocolName, false
+	}
+}
+
+// requestedMode returns the tunnel mode of a handshake request and
+// whether it is allowed. Requests without a mode use TUN.
+func (srv *Server) requestedMode(records Records) (Mode, bool) {
+	if records[RecordMode] == nil {
+		return ModeTUN, containsMode(srv.modes(), ModeTUN)
 	}
 
-	return
+	mode, err := records.Mode()
+	if err != nil {
+		return 0, false
+	}
+
+	return mode, containsMode(srv.modes(), mode)
 }
 
-func (srv *Server) handleFinishHandshake(msg *Message, reply *Message, peer *Peer) error {
-	methodName := msg.Records[RecordMethodName]
+// modes returns the tunnel modes allowed for our peers
+func (srv *Server) modes() []Mode {
+	if len(srv.config.Modes) > 0 {
+		return srv.config.Modes
+	}
+	return srv.impl.Modes()
+}
 
-	if methodName == nil {
-		reply.SetError(ReplyRecordMissing, RecordMethodName)
-		return fmt.Errorf("method name missing")
+// methods returns the methods offered to our peers
+func (srv *Server) methods() []string {
+	if len(srv.config.Methods) > 0 {
+		return srv.config.Methods
+	}
+	return srv.impl.Methods()
+}
+
+// contains reports whether the list contains the string
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// containsMode reports whether the list contains the mode
+func containsMode(list []Mode, mode Mode) bool {
+	for _, item := range list {
+		if item == mode {
+			return true
+		}
 	}
-	if string(methodName) != "null" {
-		reply.SetError(ReplyUnacceptableValue, RecordMethodName)
-		return fmt.Errorf("method name invalid: %s", methodName)
+	return false
+}
+
+// handleFinishHandshake establishes the session of a finished
+// handshake. Only rejected messages with a valid signature are answered
+// with an error reply.
+func (srv *Server) handleFinishHandshake(msg *Message, peer *Peer) (*Message, error) {
+	hs := peer.handshake
+	reject := func(code ReplyCode, detail TLVKey) *Message {
+		return srv.rejectHandshake(msg, hs, code, detail)
 	}
 
 	if !msg.VerifySignature() {
-		return fmt.Errorf("invalid signature")
+		srv.handshakeFailed(msg.Src, peer.PublicKey, FailureSignature)
+		return nil, fmt.Errorf("invalid signature")
 	}
 
 	if !srv.establishPeer(peer) {
-		return fmt.Errorf("handshake timed out")
+		srv.handshakeFailed(msg.Src, peer.PublicKey, FailureTimeout)
+		return reject(ReplyUnacceptableValue, RecordRecipientHandshakeKey), fmt.Errorf("handshake timed out")
+	}
+
+	methodName := msg.Records[RecordMethodName]
+	if methodName == nil {
+		srv.handshakeFailed(msg.Src, peer.PublicKey, FailureMethod)
+		return reject(ReplyRecordMissing, RecordMethodName), fmt.Errorf("method name missing")
+	}
+	if !contains(srv.methods(), string(methodName)) {
+		srv.handshakeFailed(msg.Src, peer.PublicKey, FailureMethod)
+		return reject(ReplyUnacceptableValue, RecordMethodName), fmt.Errorf("method name invalid: %s", methodName)
 	}
 
-	// Decode and set MTU
+	// Decode the MTU
 	mtu, err := msg.Records.MTU()
 	if err != nil {
-		return fmt.Errorf("%v %v", msg.Src, err)
+		srv.handshakeFailed(msg.Src, peer.PublicKey, FailureMTU)
+		return reject(ReplyRecordMissing, RecordMTU), fmt.Errorf("%v %v", msg.Src, err)
 	}
 	if mtu < MinMTU {
-		return fmt.Errorf("%v MTU invalid: %d", msg.Src, mtu)
+		srv.handshakeFailed(msg.Src, peer.PublicKey, FailureMTU)
+		return reject(ReplyUnacceptableValue, RecordMTU), fmt.Errorf("%v MTU invalid: %d", msg.Src, mtu)
+	}
+
+	// The handshake is verified, it replaces the handshake of the known
+	// peer with its key
+	if srv.isPending(peer) {
+		known := srv.attachPending(peer)
+		if known == nil {
+			srv.handshakeFailed(msg.Src, peer.PublicKey, FailureNoHandshake)
+			return reject(ReplyUnacceptableValue, RecordRecipientHandshakeKey), errors.New("peer has been removed")
+		}
+		peer = known
+	}
+
+	// Replace the interface of a peer that has changed its mode
+	if peer.Mode != hs.mode {
+		if err := srv.changeMode(peer, hs); err != nil {
+			srv.handshakeFailed(msg.Src, peer.PublicKey, FailureClone)
+			srv.RemovePeer(peer)
+			return nil, err
+		}
 	}
+
+	// Move a roaming peer to its new endpoint
+	if !peer.Remote.Equal(&hs.remote) {
+		if err := srv.migratePeer(peer, hs.remote, hs.local); err != nil {
+			srv.handshakeFailed(msg.Src, peer.PublicKey, FailureSession)
+			return nil, err
+		}
+	}
+
+	// Set the MTU
 	if err := ifconfig.SetMTU(peer.Ifname, mtu); err != nil {
 		log.WithFields(logrus.Fields{
 			logrus.ErrorKey: err,
@@ -266,13 +548,140 @@ func (srv *Server) handleFinishHandshake(msg *Message, reply *Message, peer *Pee
 		peer.MTU = mtu
 	}
 
-	// Clear handshake keys
-	peer.handshake = nil
+	// Derive the session key and activate the session
+	session, err := hs.NewSession(string(methodName))
+	if err != nil {
+		srv.handshakeFailed(msg.Src, peer.PublicKey, FailureSession)
+		return nil, err
+	}
+	firstSession := peer.session == nil
+	if err := srv.activateSession(peer, session); err != nil {
+		return nil, err
+	}
+
+	if !firstSession {
+		return nil, nil
+	}
 	peer.assignAddresses()
 
 	// Established hook
 	if f := srv.config.OnEstablished; f != nil {
 		f(peer)
 	}
+	srv.runHook("establish", srv.config.Hooks.Establish, peer)
+	return nil, nil
+}
+
+// changeMode replaces the interface of the peer by one in the mode of
+// the handshake. The session of the former interface ends with it.
+func (srv *Server) changeMode(peer *Peer, hs *Handshake) error {
+	if peer.session != nil {
+		srv.runHook("disestablish", srv.config.Hooks.Disestablish, peer)
+	}
+	srv.runHook("down", srv.config.Hooks.Down, peer)
+	srv.impl.Destroy(peer.Ifname)
+	peer.Ifname = ""
+	peer.session = nil
+
+	ifname, err := srv.impl.Clone(hs.remote, peer.PublicKey, hs.mode, hs.compactHeader)
+	if err != nil {
+		return errors.Wrap(err, "cloning failed")
+	}
+	peer.Ifname = ifname
+	peer.Mode = hs.mode
+	peer.compactHeader = hs.compactHeader
+	srv.runHook("up", srv.config.Hooks.Up, peer)
+	return nil
+}
+
+// activateSession replaces the session of the peer, the previous one
+// stays valid for the grace period
+func (srv *Server) activateSession(peer *Peer, session *Session) error {
+	now := time.Now()
+	session.stats = &peer.replay
+
+	if err := srv.impl.SetSession(peer.Ifname, session); err != nil {
+		srv.handshakeFailed(peer.Remote, peer.PublicKey, FailureSession)
+		return errors.Wrap(err, "unable to set session")
+	}
+	first := peer.session == nil
+	if !first {
+		peer.session.expireAt(now.Add(srv.config.sessionGrace()))
+	}
+
+	// Clear handshake keys
+	peer.handshake = nil
+	peer.session = session
+	atomic.StoreInt64(&peer.established, now.UnixNano())
+
+	if interval := srv.config.RehandshakeInterval; interval > 0 {
+		peer.rehandshakeAt = now.Add(rehandshakeDelay(interval, srv.config.RehandshakeJitter))
+	}
+
+	srv.metrics.handshakesSucceeded.Inc()
+	if first {
+		srv.emitPeer(EventEstablished, peer)
+	}
 	return nil
 }
+
+// startHandshake sends a handshake request to an established peer
+func (srv *Server) startHandshake(peer *Peer) error {
+	hs := &Handshake{
+		initiator:       true,
+		ourHandshakeKey: RandomKeypair(),
+		timeout:         time.Now().Add(handshakeTimeout),
+	}
+
+	request := newHandshakeRequest(srv.config.serverKeys, hs.ourHandshakeKey, peer.PublicKey, peer.Mode)
+	request.Src = peer.local
+	request.Dst = peer.Remote
+
+	peer.handshake = hs
+	srv.emitPeer(EventHandshakeStarted, peer)
+	return srv.impl.Write(request)
+}
+
+// handleReply completes a handshake initiated by us
+func (srv *Server) handleReply(msg *Message) (*Message, error) {
+	// The peer may reply from a new endpoint
+	key, _ := msg.Records.SenderKey()
+	peer := srv.getPeerByKey(key)
+
+	if peer == nil || peer.handshake == nil || !peer.handshake.initiator {
+		srv.handshakeFailed(msg.Src, key, FailureNoHandshake)
+		return nil, errors.New("no handshake started")
+	}
+	if !srv.establishPeer(peer) {
+		srv.handshakeFailed(msg.Src, key, FailureTimeout)
+		return nil, errors.New("handshake timed out")
+	}
+
+	session, finish, err := completeHandshake(msg, peer.handshake, srv.config.serverKeys, peer.PublicKey, srv.methods())
+	switch err {
+	case nil:
+	case ErrInvalidSignature:
+		srv.handshakeFailed(msg.Src, key, FailureSignature)
+		return nil, err
+	case ErrNoCommonMethod:
+		srv.handshakeFailed(msg.Src, key, FailureMethod)
+		return nil, err
+	default:
+		srv.handshakeFailed(msg.Src, key, FailureHandshakeReply)
+		return nil, err
+	}
+	finish.Records.SetMTU(peer.MTU)
+
+	if !peer.Remote.Equal(&msg.Src) {
+		if err := srv.migratePeer(peer, msg.Src, msg.Dst); err != nil {
+			srv.handshakeFailed(msg.Src, key, FailureSession)
+			return nil, err
+		}
+	}
+
+	if err := srv.activateSession(peer, session); err != nil {
+		return nil, err
+	}
+
+	return finish, nil
+}
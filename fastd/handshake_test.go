@@ -1,21 +1,24 @@
 package fastd
 
 import (
+	"errors"
+	"fmt"
 	"net"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestHandshake(t *testing.T) {
 	assert := assert.New(t)
 	peerAddr := Sockaddr{IP: net.ParseIP("127.0.0.1"), Port: 8755}
 
-	srv := Server{}
-	srv.config.serverKeys = testServerSecret
-	srv.peers = make(map[string]*Peer)
+	srv := newTestServer(&testServerImpl{})
 
-	peer, _ := srv.getPeer(peerAddr)
+	peer, _ := srv.getPeer(peerAddr, nil, true)
 	assert.Nil(peer.handshake)
 
 	// Handshake request (0x01)
@@ -51,6 +54,10 @@ func TestHandshake(t *testing.T) {
 	assert.NoError(err)
 	assert.Equal(lproto, rproto)
 
+	methods, err := reply.Records.MethodList()
+	assert.NoError(err)
+	assert.Equal(MethodNames(), methods)
+
 	// Handshake finish (0x03)
 	msg = readTestmsg("null-finish.dat")
 
@@ -58,3 +65,424 @@ func TestHandshake(t *testing.T) {
 	reply = srv.handlePacket(msg)
 	assert.Nil(reply)
 }
+
+func TestHandshakeMethods(t *testing.T) {
+	assert := assert.New(t)
+
+	srv := newTestServer(&testServerImpl{})
+	srv.config.Methods = []string{"null+salsa2012+umac", "null"}
+
+	reply := srv.handlePacket(readTestmsg("null-request.dat"))
+	assert.NotNil(reply)
+
+	methods, err := reply.Records.MethodList()
+	assert.NoError(err)
+	assert.Equal([]string{"null+salsa2012+umac", "null"}, methods)
+
+	assert.True(contains(srv.methods(), "null"))
+	assert.False(contains(srv.methods(), "salsa2012+umac"))
+}
+
+func TestHandshakeMode(t *testing.T) {
+	assert := assert.New(t)
+
+	impl := &testServerImpl{}
+	srv := newTestServer(impl)
+
+	for _, mode := range []Mode{ModeTAP, 5} {
+		msg := readTestmsg("null-request.dat")
+		msg.Records.SetMode(mode)
+
+		reply := srv.handlePacket(msg)
+		assert.NotNil(reply)
+
+		code, _ := reply.Records.ReplyCode()
+		assert.Equal(ReplyUnacceptableValue, code)
+		detail, _ := reply.Records.ErrorDetail()
+		assert.Equal(RecordMode, detail)
+	}
+	assert.Equal(0, impl.clones)
+	assert.Equal(0, srv.PeersCount())
+
+	// requests without mode use TUN
+	msg := readTestmsg("null-request.dat")
+	msg.Records[RecordMode] = nil
+
+	reply := srv.handlePacket(msg)
+	code, _ := reply.Records.ReplyCode()
+	assert.Equal(ReplySuccess, code)
+	assert.Equal(1, impl.clones)
+	assert.Equal(ModeTUN, srv.GetPeers()[0].Mode)
+}
+
+func TestHandshakeModeChange(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	impl := &testServerImpl{modes: []Mode{ModeTUN, ModeTAP}}
+	srv := newTestServer(impl)
+	src := Sockaddr{IP: net.ParseIP("127.0.0.1"), Port: 8755}
+
+	_, finish := testHandshakeFrom(t, srv, src, ModeTUN)
+	assert.Nil(srv.handlePacket(remarshal(t, finish)))
+	peer := srv.getPeerByKey(testClientSecret.Public())
+	require.NotNil(peer)
+	session := peer.session
+	require.NotNil(session)
+
+	// an unfinished request does not touch the established interface
+	request := newHandshakeRequest(testClientSecret, RandomKeypair(), testServerSecret.Public(), ModeTAP)
+	request.Src = src
+	request.Dst = Sockaddr{IP: net.ParseIP("127.0.0.1"), Port: 10000}
+	assert.NotNil(srv.handlePacket(remarshal(t, request)))
+	assert.Empty(impl.destroyed)
+	assert.Equal("fastd0", peer.Ifname)
+	assert.Equal(ModeTUN, peer.Mode)
+	assert.Equal(session, peer.session)
+
+	// the interface is replaced by a finished handshake
+	_, finish = testHandshakeFrom(t, srv, src, ModeTAP)
+	assert.Nil(srv.handlePacket(remarshal(t, finish)))
+	assert.Equal([]string{"fastd0"}, impl.destroyed)
+	assert.Equal("fastd1", peer.Ifname)
+	assert.Equal(ModeTAP, peer.Mode)
+	assert.NotNil(peer.session)
+	assert.NotEqual(session, peer.session)
+}
+
+func TestHandshakeRoaming(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	impl := &testServerImpl{modes: []Mode{ModeTUN, ModeTAP}}
+	srv := newTestServer(impl)
+	assigned := 0
+	srv.config.AssignAddresses = func(*Peer) error {
+		assigned++
+		return nil
+	}
+	src := Sockaddr{IP: net.ParseIP("127.0.0.1"), Port: 8755}
+	other := Sockaddr{IP: net.ParseIP("192.0.2.1"), Port: 9000}
+
+	// a request from another endpoint does not break an unfinished handshake
+	_, finish := testHandshakeFrom(t, srv, src, ModeTUN)
+	peer := srv.getPeerByKey(testClientSecret.Public())
+	require.NotNil(peer)
+	hs := peer.handshake
+	testHandshakeFrom(t, srv, other, ModeTAP)
+	assert.Equal(hs, peer.handshake)
+	assert.Len(srv.pending, 1)
+
+	assert.Nil(srv.handlePacket(remarshal(t, finish)))
+	require.NotNil(peer.session)
+	session := peer.session
+	assert.Equal(1, assigned)
+
+	// nor does it touch the established peer
+	_, finish = testHandshakeFrom(t, srv, other, ModeTAP)
+	assert.Nil(peer.handshake)
+	assert.Equal(src.String(), peer.Remote.String())
+	assert.Equal(ModeTUN, peer.Mode)
+	assert.Equal(session, peer.session)
+	assert.Empty(impl.destroyed)
+	assert.Equal(1, assigned)
+	assert.Equal(1, srv.PeersCount())
+
+	// the finished handshake migrates the peer
+	assert.Nil(srv.handlePacket(remarshal(t, finish)))
+	assert.Equal(other.String(), peer.Remote.String())
+	assert.Equal(ModeTAP, peer.Mode)
+	assert.NotEqual(session, peer.session)
+	assert.Equal([]string{"fastd0"}, impl.destroyed)
+	assert.Equal(1, srv.PeersCount())
+	assert.Empty(srv.pending)
+}
+
+func TestHandshakeConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	impl := &testServerImpl{}
+	srv := newTestServer(impl)
+	srv.config.Modes = []Mode{ModeTAP}
+
+	// requests without mode use TUN
+	reply := srv.handlePacket(readTestmsg("null-request.dat"))
+	detail, _ := reply.Records.ErrorDetail()
+	assert.Equal(RecordMode, detail)
+
+	srv.config.Modes = nil
+	srv.config.MTU = 1280
+	reply = srv.handlePacket(readTestmsg("null-request.dat"))
+	detail, _ = reply.Records.ErrorDetail()
+	assert.Equal(RecordMTU, detail)
+	assert.Equal(0, impl.clones)
+}
+
+func TestHandshakeProtocol(t *testing.T) {
+	assert := assert.New(t)
+	srv := newTestServer(&testServerImpl{})
+
+	for _, name := range []string{"", "ec25519-fhmqv"} {
+		msg := readTestmsg("null-request.dat")
+		msg.Records.SetProtocolName(name)
+
+		reply := srv.handlePacket(msg)
+		code, _ := reply.Records.ReplyCode()
+		detail, _ := reply.Records.ErrorDetail()
+		assert.Equal(RecordProtocolName, detail, name)
+		if name == "" {
+			assert.Equal(ReplyRecordMissing, code)
+		} else {
+			assert.Equal(ReplyUnacceptableValue, code)
+		}
+	}
+	assert.Equal(0, srv.PeersCount())
+
+	// error replies are not answered
+	msg := readTestmsg("null-request.dat")
+	msg.SetError(ReplyUnacceptableValue, RecordMode)
+	assert.Nil(srv.handlePacket(msg))
+}
+
+func TestHandshakeErrorReplies(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*Peer, *Message)
+		code   ReplyCode
+		detail TLVKey
+	}{
+		{"method missing", func(_ *Peer, msg *Message) { msg.Records[RecordMethodName] = nil }, ReplyRecordMissing, RecordMethodName},
+		{"method invalid", func(_ *Peer, msg *Message) { msg.Records.SetMethodName("foo") }, ReplyUnacceptableValue, RecordMethodName},
+		{"MTU missing", func(_ *Peer, msg *Message) { msg.Records[RecordMTU] = nil }, ReplyRecordMissing, RecordMTU},
+		{"MTU invalid", func(_ *Peer, msg *Message) { msg.Records.SetMTU(MinMTU - 1) }, ReplyUnacceptableValue, RecordMTU},
+		{"handshake expired", func(peer *Peer, _ *Message) { peer.handshake.timeout = time.Now() }, ReplyUnacceptableValue, RecordRecipientHandshakeKey},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert := assert.New(t)
+			srv := newTestServer(&testServerImpl{})
+			hs, finish := testHandshakeFinish(t, srv)
+			test.modify(srv.GetPeers()[0], finish)
+
+			reply := srv.handlePacket(remarshal(t, finish))
+			require.NotNil(t, reply)
+			typ, _ := reply.Records.HandshakeType()
+			assert.Equal(handshakeFinishError, typ)
+
+			// the reply is signed
+			reply = remarshal(t, reply)
+			reply.SignKey = hs.sharedKey
+			assert.True(reply.VerifySignature())
+			assert.Equal(&HandshakeError{Code: test.code, Detail: test.detail, Verified: true}, newHandshakeError(reply, true))
+		})
+	}
+
+	// messages with an invalid signature are not answered
+	srv := newTestServer(&testServerImpl{})
+	_, finish := testHandshakeFinish(t, srv)
+	finish = remarshal(t, finish)
+	finish.SignKey = nil
+	finish.Records.SetMethodName("foo")
+	assert.Nil(t, srv.handlePacket(remarshal(t, finish)))
+}
+
+func TestHandshakeUnknownFinish(t *testing.T) {
+	assert := assert.New(t)
+	srv := newTestServer(&testServerImpl{})
+	srv.config.MaxPeers = 1
+
+	// finish messages of unknown endpoints create no peers
+	for i := 1; i <= 5; i++ {
+		msg := readTestmsg("null-finish.dat")
+		msg.Src.IP = net.IPv4(192, 0, 2, byte(i))
+		reply := srv.handlePacket(msg)
+		if assert.NotNil(reply) {
+			assert.Equal(&HandshakeError{Code: ReplyUnacceptableValue, Detail: RecordRecipientHandshakeKey}, newHandshakeError(reply, false))
+		}
+	}
+	assert.Equal(0, srv.PeersCount())
+	assert.EqualValues(5, testutil.ToFloat64(srv.metrics.handshakesFailed.WithLabelValues(string(FailureNoHandshake))))
+
+	// and use up no slots
+	reply := srv.handlePacket(readTestmsg("null-request.dat"))
+	code, _ := reply.Records.ReplyCode()
+	assert.Equal(ReplySuccess, code)
+}
+
+func TestHandshakeAddressesUnavailable(t *testing.T) {
+	assert := assert.New(t)
+	srv := newTestServer(&testServerImpl{})
+
+	released := 0
+	srv.config.AssignAddresses = func(*Peer) error { return errors.New("pool exhausted") }
+	srv.config.ReleaseAddresses = func(*Peer) { released++ }
+
+	reply := srv.handlePacket(readTestmsg("null-request.dat"))
+	if assert.NotNil(reply) {
+		assert.NotNil(reply.SignKey)
+		code, _ := reply.Records.ReplyCode()
+		assert.Equal(ReplyUnacceptableValue, code)
+	}
+	assert.Equal(0, srv.PeersCount())
+	assert.Equal(1, released)
+	assert.EqualValues(1, testutil.ToFloat64(srv.metrics.handshakesFailed.WithLabelValues(string(FailureAddresses))))
+}
+
+func TestHandshakePeerLimits(t *testing.T) {
+	assert := assert.New(t)
+	srv := newTestServer(&testServerImpl{})
+	srv.config.MaxPeers = 1
+
+	var rejected []error
+	srv.config.OnReject = func(peer *Peer, err error) {
+		assert.NotNil(peer.PublicKey)
+		rejected = append(rejected, err)
+	}
+
+	request := func(ip string) *Message {
+		msg := readTestmsg("null-request.dat")
+		msg.Src.IP = net.ParseIP(ip)
+		return srv.handlePacket(msg)
+	}
+	assertRejected := func(reply *Message) {
+		if assert.NotNil(reply) {
+			assert.Equal(&HandshakeError{Code: ReplyUnacceptableValue, Detail: RecordSenderKey}, newHandshakeError(reply, false))
+		}
+	}
+
+	// another peer occupies the only slot
+	other := NewPeer(Sockaddr{IP: net.ParseIP("192.0.2.9"), Port: 10000})
+	srv.addPeer(other)
+	assertRejected(request("192.0.2.1"))
+	assert.Equal([]error{ErrPeerLimit}, rejected)
+	assert.Equal(1, srv.PeersCount())
+
+	srv.RemovePeer(srv.GetPeers()[0])
+	reply := request("192.0.2.1")
+	code, _ := reply.Records.ReplyCode()
+	assert.Equal(ReplySuccess, code)
+
+	// known keys may roam at the limit
+	reply = request("192.0.2.2")
+	code, _ = reply.Records.ReplyCode()
+	assert.Equal(ReplySuccess, code)
+
+	// but not while established with one endpoint per key
+	srv.config.MaxEndpointsPerKey = 1
+	peer := srv.GetPeers()[0]
+	peer.session = &Session{}
+	assertRejected(request("192.0.2.3"))
+	assert.Equal([]error{ErrPeerLimit, ErrKeyInUse}, rejected)
+
+	reply = request(peer.Remote.IP.String())
+	code, _ = reply.Records.ReplyCode()
+	assert.Equal(ReplySuccess, code)
+
+	// the pending handshake of 192.0.2.2 takes the second endpoint
+	srv.config.MaxEndpointsPerKey = 2
+	reply = request("192.0.2.2")
+	code, _ = reply.Records.ReplyCode()
+	assert.Equal(ReplySuccess, code)
+	assertRejected(request("192.0.2.3"))
+	assert.Equal([]error{ErrPeerLimit, ErrKeyInUse, ErrKeyInUse}, rejected)
+
+	m := srv.metrics
+	assert.EqualValues(1, testutil.ToFloat64(m.handshakesFailed.WithLabelValues(string(FailurePeerLimit))))
+	assert.EqualValues(2, testutil.ToFloat64(m.handshakesFailed.WithLabelValues(string(FailureKeyInUse))))
+}
+
+// testHandshakeFinish performs a handshake of testClientSecret and
+// returns the finish message, which is not passed to the server yet
+func testHandshakeFinish(t *testing.T, srv *Server) (*Handshake, *Message) {
+	return testHandshakeFrom(t, srv, Sockaddr{IP: net.ParseIP("127.0.0.1"), Port: 8755}, ModeTUN)
+}
+
+// testHandshakeFrom is testHandshakeFinish with the given endpoint and
+// mode of the client
+func testHandshakeFrom(t *testing.T, srv *Server, src Sockaddr, mode Mode) (*Handshake, *Message) {
+	hs := &Handshake{initiator: true, ourHandshakeKey: RandomKeypair()}
+	request := newHandshakeRequest(testClientSecret, hs.ourHandshakeKey, testServerSecret.Public(), mode)
+	request.Src = src
+	request.Dst = Sockaddr{IP: net.ParseIP("127.0.0.1"), Port: 10000}
+
+	reply := srv.handlePacket(remarshal(t, request))
+	require.NotNil(t, reply)
+
+	_, finish, err := completeHandshake(remarshal(t, reply), hs, testClientSecret, testServerSecret.Public(), MethodNames())
+	require.NoError(t, err)
+	finish.Records.SetMTU(1400)
+	return hs, finish
+}
+
+// remarshal returns the parsed message as received by the peer
+func remarshal(t *testing.T, msg *Message) *Message {
+	buf, err := msg.Marshal(true)
+	require.NoError(t, err)
+	parsed, err := ParseMessage(buf, true)
+	require.NoError(t, err)
+	return parsed
+}
+
+// newTestServer returns a server without a worker
+func newTestServer(impl ServerImpl) *Server {
+	srv := &Server{
+		impl:       impl,
+		peers:      make(map[string]*Peer),
+		peersByKey: make(map[string]*Peer),
+		pending:    make(map[string]*Peer),
+		metrics:    newServerMetrics(),
+	}
+	srv.config.serverKeys = testServerSecret
+	return srv
+}
+
+// testServerImpl is a ServerImpl without any transport
+type testServerImpl struct {
+	written   []*Message
+	clones    int
+	destroyed []string
+	modes     []Mode // supported modes, defaults to TUN
+}
+
+func (impl *testServerImpl) Read() chan *Message  { return nil }
+func (impl *testServerImpl) Close()               {}
+func (impl *testServerImpl) Peers() []*Peer       { return nil }
+func (impl *testServerImpl) Errors() <-chan error { return nil }
+
+func (impl *testServerImpl) Write(msg *Message) error {
+	impl.written = append(impl.written, msg)
+	return nil
+}
+
+func (impl *testServerImpl) Destroy(ifname string) {
+	impl.destroyed = append(impl.destroyed, ifname)
+}
+
+func (impl *testServerImpl) Modes() []Mode {
+	if impl.modes != nil {
+		return impl.modes
+	}
+	return []Mode{ModeTUN}
+}
+
+func (impl *testServerImpl) Clone(Sockaddr, []byte, Mode, bool) (string, error) {
+	impl.clones++
+	return fmt.Sprintf("fastd%d", impl.clones-1), nil
+}
+
+func (impl *testServerImpl) SetRemote(string, Sockaddr, []byte, bool) error {
+	return nil
+}
+
+func (impl *testServerImpl) Stats(string) (*IfaceStats, error) {
+	return &IfaceStats{}, nil
+}
+
+func (impl *testServerImpl) Methods() []string {
+	return MethodNames()
+}
+
+func (impl *testServerImpl) SetSession(string, *Session) error {
+	return nil
+}
@@ -0,0 +1,121 @@
+package fastd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultHookTimeout is the default maximum runtime of a hook command.
+const DefaultHookTimeout = 10 * time.Second
+
+// verifyCacheTime is the time a peer accepted by the verify hook is not
+// verified again
+const verifyCacheTime = time.Minute
+
+var errVerifyPending = errors.New("verification pending")
+
+// Hook is a shell command executed on a peer event. The server waits for
+// synchronous hooks, asynchronous ones run in the background.
+type Hook struct {
+	Command string
+	Async   bool
+}
+
+// Hooks are the shell commands executed on peer events. Like in the
+// reference implementation, the commands get the peer in environment
+// variables like PEER_KEY, PEER_ADDRESS and INTERFACE.
+type Hooks struct {
+	Up           *Hook // the interface of a peer has been created
+	Down         *Hook // the interface of a peer will be destroyed
+	Verify       *Hook // verifies unknown peers, a non-zero exit status rejects them
+	Establish    *Hook // the first session of a peer has been established
+	Disestablish *Hook // an established peer has been removed
+	Reject       *Hook // a handshake has been rejected by a limit, the reason is passed in REJECT_REASON
+
+	Timeout time.Duration // maximum runtime of a command, defaults to DefaultHookTimeout
+}
+
+func (hooks *Hooks) timeout() time.Duration {
+	if hooks.Timeout > 0 {
+		return hooks.Timeout
+	}
+	return DefaultHookTimeout
+}
+
+// runHook executes a hook for the peer. Errors of asynchronous hooks are
+// only logged.
+func (srv *Server) runHook(event string, hook *Hook, peer *Peer) {
+	if hook == nil {
+		return
+	}
+
+	srv.startHook(event, hook, srv.hookEnv(peer))
+}
+
+// startHook executes a hook with the given environment
+func (srv *Server) startHook(event string, hook *Hook, env []string) {
+	if hook.Async {
+		go srv.execHook(event, hook, env)
+	} else {
+		srv.execHook(event, hook, env)
+	}
+}
+
+// execHook runs the command of a hook and waits until it has exited
+func (srv *Server) execHook(event string, hook *Hook, env []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), srv.config.Hooks.timeout())
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", hook.Command)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = errors.Errorf("timed out after %v", srv.config.Hooks.timeout())
+	}
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			logrus.ErrorKey: err,
+			"event":         event,
+			"command":       hook.Command,
+		}).Error("hook failed")
+	}
+	return errors.Wrapf(err, "%s hook failed", event)
+}
+
+// hookEnv returns the environment variables describing the peer. It must
+// be called by the owner of the peer, the command may run concurrently.
+func (srv *Server) hookEnv(peer *Peer) []string {
+	env := []string{
+		"FASTD_PID=" + strconv.Itoa(os.Getpid()),
+		"INTERFACE=" + peer.Ifname,
+		"INTERFACE_MTU=" + strconv.Itoa(int(peer.MTU)),
+		fmt.Sprintf("LOCAL_KEY=%x", srv.config.serverKeys.public[:]),
+		fmt.Sprintf("PEER_KEY=%x", peer.PublicKey),
+		"PEER_NAME=" + peer.Name,
+	}
+
+	if peer.local.IP != nil {
+		env = append(env,
+			"LOCAL_ADDRESS="+peer.local.IP.String(),
+			"LOCAL_PORT="+strconv.Itoa(int(peer.local.Port)),
+		)
+	}
+	if peer.Remote.IP != nil {
+		env = append(env,
+			"PEER_ADDRESS="+peer.Remote.IP.String(),
+			"PEER_PORT="+strconv.Itoa(int(peer.Remote.Port)),
+		)
+	}
+
+	return env
+}
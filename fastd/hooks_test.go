@@ -0,0 +1,133 @@
+package fastd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHooks(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_, restore := withTestTun()
+	defer restore()
+
+	dir, err := ioutil.TempDir("", "fastd-hooks")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	events := filepath.Join(dir, "events")
+	hook := func(event string) *Hook {
+		return &Hook{Command: fmt.Sprintf(`echo %s $INTERFACE $PEER_KEY $PEER_PORT >> %s`, event, events)}
+	}
+
+	srv, session, peer := connectTestClient(t, Config{
+		Hooks: Hooks{
+			Up:           hook("up"),
+			Down:         hook("down"),
+			Verify:       hook("verify"),
+			Establish:    hook("establish"),
+			Disestablish: hook("disestablish"),
+		},
+	}, nil)
+	defer srv.Stop()
+	defer session.Close()
+
+	srv.call(func() { srv.RemovePeer(peer) })
+
+	data, err := ioutil.ReadFile(events)
+	require.NoError(err)
+
+	suffix := fmt.Sprintf("%x %d", testClientSecret.Public(), peer.Remote.Port)
+	assert.Equal([]string{
+		"verify " + suffix,
+		"up fastd0 " + suffix,
+		"establish fastd0 " + suffix,
+		"disestablish fastd0 " + suffix,
+		"down fastd0 " + suffix,
+	}, strings.Split(strings.TrimSpace(string(data)), "\n"))
+}
+
+func TestVerifyHookAsync(t *testing.T) {
+	require := require.New(t)
+	_, restore := withTestTun()
+	defer restore()
+
+	// the handshake is answered when the hook has finished
+	srv, session, peer := connectTestClient(t, Config{
+		Hooks: Hooks{Verify: &Hook{
+			Command: fmt.Sprintf(`sleep 0.2; test "$PEER_KEY" = %x`, testClientSecret.Public()),
+			Async:   true,
+		}},
+	}, nil)
+	session.Close()
+	srv.Stop()
+	require.False(peer.verifiedAt.IsZero())
+
+	// rejected peers get no reply
+	srv, remote := startTestServer(t, Config{
+		Hooks: Hooks{
+			Verify:  &Hook{Command: "sleep 1", Async: true},
+			Timeout: 100 * time.Millisecond,
+		},
+	})
+	defer srv.Stop()
+
+	config := testClientConfig(remote)
+	config.Timeout = 300 * time.Millisecond
+	client, err := NewClient(config)
+	require.NoError(err)
+	_, err = client.Connect()
+	require.Equal(ErrHandshakeTimeout, err)
+	require.Equal(0, srv.PeersCount())
+}
+
+func TestRemovePeerUnlocked(t *testing.T) {
+	assert := assert.New(t)
+	srv := newTestServer(&testServerImpl{})
+
+	// callbacks of removed peers may use the server
+	peers := -1
+	srv.config.ReleaseAddresses = func(*Peer) {
+		peers = srv.PeersCount()
+	}
+
+	peer, _ := srv.getPeer(Sockaddr{IP: net.ParseIP("192.0.2.1"), Port: 10000}, testClientSecret.Public(), true)
+	srv.RemovePeer(peer)
+	assert.Equal(0, peers)
+
+	// peers are released once
+	peers = -1
+	srv.RemovePeer(peer)
+	assert.Equal(-1, peers)
+}
+
+func TestRejectHook(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "fastd-hooks")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "reject")
+	srv := newTestServer(&testServerImpl{})
+	srv.config.MaxPeers = 1
+	srv.config.Hooks.Reject = &Hook{Command: fmt.Sprintf(`echo $REJECT_REASON $PEER_KEY $PEER_ADDRESS > %s`, out)}
+	srv.addPeer(NewPeer(Sockaddr{IP: net.ParseIP("192.0.2.9"), Port: 10000}))
+
+	msg := readTestmsg("null-request.dat")
+	assert.NotNil(srv.handlePacket(msg))
+
+	data, err := ioutil.ReadFile(out)
+	require.NoError(err)
+	assert.Equal(fmt.Sprintf("peer_limit %x %s\n", msg.Records[RecordSenderKey], msg.Src.IP), string(data))
+}
@@ -11,6 +11,14 @@ import (
 type IfaceStats struct {
 	ipackets uint64
 	opackets uint64
+	ibytes   uint64 // not provided by the kernel module
+	obytes   uint64 // not provided by the kernel module
+}
+
+// ifaceStatsParam is the counter struct of the kernel module
+type ifaceStatsParam struct {
+	ipackets uint64
+	opackets uint64
 }
 
 type ifconfigParam struct {
@@ -70,9 +78,12 @@ func SetRemote(ifname string, remote Sockaddr, pubkey []byte, compactHeader bool
 
 // GetStats returns the interface counters
 func GetStats(ifname string) (*IfaceStats, error) {
-	param := &IfaceStats{}
+	param := &ifaceStatsParam{}
 
 	err := ifconfig.GetDrvSpec(ifname, paramGetStats, unsafe.Pointer(param), unsafe.Sizeof(*param))
 
-	return param, err
+	return &IfaceStats{
+		ipackets: param.ipackets,
+		opackets: param.opackets,
+	}, err
 }
@@ -174,25 +174,57 @@ func (hs *Handshake) makeSharedKey(initiator bool, ourKey *KeyPair, peerKey []by
 	eccSigma := work.StorePackedLegacy()
 	sigma := eccSigma.Bytes()
 
-	// Derive shared key
-	hs.sharedKey = deriveKey(A, B, X, Y, sigma[:])
+	// Derive shared key, keep the pseudorandom key for the method keys
+	hs.prk = extractKey(sigma[:])
+	hs.keyInfo = keyInfo(A, B, X, Y)
+	hs.sharedKey = expandKey(hs.prk, hs.keyInfo, sha256.Size)
 
 	return true
 }
 
+// methodKey derives the session key for the given method
+func (hs *Handshake) methodKey(method string, length int) []byte {
+	info := make([]byte, 0, len(hs.keyInfo)+len(method))
+	info = append(info, hs.keyInfo...)
+	info = append(info, method...)
+
+	return expandKey(hs.prk, info, length)
+}
+
 func deriveKey(A, B, X, Y, sigma []byte) []byte {
-	// extract
+	return expandKey(extractKey(sigma), keyInfo(A, B, X, Y), sha256.Size)
+}
+
+// keyInfo concatenates the public keys for the key expansion
+func keyInfo(A, B, X, Y []byte) []byte {
+	info := make([]byte, 0, 4*KEYSIZE)
+	info = append(info, A...)
+	info = append(info, B...)
+	info = append(info, X...)
+	info = append(info, Y...)
+	return info
+}
+
+// extractKey is the HKDF-SHA256 extract step with an empty salt
+func extractKey(sigma []byte) []byte {
 	extractor := hmac.New(sha256.New, nil)
 	extractor.Write(sigma)
-	prk := extractor.Sum(nil)
+	return extractor.Sum(nil)
+}
 
-	// expand
-	expander := hmac.New(sha256.New, prk)
-	expander.Write(A)
-	expander.Write(B)
-	expander.Write(X)
-	expander.Write(Y)
-	expander.Write([]byte{0x01})
+// expandKey is the HKDF-SHA256 expand step
+func expandKey(prk, info []byte, length int) []byte {
+	out := make([]byte, 0, length+sha256.Size)
+	var prev []byte
+
+	for i := byte(1); len(out) < length; i++ {
+		expander := hmac.New(sha256.New, prk)
+		expander.Write(prev)
+		expander.Write(info)
+		expander.Write([]byte{i})
+		prev = expander.Sum(nil)
+		out = append(out, prev...)
+	}
 
-	return expander.Sum(nil)
+	return out[:length]
 }
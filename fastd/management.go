@@ -0,0 +1,376 @@
+package fastd
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Errors of the management API
+var (
+	ErrPeerNotFound      = errors.New("peer not found")
+	ErrServerStopped     = errors.New("server stopped")
+	ErrReloadUnsupported = errors.New("reload not configured")
+)
+
+// PeerInfo describes a peer in the management API.
+type PeerInfo struct {
+	PublicKey string `json:"public_key"` // hex encoded
+	PeerStatus
+	Vars []byte `json:"vars,omitempty"`
+}
+
+// PeerUpdate changes the attributes of a peer. The peer gets them with
+// its next handshake, addresses of an established peer are assigned to
+// its interface immediately. AssignAddresses may replace them on the
+// next handshake.
+type PeerUpdate struct {
+	Vars []byte         `json:"vars"` // replaces the Vars unless nil, empty Vars remove them
+	IPv4 *AddressConfig `json:"ipv4,omitempty"`
+	IPv6 *AddressConfig `json:"ipv6,omitempty"`
+}
+
+// ListPeers returns all peers ordered by public key.
+func (srv *Server) ListPeers() ([]*PeerInfo, error) {
+	var peers []*PeerInfo
+	ok := srv.call(func() {
+		now := time.Now()
+		for _, peer := range srv.GetPeers() {
+			peers = append(peers, peer.info(srv.impl, now))
+		}
+	})
+	if !ok {
+		return nil, ErrServerStopped
+	}
+
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].PublicKey < peers[j].PublicKey
+	})
+	return peers, nil
+}
+
+// LookupPeer returns the peer with the given hex encoded public key or
+// interface name.
+func (srv *Server) LookupPeer(id string) (info *PeerInfo, err error) {
+	err = srv.withPeer(id, func(peer *Peer) {
+		info = peer.info(srv.impl, time.Now())
+	})
+	return
+}
+
+// KickPeer removes the peer with the given hex encoded public key or
+// interface name. The peer may connect again.
+func (srv *Server) KickPeer(id string) error {
+	return srv.withPeer(id, srv.RemovePeer)
+}
+
+// UpdatePeer changes the peer with the given hex encoded public key or
+// interface name and returns its new state.
+func (srv *Server) UpdatePeer(id string, update *PeerUpdate) (info *PeerInfo, err error) {
+	err = srv.withPeer(id, func(peer *Peer) {
+		peer.update(update)
+		info = peer.info(srv.impl, time.Now())
+	})
+	return
+}
+
+// Reload calls the OnReload func of the config.
+func (srv *Server) Reload() error {
+	f := srv.config.OnReload
+	if f == nil {
+		return ErrReloadUnsupported
+	}
+	return f()
+}
+
+// withPeer calls f in the worker with the peer of the given public key
+// or interface name
+func (srv *Server) withPeer(id string, f func(*Peer)) error {
+	found := false
+	ok := srv.call(func() {
+		if peer := srv.findPeer(id); peer != nil {
+			found = true
+			f(peer)
+		}
+	})
+
+	if !ok {
+		return ErrServerStopped
+	}
+	if !found {
+		return ErrPeerNotFound
+	}
+	return nil
+}
+
+// findPeer returns the peer of a hex encoded public key or an interface
+// name
+func (srv *Server) findPeer(id string) *Peer {
+	srv.peersMtx.RLock()
+	defer srv.peersMtx.RUnlock()
+
+	if key, err := hex.DecodeString(id); err == nil && len(key) == KEYSIZE {
+		if peer := srv.peersByKey[string(key)]; peer != nil {
+			return peer
+		}
+	}
+	for _, peer := range srv.peers {
+		if peer.Ifname != "" && peer.Ifname == id {
+			return peer
+		}
+	}
+	return nil
+}
+
+func (peer *Peer) info(impl ServerImpl, now time.Time) *PeerInfo {
+	return &PeerInfo{
+		PublicKey:  hex.EncodeToString(peer.PublicKey),
+		PeerStatus: *peer.status(impl, now),
+		Vars:       peer.Vars,
+	}
+}
+
+func (peer *Peer) update(update *PeerUpdate) {
+	if update.Vars != nil {
+		peer.Vars = update.Vars
+		if len(peer.Vars) == 0 {
+			peer.Vars = nil
+		}
+	}
+	if update.IPv4 != nil {
+		peer.IPv4 = *update.IPv4
+	}
+	if update.IPv6 != nil {
+		peer.IPv6 = *update.IPv6
+	}
+
+	if peer.session != nil && (update.IPv4 != nil || update.IPv6 != nil) {
+		peer.assignAddresses()
+	}
+}
+
+// startManagementSocket serves the management API on a Unix socket,
+// which is only accessible by the owner.
+func (srv *Server) startManagementSocket(path string) error {
+	ln, err := listenUnix(path)
+	if err != nil {
+		return errors.Wrap(err, "unable to create management socket")
+	}
+	if err = os.Chmod(path, 0600); err != nil {
+		ln.Close()
+		return errors.Wrap(err, "unable to change permissions of management socket")
+	}
+	log.WithField("path", path).Info("management socket created")
+
+	srv.management = &http.Server{Handler: srv.managementHandler()}
+	srv.wg.Add(1)
+	go func() {
+		defer srv.wg.Done()
+		srv.management.Serve(ln)
+	}()
+	return nil
+}
+
+// managementHandler returns the HTTP handler of the management API:
+//
+//	GET    /peers       lists all peers
+//	GET    /peers/<id>  returns a peer by public key or interface name
+//	PATCH  /peers/<id>  changes a peer with a PeerUpdate
+//	DELETE /peers/<id>  removes a peer
+//	POST   /reload      calls OnReload
+func (srv *Server) managementHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/peers", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodGet) {
+			return
+		}
+		peers, err := srv.ListPeers()
+		writeResult(w, peers, err)
+	})
+
+	mux.HandleFunc("/peers/", func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, "/peers/")
+
+		switch r.Method {
+		case http.MethodGet:
+			info, err := srv.LookupPeer(id)
+			writeResult(w, info, err)
+		case http.MethodPatch:
+			update := PeerUpdate{}
+			if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			info, err := srv.UpdatePeer(id, &update)
+			writeResult(w, info, err)
+		case http.MethodDelete:
+			writeResult(w, nil, srv.KickPeer(id))
+		default:
+			allowMethods(w, r, http.MethodGet, http.MethodPatch, http.MethodDelete)
+		}
+	})
+
+	mux.HandleFunc("/reload", func(w http.ResponseWriter, r *http.Request) {
+		if allowMethods(w, r, http.MethodPost) {
+			writeResult(w, nil, srv.Reload())
+		}
+	})
+
+	return mux
+}
+
+// allowMethods replies with 405 Method Not Allowed unless the request
+// has one of the given methods
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	if contains(methods, r.Method) {
+		return true
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	return false
+}
+
+// writeResult writes the result as JSON or the error with a matching
+// status code. A nil result gives an empty response.
+func writeResult(w http.ResponseWriter, result interface{}, err error) {
+	switch err {
+	case nil:
+	case ErrPeerNotFound:
+		writeError(w, http.StatusNotFound, err)
+		return
+	case ErrServerStopped:
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	case ErrReloadUnsupported:
+		writeError(w, http.StatusNotImplemented, err)
+		return
+	default:
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if result == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{err.Error()})
+}
+
+// ManagementClient talks to the management socket of a server.
+type ManagementClient struct {
+	client http.Client
+}
+
+// NewManagementClient returns a client for the management socket at
+// the given path.
+func NewManagementClient(path string) *ManagementClient {
+	dialer := net.Dialer{}
+	return &ManagementClient{
+		client: http.Client{
+			Timeout: 10 * time.Second,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return dialer.DialContext(ctx, "unix", path)
+				},
+			},
+		},
+	}
+}
+
+// Peers returns all peers of the server.
+func (c *ManagementClient) Peers() (peers []*PeerInfo, err error) {
+	err = c.do(http.MethodGet, "/peers", nil, &peers)
+	return
+}
+
+// Peer returns the peer with the given hex encoded public key or
+// interface name.
+func (c *ManagementClient) Peer(id string) (*PeerInfo, error) {
+	info := &PeerInfo{}
+	if err := c.do(http.MethodGet, "/peers/"+url.PathEscape(id), nil, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// UpdatePeer changes the peer with the given hex encoded public key or
+// interface name.
+func (c *ManagementClient) UpdatePeer(id string, update *PeerUpdate) (*PeerInfo, error) {
+	info := &PeerInfo{}
+	if err := c.do(http.MethodPatch, "/peers/"+url.PathEscape(id), update, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Kick removes the peer with the given hex encoded public key or
+// interface name.
+func (c *ManagementClient) Kick(id string) error {
+	return c.do(http.MethodDelete, "/peers/"+url.PathEscape(id), nil, nil)
+}
+
+// Reload makes the server reload its configuration.
+func (c *ManagementClient) Reload() error {
+	return c.do(http.MethodPost, "/reload", nil, nil)
+}
+
+// do sends a request with an optional JSON body and decodes the result.
+// Known errors of the server are returned as such.
+func (c *ManagementClient) do(method, path string, body, result interface{}) error {
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, "http://fastd"+path, &reqBody)
+	if err != nil {
+		return err
+	}
+	res, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		response := errorResponse{}
+		if err := json.NewDecoder(res.Body).Decode(&response); err != nil || response.Error == "" {
+			return errors.Errorf("unexpected response: %s", res.Status)
+		}
+		for _, known := range []error{ErrPeerNotFound, ErrServerStopped, ErrReloadUnsupported} {
+			if response.Error == known.Error() {
+				return known
+			}
+		}
+		return errors.New(response.Error)
+	}
+
+	if result == nil {
+		return nil
+	}
+	return errors.Wrap(json.NewDecoder(res.Body).Decode(result), "invalid response")
+}
@@ -0,0 +1,100 @@
+package fastd
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManagementSocket(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_, restore := withTestTun()
+	defer restore()
+
+	dir, err := ioutil.TempDir("", "fastd")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "management.sock")
+
+	reloads := 0
+	srv, session, _ := connectTestClient(t, Config{
+		ManagementSocket: path,
+		OnReload: func() error {
+			reloads++
+			return nil
+		},
+	}, nil)
+	defer srv.Stop()
+	defer session.Close()
+
+	fi, err := os.Stat(path)
+	require.NoError(err)
+	assert.Equal(os.FileMode(0600), fi.Mode().Perm())
+
+	client := NewManagementClient(path)
+	key := hex.EncodeToString(testClientSecret.Public())
+
+	// list peers
+	peers, err := client.Peers()
+	require.NoError(err)
+	require.Len(peers, 1)
+	assert.Equal(key, peers[0].PublicKey)
+	assert.Equal("fastd0", peers[0].Interface)
+	assert.Equal("established", peers[0].Handshake)
+
+	// get peer by key and interface name
+	for _, id := range []string{key, "fastd0"} {
+		info, err := client.Peer(id)
+		require.NoError(err, id)
+		assert.Equal(key, info.PublicKey)
+	}
+	_, err = client.Peer("fastd1")
+	assert.Equal(ErrPeerNotFound, err)
+
+	// update Vars and addresses
+	info, err := client.UpdatePeer("fastd0", &PeerUpdate{
+		Vars: []byte("foo"),
+		IPv4: &AddressConfig{LocalAddr: net.ParseIP("10.0.0.1"), DestAddr: net.ParseIP("10.0.0.2")},
+	})
+	require.NoError(err)
+	assert.Equal([]byte("foo"), info.Vars)
+	assert.Equal("10.0.0.2", info.IPv4.DestAddr.String())
+
+	// the next handshake sends them
+	remote := srv.impl.(*UDPServer).connections[0].conn.LocalAddr().String()
+	c, err := NewClient(testClientConfig(remote))
+	require.NoError(err)
+	session2, err := c.Connect()
+	require.NoError(err)
+	defer session2.Close()
+	assert.Equal([]byte("foo"), session2.Vars)
+	assert.Equal("10.0.0.2", session2.IPv4.LocalAddr.String())
+
+	// reload
+	require.NoError(client.Reload())
+	assert.Equal(1, reloads)
+
+	// kick
+	require.NoError(client.Kick(key))
+	assert.Equal(0, srv.PeersCount())
+	assert.Equal(ErrPeerNotFound, client.Kick(key))
+
+	// the socket is removed on shutdown
+	srv.Stop()
+	_, err = os.Stat(path)
+	assert.True(os.IsNotExist(err))
+	_, err = srv.ListPeers()
+	assert.Equal(ErrServerStopped, err)
+}
+
+func TestManagementReloadUnsupported(t *testing.T) {
+	srv := newTestServer(&testServerImpl{})
+	assert.Equal(t, ErrReloadUnsupported, srv.Reload())
+}
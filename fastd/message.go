@@ -6,6 +6,7 @@ import (
 	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
+	"io"
 
 	"github.com/pkg/errors"
 )
@@ -29,6 +30,19 @@ const (
 	HandshakeFinish
 )
 
+func (typ HandshakeType) String() string {
+	switch typ {
+	case HandshakeRequest:
+		return "request"
+	case HandshakeReply:
+		return "reply"
+	case HandshakeFinish:
+		return "finish"
+	default:
+		return fmt.Sprintf("handshake type %d", byte(typ))
+	}
+}
+
 // A ReplyCode is set in handshake packets.
 type ReplyCode byte
 
@@ -39,6 +53,19 @@ const (
 	ReplyUnacceptableValue
 )
 
+func (code ReplyCode) String() string {
+	switch code {
+	case ReplySuccess:
+		return "success"
+	case ReplyRecordMissing:
+		return "record missing"
+	case ReplyUnacceptableValue:
+		return "unacceptable value"
+	default:
+		return fmt.Sprintf("reply code %d", byte(code))
+	}
+}
+
 // Mode represents tunnel modes.
 type Mode byte
 
@@ -48,16 +75,78 @@ const (
 	ModeTUN
 )
 
+func (mode Mode) String() string {
+	switch mode {
+	case ModeTAP:
+		return "tap"
+	case ModeTUN:
+		return "tun"
+	default:
+		return fmt.Sprintf("mode %d", byte(mode))
+	}
+}
+
+// MaxMessageSize is the maximum size of a marshalled handshake message,
+// larger ones do not fit into a UDP datagram over IPv6 with a path MTU
+// of 1500 bytes.
+const MaxMessageSize = 1500 - 40 - 8
+
+// ErrMessageTooLarge is returned when marshalling a message larger than
+// MaxMessageSize.
+var ErrMessageTooLarge = errors.New("message too large")
+
+// emptyMAC is the placeholder of the HMAC while it is calculated
+var emptyMAC [sha256.Size]byte
+
 // Message is a fastd handshake message
 type Message struct {
 	Src     Sockaddr
 	Dst     Sockaddr
 	Type    MessageType
 	Records Records
+	Unknown []Record // records with unknown keys in the order of the packet
+	Order   []TLVKey // order of the marshalled records including unknown ones, set by Unmarshal, defaults to ReferenceOrder
 	SignKey []byte
 	raw     []byte
 }
 
+// Record is a Type-Length-Value record.
+type Record struct {
+	Key   TLVKey
+	Value []byte
+}
+
+// Errors of malformed packets, wrapped in a *ParseError.
+var (
+	ErrPacketTooShort  = errors.New("packet too short")
+	ErrLengthMismatch  = errors.New("length does not match packet size")
+	ErrRecordTruncated = errors.New("record truncated")
+	ErrTrailingBytes   = errors.New("trailing bytes after last record")
+)
+
+// ParseError describes a malformed packet.
+type ParseError struct {
+	Err    error  // one of ErrPacketTooShort, ErrLengthMismatch, ErrRecordTruncated or ErrTrailingBytes
+	Offset int    // offset of the malformed data in the fastd packet
+	Key    TLVKey // key of a truncated record
+}
+
+func (err *ParseError) Error() string {
+	switch err.Err {
+	case ErrRecordTruncated:
+		return fmt.Sprintf("%v: key %d at offset %d", err.Err, err.Key, err.Offset)
+	case ErrTrailingBytes:
+		return fmt.Sprintf("%v at offset %d", err.Err, err.Offset)
+	default:
+		return err.Err.Error()
+	}
+}
+
+// Unwrap returns the underlying error.
+func (err *ParseError) Unwrap() error {
+	return err.Err
+}
+
 // NewReply creates a reply to the message
 func (msg *Message) NewReply() *Message {
 	reply := &Message{
@@ -102,16 +191,13 @@ func ParseMessage(buf []byte, includeSockaddr bool) (*Message, error) {
 	offset := 0
 	if includeSockaddr {
 		if len(buf) < 40 {
-			return nil, fmt.Errorf("packet too small (%d bytes)", len(buf))
+			return nil, &ParseError{Err: ErrPacketTooShort}
 		}
 		msg.Src = parseSockaddr(buf[0:18])
 		msg.Dst = parseSockaddr(buf[18:36])
 		offset = 36
-	} else if len(buf) < 4 {
-		return nil, fmt.Errorf("packet too small (%d bytes)", len(buf))
 	}
 
-	msg.Type = MessageType(buf[offset])
 	msg.raw = buf[offset:]
 
 	if err := msg.Unmarshal(msg.raw); err != nil {
@@ -122,112 +208,190 @@ func ParseMessage(buf []byte, includeSockaddr bool) (*Message, error) {
 }
 
 // Marshal serializes the message and optionally adds the HMAC
-func (msg *Message) Marshal(includeSockaddr bool) []byte {
-	bytes := make([]byte, 1500)
-	offset := 0
+func (msg *Message) Marshal(includeSockaddr bool) ([]byte, error) {
+	if !includeSockaddr {
+		return msg.AppendPayload(make([]byte, 0, msg.Size()))
+	}
 
-	if includeSockaddr {
-		msg.Src.Write(bytes)
-		msg.Dst.Write(bytes[18:])
-		offset = 36
+	buf := make([]byte, 36, 36+msg.Size())
+	msg.Src.Write(buf)
+	msg.Dst.Write(buf[18:])
+	return msg.AppendPayload(buf)
+}
+
+// Size returns the size of the marshalled payload.
+func (msg *Message) Size() int {
+	size := 4
+	msg.eachRecord(func(_ TLVKey, val []byte) {
+		size += 4 + len(val)
+	})
+	return size
+}
+
+// AppendPayload appends the payload to buf and returns the extended
+// buffer. It fails if the payload exceeds MaxMessageSize.
+func (msg *Message) AppendPayload(buf []byte) ([]byte, error) {
+	size := msg.Size()
+	if size > MaxMessageSize {
+		return buf, ErrMessageTooLarge
+	}
+
+	n := len(buf)
+	if cap(buf)-n < size {
+		grown := make([]byte, n, n+size)
+		copy(grown, buf)
+		buf = grown
 	}
+	buf = buf[:n+size]
+	msg.writePayload(buf[n:])
+	return buf, nil
+}
 
-	n := msg.MarshalPayload(bytes[offset:])
-	return bytes[:offset+n]
+// MarshalPayload writes the payload into the given slice and returns
+// the number of bytes written. It fails if the payload exceeds
+// MaxMessageSize or the slice is too small.
+func (msg *Message) MarshalPayload(out []byte) (int, error) {
+	size := msg.Size()
+	if size > MaxMessageSize {
+		return 0, ErrMessageTooLarge
+	}
+	if len(out) < size {
+		return 0, io.ErrShortBuffer
+	}
+	msg.writePayload(out[:size])
+	return size, nil
 }
 
-// MarshalPayload writes the payload into the given slice. The slice needs
-// to be large enough to hold the payload data, or else it will panic.
-func (msg *Message) MarshalPayload(out []byte) int {
+// writePayload writes the payload into a slice of its exact size
+func (msg *Message) writePayload(out []byte) {
 	// Header
 	out[0] = byte(msg.Type)
+	out[1] = 0
+	binary.BigEndian.PutUint16(out[2:], uint16(len(out)-4))
 	i := 4
 
-	// Function for appending records
-	addRecord := func(key TLVKey, val []byte) {
+	msg.eachRecord(func(key TLVKey, val []byte) {
 		binary.LittleEndian.PutUint16(out[i:], uint16(key))
 		binary.LittleEndian.PutUint16(out[i+2:], uint16(len(val)))
 		copy(out[i+4:], val)
 		i += 4 + len(val)
+	})
+
+	// Add HMAC (optional)
+	if msg.SignKey != nil {
+		mac := hmac.New(sha256.New, msg.SignKey)
+		mac.Write(out[4:])
+		mac.Sum(out[:len(out)-sha256.Size])
 	}
+}
 
-	// Append records
-	for key, val := range msg.Records {
-		if val != nil {
-			addRecord(TLVKey(key), val)
+// eachRecord calls f for all records in the order of the message. Known
+// records missing in the order follow in key order, then the remaining
+// unknown records and the HMAC. The HMAC is always last and zeroed if
+// the message is signed.
+func (msg *Message) eachRecord(f func(key TLVKey, val []byte)) {
+	order := msg.Order
+	if order == nil {
+		order = ReferenceOrder
+	}
+
+	var done [RecordMax]bool
+	done[RecordTLVMAC] = true
+	record := func(key TLVKey) {
+		if key < RecordMax && !done[key] {
+			done[key] = true
+			if val := msg.Records[key]; val != nil {
+				f(key, val)
+			}
 		}
 	}
 
-	// Add HMAC (optional)
-	if msg.SignKey != nil {
-		addRecord(RecordTLVMAC, make([]byte, sha256.Size))
-		mac := hmac.New(sha256.New, msg.SignKey)
-		mac.Write(out[4:i])
-		copy(out[i-sha256.Size:], mac.Sum(nil))
+	// unknown keys in the order refer to the next unknown record with
+	// this key
+	unknownDone := make([]bool, len(msg.Unknown))
+	unknown := func(key TLVKey) {
+		for i, rec := range msg.Unknown {
+			if !unknownDone[i] && rec.Key == key {
+				unknownDone[i] = true
+				f(rec.Key, rec.Value)
+				return
+			}
+		}
 	}
 
-	// Set length
-	binary.BigEndian.PutUint16(out[2:], uint16(i-4))
+	for _, key := range order {
+		if key < RecordMax {
+			record(key)
+		} else {
+			unknown(key)
+		}
+	}
+	for key := TLVKey(0); key < RecordMax; key++ {
+		record(key)
+	}
+	for i, rec := range msg.Unknown {
+		if !unknownDone[i] {
+			f(rec.Key, rec.Value)
+		}
+	}
 
-	return i
+	if msg.SignKey != nil {
+		f(RecordTLVMAC, emptyMAC[:])
+	} else if val := msg.Records[RecordTLVMAC]; val != nil {
+		f(RecordTLVMAC, val)
+	}
 }
 
-// Unmarshal decodes the packet
-// It will zero the HMAC bytes in the given slice
-func (msg *Message) Unmarshal(data []byte) (err error) {
-	msg.Type = MessageType(data[0])
-
+// Unmarshal decodes the packet. Records with unknown keys are kept in
+// Unknown, a known record given twice is replaced. The order of the keys
+// is kept in Order, so the message is marshalled as received. It will
+// zero the HMAC bytes in the given slice.
+func (msg *Message) Unmarshal(data []byte) error {
 	// fastd header
-	length := binary.BigEndian.Uint16(data[2:4])
+	if len(data) < 4 {
+		return &ParseError{Err: ErrPacketTooShort}
+	}
+	msg.Type = MessageType(data[0])
+	length := int(binary.BigEndian.Uint16(data[2:4]))
 
-	if len(data)-4 != int(length) {
-		err = fmt.Errorf("wrong data size: expected=%d actual=%d", length, len(data))
-		return
+	if len(data)-4 != length {
+		return &ParseError{Err: ErrLengthMismatch}
 	}
 
-	// Shift header
-	data = data[4:]
+	for offset := 4; offset < len(data); {
+		if len(data)-offset < 4 {
+			return &ParseError{Err: ErrTrailingBytes, Offset: offset}
+		}
 
-	for len(data) >= 4 {
-		typ := TLVKey(binary.LittleEndian.Uint16(data[0:2]))
-		length = binary.LittleEndian.Uint16(data[2:4])
+		typ := TLVKey(binary.LittleEndian.Uint16(data[offset:]))
+		length := int(binary.LittleEndian.Uint16(data[offset+2:]))
+		start := offset + 4
+		end := start + length
 
-		if typ >= RecordMax {
-			// unsupported field
-			continue
+		if end > len(data) {
+			return &ParseError{Err: ErrRecordTruncated, Offset: offset, Key: typ}
 		}
 
-		// Shift Type+Length
-		data = data[4:]
-		if uint16(len(data)) < length {
-			err = fmt.Errorf("wrong value size: expected=%d actual=%d", length, len(data))
-			return
+		value := data[start:end:end]
+		if typ != RecordTLVMAC {
+			msg.Order = append(msg.Order, typ)
 		}
 
-		if typ == RecordTLVMAC {
-			// Add record and copy value
-			value := make([]byte, length)
-			copy(value, data[:length])
-			msg.Records[typ] = value
-
-			// Zero the source bytes to conform the HMAC function
-			for i := 0; i < int(length); i++ {
-				data[i] = 0
+		switch {
+		case typ == RecordTLVMAC:
+			// Copy the value and zero the source bytes to conform the HMAC function
+			msg.Records[typ] = append([]byte(nil), value...)
+			for i := range value {
+				value[i] = 0
 			}
-		} else {
-			// Add record and reference value
-			msg.Records[typ] = data[:length]
-
-			/*
-				if typ == RECORD_HANDSHAKE_TYPE {
-					ioutil.WriteFile(fmt.Sprintf("null-%d.dat", data[0]), msg.raw, 0644)
-				}
-			*/
+		case typ < RecordMax:
+			msg.Records[typ] = value
+		default:
+			msg.Unknown = append(msg.Unknown, Record{Key: typ, Value: value})
 		}
 
-		// Strip data
-		data = data[length:]
+		offset = end
 	}
 
-	return
+	return nil
 }
@@ -1,11 +1,16 @@
 package fastd
 
 import (
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
+	"io"
 	"io/ioutil"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 var (
@@ -42,14 +47,16 @@ func TestParseRequest(t *testing.T) {
 	// Sender Handshake Key
 	assert.Equal("2d25af50e5beab86fa0014caa5a06a32afca1f3467499c5dbdc252e74d95ee90", hex.EncodeToString(msg.Records[RecordSenderHandshakeKey]))
 
-	// Marshaling
-	assert.Equal(len(bytes), len(msg.Marshal(true)))
+	// Marshaling reproduces the packet of the reference implementation
+	marshalled, err := msg.Marshal(true)
+	assert.NoError(err)
+	assert.Equal(readTestdata("null-request.dat"), marshalled)
 
 	// Parse marshaled message
-	msg2, err := ParseMessage(msg.Marshal(true), true)
+	msg2, err := ParseMessage(marshalled, true)
 	assert.Nil(err)
 	assert.NotNil(msg2)
-	//assert.EqualValues(msg.Marshal(), msg2.Marshal())
+	assert.Equal(msg.Records, msg2.Records)
 }
 
 func TestVerifySignature(t *testing.T) {
@@ -70,6 +77,148 @@ func TestVerifySignature(t *testing.T) {
 	// Valid signing key
 	msg.SignKey = testSharedKey
 	assert.True(msg.VerifySignature())
+
+	// Marshaling reproduces the packet of the reference implementation
+	marshalled, err := msg.Marshal(true)
+	assert.NoError(err)
+	assert.Equal(readTestdata("null-finish.dat"), marshalled)
+}
+
+func TestMarshal(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	msg := &Message{Type: TypeHandshake}
+	msg.Records.
+		SetHandshakeType(HandshakeReply).
+		SetReplyCode(ReplySuccess).
+		SetMode(ModeTUN)
+	expected := MustDecodeHex("0100000f" + "0000010002" + "0400010001" + "0100010000")
+	assert.Equal(len(expected), msg.Size())
+
+	// appending to a buffer
+	buf, err := msg.AppendPayload([]byte{0xff})
+	require.NoError(err)
+	assert.Equal(append([]byte{0xff}, expected...), buf)
+
+	// without allocation
+	buf = make([]byte, 0, 64)
+	out, err := msg.AppendPayload(buf)
+	require.NoError(err)
+	assert.True(&buf[:1][0] == &out[0])
+
+	// into a slice
+	buf = make([]byte, 64)
+	n, err := msg.MarshalPayload(buf)
+	require.NoError(err)
+	assert.Equal(expected, buf[:n])
+	_, err = msg.MarshalPayload(buf[:n-1])
+	assert.Equal(io.ErrShortBuffer, err)
+
+	// custom order
+	msg.Order = []TLVKey{RecordMode, RecordReplyCode}
+	buf, err = msg.Marshal(false)
+	require.NoError(err)
+	assert.Equal(MustDecodeHex("0100000f"+"0400010001"+"0100010000"+"0000010002"), buf)
+
+	// too large
+	msg.Records.SetVars(make([]byte, MaxMessageSize))
+	_, err = msg.Marshal(false)
+	assert.Equal(ErrMessageTooLarge, err)
+	_, err = msg.MarshalPayload(make([]byte, 2*MaxMessageSize))
+	assert.Equal(ErrMessageTooLarge, err)
+}
+
+func TestUnknownRecords(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	msg := &Message{Type: TypeHandshake, SignKey: testSharedKey}
+	msg.Records.SetHandshakeType(HandshakeRequest)
+	msg.Unknown = []Record{
+		{Key: 0x42, Value: []byte("foo")},
+		{Key: RecordMax, Value: []byte{}},
+		{Key: 0x42, Value: []byte("bar")},
+	}
+
+	buf, err := msg.Marshal(false)
+	require.NoError(err)
+	parsed, err := ParseMessage(buf, false)
+	require.NoError(err)
+	assert.Equal(msg.Unknown, parsed.Unknown)
+
+	// unknown records are covered by the HMAC
+	parsed.SignKey = testSharedKey
+	assert.True(parsed.VerifySignature())
+	parsed.raw[len(parsed.raw)-4-sha256.Size-1] ^= 0xff
+	assert.False(parsed.VerifySignature())
+}
+
+func TestUnknownRecordsRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	// unknown records between known ones in a non-reference order
+	records := []Record{
+		{Key: RecordMode, Value: []byte{byte(ModeTUN)}},
+		{Key: 0x42, Value: []byte("foo")},
+		{Key: RecordHandshakeType, Value: []byte{byte(HandshakeRequest)}},
+		{Key: RecordMax, Value: []byte{}},
+		{Key: 0x42, Value: []byte("bar")},
+		{Key: RecordProtocolName, Value: []byte(protocolName)},
+	}
+
+	buf := []byte{byte(TypeHandshake), 0, 0, 0}
+	for _, rec := range records {
+		buf = append(buf, byte(rec.Key), byte(rec.Key>>8), byte(len(rec.Value)), 0)
+		buf = append(buf, rec.Value...)
+	}
+	binary.BigEndian.PutUint16(buf[2:], uint16(len(buf)-4))
+
+	msg, err := ParseMessage(append([]byte(nil), buf...), false)
+	require.NoError(err)
+	assert.Equal([]TLVKey{RecordMode, 0x42, RecordHandshakeType, RecordMax, 0x42, RecordProtocolName}, msg.Order)
+
+	out, err := msg.Marshal(false)
+	require.NoError(err)
+	assert.Equal(buf, out)
+}
+
+func TestParseMalformed(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet string
+		err    error
+		offset int
+	}{
+		{"short header", "010000", ErrPacketTooShort, 0},
+		{"length mismatch", "0100000500000000", ErrLengthMismatch, 0},
+		{"truncated record", "0100000600000300aabb", ErrRecordTruncated, 4},
+		{"truncated unknown record", "010000094200010011ff00ff00", ErrRecordTruncated, 9},
+		{"trailing bytes", "0100000742000000aabbcc", ErrTrailingBytes, 8},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ParseMessage(MustDecodeHex(test.packet), false)
+
+			var parseErr *ParseError
+			require.True(t, errors.As(err, &parseErr), "%v", err)
+			assert.Equal(t, test.err, parseErr.Err)
+			assert.Equal(t, test.offset, parseErr.Offset)
+			assert.True(t, errors.Is(err, test.err))
+		})
+	}
+}
+
+func TestParseTruncated(t *testing.T) {
+	packet := readTestdata("null-request.dat")
+
+	for i := 0; i < len(packet); i++ {
+		buf := append([]byte(nil), packet[:i]...)
+		_, err := ParseMessage(buf, true)
+		assert.Error(t, err, i)
+	}
 }
 
 func readTestdata(name string) []byte {
@@ -0,0 +1,96 @@
+package fastd
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Method encrypts and authenticates the payload of data packets. The
+// nonce is the nonce of the common method header.
+type Method interface {
+	Name() string   // name used in the handshake
+	KeyLength() int // length of the session key
+	Overhead() int  // number of bytes added to the payload
+
+	// Encrypt appends the encrypted and authenticated payload to dst
+	Encrypt(dst, nonce, payload []byte) []byte
+
+	// Decrypt verifies the data and appends the decrypted payload to dst
+	Decrypt(dst, nonce, data []byte) ([]byte, error)
+}
+
+// MethodBuilder creates a Method using the given session key.
+type MethodBuilder func(key []byte) (Method, error)
+
+type methodEntry struct {
+	keyLength int
+	builder   MethodBuilder
+}
+
+var (
+	methods     = make(map[string]methodEntry)
+	methodNames []string // in order of registration
+	methodsMtx  sync.RWMutex
+)
+
+func init() {
+	RegisterMethod("salsa2012+umac", umacKeyLength, newUMACMethod(true))
+	RegisterMethod("chacha20-poly1305", chacha20poly1305KeyLength, newChaCha20Poly1305Method)
+	RegisterMethod("aes128-gcm", aes128gcmKeyLength, newAES128GCMMethod)
+	RegisterMethod("null+salsa2012+umac", umacKeyLength, newUMACMethod(false))
+	RegisterMethod("null", 0, newNullMethod)
+}
+
+// RegisterMethod makes a method available under the given name. A
+// method registered under an existing name replaces the former one.
+func RegisterMethod(name string, keyLength int, builder MethodBuilder) {
+	methodsMtx.Lock()
+	defer methodsMtx.Unlock()
+
+	if _, exists := methods[name]; !exists {
+		methodNames = append(methodNames, name)
+	}
+	methods[name] = methodEntry{keyLength: keyLength, builder: builder}
+}
+
+// MethodNames returns the names of all registered methods in order of
+// registration.
+func MethodNames() []string {
+	methodsMtx.RLock()
+	defer methodsMtx.RUnlock()
+
+	return append([]string(nil), methodNames...)
+}
+
+// newMethod creates the method with the given name. The session key is
+// obtained by calling key with the key length of the method.
+func newMethod(name string, key func(length int) []byte) (Method, error) {
+	methodsMtx.RLock()
+	entry, ok := methods[name]
+	methodsMtx.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unsupported method: %s", name)
+	}
+
+	return entry.builder(key(entry.keyLength))
+}
+
+// nullMethod passes the payload unencrypted and unauthenticated
+type nullMethod struct{}
+
+func newNullMethod([]byte) (Method, error) {
+	return nullMethod{}, nil
+}
+
+func (nullMethod) Name() string   { return "null" }
+func (nullMethod) KeyLength() int { return 0 }
+func (nullMethod) Overhead() int  { return 0 }
+
+func (nullMethod) Encrypt(dst, nonce, payload []byte) []byte {
+	return append(dst, payload...)
+}
+
+func (nullMethod) Decrypt(dst, nonce, data []byte) ([]byte, error) {
+	return append(dst, data...), nil
+}
@@ -0,0 +1,85 @@
+package fastd
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	aeadTagSize               = 16
+	chacha20poly1305KeyLength = chacha20poly1305.KeySize
+	aes128gcmKeyLength        = 16
+)
+
+// aeadMethod implements the aes128-gcm and chacha20-poly1305 methods.
+// Like the other methods, the tag precedes the ciphertext. The nonce of
+// the method header is zero-padded to the 96 bit nonce of the cipher.
+//
+// aes128-gcm is the aes128-ctr+gmac method of the reference
+// implementation: its counter block nonce|0…0|1 masks the GHASH tag and
+// the payload is encrypted from nonce|0…0|2 on, which is GCM without
+// additional data. The reference implementation has no ChaCha20 cipher,
+// chacha20-poly1305 uses the AEAD construction of RFC 8439.
+type aeadMethod struct {
+	name      string
+	keyLength int
+	aead      cipher.AEAD
+}
+
+func newChaCha20Poly1305Method(key []byte) (Method, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return &aeadMethod{"chacha20-poly1305", chacha20poly1305KeyLength, aead}, nil
+}
+
+func newAES128GCMMethod(key []byte) (Method, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &aeadMethod{"aes128-gcm", aes128gcmKeyLength, aead}, nil
+}
+
+func (m *aeadMethod) Name() string   { return m.name }
+func (m *aeadMethod) KeyLength() int { return m.keyLength }
+func (m *aeadMethod) Overhead() int  { return aeadTagSize }
+
+func (m *aeadMethod) Encrypt(dst, nonce, payload []byte) []byte {
+	sealed := m.aead.Seal(nil, m.nonce(nonce), payload, nil)
+
+	// the tag follows the ciphertext in sealed
+	n := len(sealed) - aeadTagSize
+	dst = append(dst, sealed[n:]...)
+	return append(dst, sealed[:n]...)
+}
+
+func (m *aeadMethod) Decrypt(dst, nonce, data []byte) ([]byte, error) {
+	if len(data) < aeadTagSize {
+		return nil, errPacketTooShort
+	}
+
+	// Open expects the tag after the ciphertext
+	sealed := make([]byte, 0, len(data))
+	sealed = append(sealed, data[aeadTagSize:]...)
+	sealed = append(sealed, data[:aeadTagSize]...)
+
+	out, err := m.aead.Open(dst, m.nonce(nonce), sealed, nil)
+	if err != nil {
+		return nil, errInvalidTag
+	}
+	return out, nil
+}
+
+func (m *aeadMethod) nonce(nonce []byte) []byte {
+	iv := make([]byte, m.aead.NonceSize())
+	copy(iv, nonce)
+	return iv
+}
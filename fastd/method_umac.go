@@ -0,0 +1,101 @@
+package fastd
+
+import (
+	"crypto/subtle"
+
+	"github.com/digineo/fastd/crypto/salsa2012"
+	"github.com/digineo/fastd/crypto/umac"
+)
+
+const umacTagSize = 16
+
+// umacKeyLength is the length of the session key: the Salsa20/12 key
+// followed by the UHASH key.
+var umacKeyLength = salsa2012.KeySize + umac.KeySize(umacTagSize)
+
+// umacMethod implements the salsa2012+umac and null+salsa2012+umac
+// methods. The first Salsa20/12 keystream block masks the UHASH tag of
+// the ciphertext, the remaining keystream encrypts the payload unless
+// the method is authentication only.
+type umacMethod struct {
+	encrypt bool
+	key     [salsa2012.KeySize]byte
+	hash    *umac.Hash
+}
+
+func newUMACMethod(encrypt bool) MethodBuilder {
+	return func(key []byte) (Method, error) {
+		m := &umacMethod{
+			encrypt: encrypt,
+			hash:    umac.New(key[salsa2012.KeySize:], umacTagSize),
+		}
+		copy(m.key[:], key)
+		return m, nil
+	}
+}
+
+func (m *umacMethod) Name() string {
+	if m.encrypt {
+		return "salsa2012+umac"
+	}
+	return "null+salsa2012+umac"
+}
+
+func (m *umacMethod) KeyLength() int {
+	return umacKeyLength
+}
+
+func (m *umacMethod) Overhead() int {
+	return umacTagSize
+}
+
+func (m *umacMethod) Encrypt(dst, nonce, payload []byte) []byte {
+	var iv [salsa2012.NonceSize]byte
+	copy(iv[:], expandNonce(nonce, salsa2012.NonceSize))
+
+	offset := len(dst)
+	dst = append(dst, make([]byte, umacTagSize)...)
+	dst = append(dst, payload...)
+	out := dst[offset:]
+
+	// the zeroed tag block receives the first keystream block
+	if m.encrypt {
+		salsa2012.XORKeyStream(out, out, &iv, &m.key)
+	} else {
+		salsa2012.XORKeyStream(out[:umacTagSize], out[:umacTagSize], &iv, &m.key)
+	}
+
+	tag := m.hash.Sum(make([]byte, 0, umacTagSize), out[umacTagSize:])
+	for i := range tag {
+		out[i] ^= tag[i]
+	}
+
+	return dst
+}
+
+func (m *umacMethod) Decrypt(dst, nonce, data []byte) ([]byte, error) {
+	if len(data) < umacTagSize {
+		return nil, errPacketTooShort
+	}
+
+	var iv [salsa2012.NonceSize]byte
+	copy(iv[:], expandNonce(nonce, salsa2012.NonceSize))
+
+	tag := m.hash.Sum(make([]byte, 0, umacTagSize), data[umacTagSize:])
+
+	var buf []byte
+	if m.encrypt {
+		buf = make([]byte, len(data))
+		salsa2012.XORKeyStream(buf, data, &iv, &m.key)
+	} else {
+		buf = make([]byte, umacTagSize, len(data))
+		salsa2012.XORKeyStream(buf, data[:umacTagSize], &iv, &m.key)
+		buf = append(buf, data[umacTagSize:]...)
+	}
+
+	if subtle.ConstantTimeCompare(buf[:umacTagSize], tag) != 1 {
+		return nil, errInvalidTag
+	}
+
+	return append(dst, buf[umacTagSize:]...), nil
+}
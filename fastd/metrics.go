@@ -0,0 +1,145 @@
+package fastd
+
+import (
+	"encoding/hex"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// FailureReason is the reason of a failed handshake, it is used as
+// label of the fastd_handshakes_failed_total metric.
+type FailureReason string
+
+// Reasons of failed handshakes
+const (
+	FailureMalformed      FailureReason = "malformed"
+	FailureRecipientKey   FailureReason = "recipient_key_invalid"
+	FailurePublicKey      FailureReason = "public_key_changed"
+	FailureNoHandshake    FailureReason = "no_handshake"
+	FailureMode           FailureReason = "mode_unsupported"
+	FailureProtocol       FailureReason = "protocol_unsupported"
+	FailureVerify         FailureReason = "verify_failed"
+	FailureClone          FailureReason = "cloning_failed"
+	FailureMethod         FailureReason = "method_invalid"
+	FailureSignature      FailureReason = "signature_invalid"
+	FailureMTU            FailureReason = "mtu_invalid"
+	FailureTimeout        FailureReason = "timed_out"
+	FailureSession        FailureReason = "session_failed"
+	FailureHandshakeReply FailureReason = "reply_invalid"
+	FailurePeerLimit      FailureReason = "peer_limit"
+	FailureKeyInUse       FailureReason = "key_in_use"
+	FailureAddresses      FailureReason = "addresses_unavailable"
+)
+
+// serverMetrics are the Prometheus metrics of a server
+type serverMetrics struct {
+	handshakesReceived  *prometheus.CounterVec
+	handshakesSucceeded prometheus.Counter
+	handshakesFailed    *prometheus.CounterVec
+	handshakesDropped   *prometheus.CounterVec
+	timeouts            prometheus.Counter
+
+	peers            *prometheus.Desc
+	peersEstablished *prometheus.Desc
+	rxPackets        *prometheus.Desc
+	txPackets        *prometheus.Desc
+}
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{
+		handshakesReceived: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "fastd",
+			Name:      "handshakes_received_total",
+			Help:      "Number of received handshake packets by type.",
+		}, []string{"type"}),
+		handshakesSucceeded: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "fastd",
+			Name:      "handshakes_succeeded_total",
+			Help:      "Number of finished handshakes.",
+		}),
+		handshakesFailed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "fastd",
+			Name:      "handshakes_failed_total",
+			Help:      "Number of failed handshakes by reason.",
+		}, []string{"reason"}),
+		handshakesDropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "fastd",
+			Name:      "handshakes_dropped_total",
+			Help:      "Number of handshake requests dropped by the rate limits by reason.",
+		}, []string{"reason"}),
+		timeouts: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "fastd",
+			Name:      "peer_timeouts_total",
+			Help:      "Number of peers removed after a timeout.",
+		}),
+
+		peers: prometheus.NewDesc("fastd_peers",
+			"Number of known peers.", nil, nil),
+		peersEstablished: prometheus.NewDesc("fastd_peers_established",
+			"Number of peers with an established session.", nil, nil),
+		rxPackets: prometheus.NewDesc("fastd_peer_rx_packets_total",
+			"Number of packets received from the peer.", []string{"ifname", "pubkey"}, nil),
+		txPackets: prometheus.NewDesc("fastd_peer_tx_packets_total",
+			"Number of packets sent to the peer.", []string{"ifname", "pubkey"}, nil),
+	}
+}
+
+func (m *serverMetrics) handshakeFailed(reason FailureReason) {
+	m.handshakesFailed.WithLabelValues(string(reason)).Inc()
+}
+
+// Describe implements prometheus.Collector.
+func (srv *Server) Describe(ch chan<- *prometheus.Desc) {
+	m := srv.metrics
+	m.handshakesReceived.Describe(ch)
+	m.handshakesSucceeded.Describe(ch)
+	m.handshakesFailed.Describe(ch)
+	m.handshakesDropped.Describe(ch)
+	m.timeouts.Describe(ch)
+	ch <- m.peers
+	ch <- m.peersEstablished
+	ch <- m.rxPackets
+	ch <- m.txPackets
+}
+
+// Collect implements prometheus.Collector.
+func (srv *Server) Collect(ch chan<- prometheus.Metric) {
+	m := srv.metrics
+	m.handshakesReceived.Collect(ch)
+	m.handshakesSucceeded.Collect(ch)
+	m.handshakesFailed.Collect(ch)
+	m.handshakesDropped.Collect(ch)
+	m.timeouts.Collect(ch)
+
+	// the interface names are owned by the worker
+	type ifaceInfo struct{ ifname, pubkey string }
+	var ifaces []ifaceInfo
+	var peers, established int
+
+	srv.call(func() {
+		srv.peersMtx.RLock()
+		defer srv.peersMtx.RUnlock()
+
+		peers = len(srv.peers)
+		for _, peer := range srv.peers {
+			if peer.session != nil {
+				established++
+			}
+			if peer.Ifname != "" {
+				ifaces = append(ifaces, ifaceInfo{peer.Ifname, hex.EncodeToString(peer.PublicKey)})
+			}
+		}
+	})
+
+	ch <- prometheus.MustNewConstMetric(m.peers, prometheus.GaugeValue, float64(peers))
+	ch <- prometheus.MustNewConstMetric(m.peersEstablished, prometheus.GaugeValue, float64(established))
+
+	for _, iface := range ifaces {
+		stats, err := srv.impl.Stats(iface.ifname)
+		if err != nil {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(m.rxPackets, prometheus.CounterValue, float64(stats.ipackets), iface.ifname, iface.pubkey)
+		ch <- prometheus.MustNewConstMetric(m.txPackets, prometheus.CounterValue, float64(stats.opackets), iface.ifname, iface.pubkey)
+	}
+}
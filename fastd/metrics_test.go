@@ -0,0 +1,52 @@
+package fastd
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	assert := assert.New(t)
+	tun, restore := withTestTun()
+	defer restore()
+
+	srv, session, _ := connectTestClient(t, Config{}, nil)
+	defer srv.Stop()
+	defer session.Close()
+
+	// rejected by the server
+	config := testClientConfig(srv.impl.(*UDPServer).connections[0].conn.LocalAddr().String())
+	config.PeerKey = testClientSecret.Public()
+	client, err := NewClient(config)
+	require.NoError(t, err)
+	_, err = client.Connect()
+	assert.Error(err)
+
+	m := srv.metrics
+	assert.EqualValues(2, testutil.ToFloat64(m.handshakesReceived.WithLabelValues("request")))
+	assert.EqualValues(1, testutil.ToFloat64(m.handshakesReceived.WithLabelValues("finish")))
+	assert.EqualValues(1, testutil.ToFloat64(m.handshakesSucceeded))
+	assert.EqualValues(1, testutil.ToFloat64(m.handshakesFailed.WithLabelValues(string(FailureRecipientKey))))
+
+	require.NoError(t, session.WritePacket([]byte{0x45, 0x01}))
+	receive(t, tun.toLocal)
+
+	expected := `
+# HELP fastd_peers Number of known peers.
+# TYPE fastd_peers gauge
+fastd_peers 1
+# HELP fastd_peers_established Number of peers with an established session.
+# TYPE fastd_peers_established gauge
+fastd_peers_established 1
+# HELP fastd_peer_rx_packets_total Number of packets received from the peer.
+# TYPE fastd_peer_rx_packets_total counter
+fastd_peer_rx_packets_total{ifname="fastd0",pubkey="` + hex.EncodeToString(testClientSecret.Public()) + `"} 1
+`
+	assert.NoError(testutil.CollectAndCompare(srv, strings.NewReader(expected),
+		"fastd_peers", "fastd_peers_established", "fastd_peer_rx_packets_total"))
+}
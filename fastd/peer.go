@@ -1,31 +1,54 @@
 package fastd
 
 import (
+	"bytes"
 	"net"
+	"sync/atomic"
 	"time"
 
-	"github.com/digineo/fastd/ifconfig"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
+// Errors of handshakes rejected by the limits of the config, passed to
+// the OnReject func
+var (
+	ErrPeerLimit = errors.New("maximum number of peers reached")
+	ErrKeyInUse  = errors.New("maximum number of endpoints of the key reached")
+)
+
 // AddressConfig contains the local and remote PTP address
 type AddressConfig struct {
-	LocalAddr net.IP // local PTP address
-	DestAddr  net.IP // remote PTP address
+	LocalAddr net.IP `json:"local"` // local PTP address
+	DestAddr  net.IP `json:"dest"`  // remote PTP address
 }
 
 // Peer is a fastd peer
 type Peer struct {
+	established int64       // unix time of the last finished handshake in nanoseconds, accessed atomically
+	replay      ReplayStats // packets rejected by the replay protection
+
 	Remote    Sockaddr
 	PublicKey []byte
+	Name      string     // name in the peer store
 	handshake *Handshake // handshake until it's finished
 	lastSeen  time.Time
 
-	Ifname   string
-	MTU      uint16
-	IPv4     AddressConfig
-	IPv6     AddressConfig
-	ipackets uint64 // received packet counter
+	local         Sockaddr  // our address used by the peer
+	compactHeader bool      // whether the interface uses the compact header
+	session       *Session  // current session
+	rehandshakeAt time.Time // time of the next handshake initiated by us
+	verifying     bool      // whether the verify hook is running
+	verifiedAt    time.Time // acceptance by the verify hook
+
+	Ifname        string
+	Mode          Mode
+	MTU           uint16
+	IPv4          AddressConfig
+	IPv4PrefixLen uint8 // sent to the peer if not zero
+	IPv6          AddressConfig
+	IPv6PrefixLen uint8  // sent to the peer if not zero
+	ipackets      uint64 // received packet counter
 
 	Vars []byte      // Vars that is sent to the client
 	Data interface{} // Some data that can be attached to the peer
@@ -35,6 +58,7 @@ type Peer struct {
 func NewPeer(addr Sockaddr) *Peer {
 	return &Peer{
 		Remote:   addr,
+		Mode:     ModeTUN,
 		lastSeen: time.Now(),
 	}
 }
@@ -61,47 +85,316 @@ func (srv *Server) GetPeers() []*Peer {
 	return peers
 }
 
-// GetPeer returns the peer and creates it if it does not exist yet
-func (srv *Server) getPeer(addr Sockaddr) (peer *Peer, created bool) {
+// SessionAge returns the time since the last finished handshake or
+// zero if the peer is not established.
+func (peer *Peer) SessionAge() time.Duration {
+	established := atomic.LoadInt64(&peer.established)
+	if established == 0 {
+		return 0
+	}
+	return time.Since(time.Unix(0, established))
+}
+
+// ReplayStats returns the number of data packets rejected by the replay
+// protection of the userspace implementation.
+func (peer *Peer) ReplayStats() ReplayStats {
+	return peer.replay.load()
+}
+
+// getPeer returns the peer of the remote endpoint. A handshake request
+// of a known key from another endpoint gets a pending peer, which leaves
+// the known peer untouched until the handshake is finished. Other
+// requests create a new peer, further handshake packets of unknown
+// endpoints get nil.
+func (srv *Server) getPeer(addr Sockaddr, pubkey []byte, request bool) (peer *Peer, created bool) {
 	key := string(addr.Raw())
 
 	srv.peersMtx.Lock()
 	defer srv.peersMtx.Unlock()
 
-	if peer = srv.peers[key]; peer == nil {
-		peer = NewPeer(addr)
-		created = true
-		srv.peers[key] = peer
+	if peer = srv.peers[key]; peer != nil {
+		if peer.PublicKey == nil && pubkey != nil {
+			peer.PublicKey = pubkey
+			srv.peersByKey[string(pubkey)] = peer
+		}
+		return
+	}
+
+	if pubkey != nil {
+		if known := srv.peersByKey[string(pubkey)]; known != nil {
+			return srv.pendingPeer(addr, known, request), false
+		}
+	}
+	if !request {
+		return nil, false
+	}
+
+	peer = NewPeer(addr)
+	peer.PublicKey = pubkey
+	created = true
+	srv.peers[key] = peer
+	if pubkey != nil {
+		srv.peersByKey[string(pubkey)] = peer
 	}
 	return
 }
 
+// pendingPeer returns the pending peer of the endpoint, which holds the
+// handshake of the known peer's key. A request creates it with a copy of
+// the known peer's addresses, other handshakes get nil if none exists.
+// Pending peers are owned by the worker.
+func (srv *Server) pendingPeer(addr Sockaddr, known *Peer, request bool) *Peer {
+	key := string(addr.Raw())
+	if peer := srv.pending[key]; peer != nil && bytes.Equal(peer.PublicKey, known.PublicKey) {
+		return peer
+	}
+	if !request {
+		return nil
+	}
+
+	srv.prunePending(time.Now())
+
+	peer := NewPeer(addr)
+	peer.PublicKey = known.PublicKey
+	peer.Name = known.Name
+	peer.Mode = known.Mode
+	peer.verifiedAt = known.verifiedAt
+	peer.IPv4 = known.IPv4
+	peer.IPv4PrefixLen = known.IPv4PrefixLen
+	peer.IPv6 = known.IPv6
+	peer.IPv6PrefixLen = known.IPv6PrefixLen
+	peer.Vars = known.Vars
+	srv.pending[key] = peer
+	return peer
+}
+
+// isPending reports whether the peer is a pending peer
+func (srv *Server) isPending(peer *Peer) bool {
+	return srv.pending[string(peer.Remote.Raw())] == peer
+}
+
+// attachPending moves the finished handshake of a pending peer to the
+// known peer with its key. It returns the known peer or nil if it has
+// been removed meanwhile.
+func (srv *Server) attachPending(pending *Peer) *Peer {
+	delete(srv.pending, string(pending.Remote.Raw()))
+
+	peer := srv.getPeerByKey(pending.PublicKey)
+	if peer == nil {
+		return nil
+	}
+	peer.handshake = pending.handshake
+	peer.verifiedAt = pending.verifiedAt
+	return peer
+}
+
+// prunePending drops pending peers without an unfinished handshake
+func (srv *Server) prunePending(now time.Time) {
+	for key, peer := range srv.pending {
+		if !peer.pendingHandshake(now) {
+			delete(srv.pending, key)
+		}
+	}
+}
+
+// abortHandshake forgets the peer of a rejected handshake request if
+// the request has created it
+func (srv *Server) abortHandshake(peer *Peer, created bool) {
+	if created {
+		srv.RemovePeer(peer)
+	} else if srv.isPending(peer) {
+		delete(srv.pending, string(peer.Remote.Raw()))
+	}
+}
+
+// checkPeerLimits checks a handshake against MaxPeers and
+// MaxEndpointsPerKey. It returns the failure reason and ErrPeerLimit or
+// ErrKeyInUse if the handshake has to be rejected.
+func (srv *Server) checkPeerLimits(remote Sockaddr, pubkey []byte, handshakeType HandshakeType) (FailureReason, error) {
+	srv.peersMtx.RLock()
+	defer srv.peersMtx.RUnlock()
+
+	existing := srv.peersByKey[string(pubkey)]
+
+	if max := srv.config.MaxPeers; max > 0 && len(srv.peers) >= max {
+		if srv.peers[string(remote.Raw())] == nil && existing == nil {
+			return FailurePeerLimit, ErrPeerLimit
+		}
+	}
+
+	if max := srv.config.MaxEndpointsPerKey; max > 0 && handshakeType == HandshakeRequest && existing != nil {
+		if !existing.Remote.Equal(&remote) && srv.keyEndpoints(existing, remote, time.Now()) >= max {
+			return FailureKeyInUse, ErrKeyInUse
+		}
+	}
+
+	return "", nil
+}
+
+// keyEndpoints returns the number of endpoints other than remote the key
+// of the peer is used from: the peer's one if it is established or has
+// an unfinished handshake, and those of its pending peers
+func (srv *Server) keyEndpoints(peer *Peer, remote Sockaddr, now time.Time) int {
+	n := 0
+	if peer.session != nil || peer.pendingHandshake(now) {
+		n++
+	}
+	for _, pending := range srv.pending {
+		if bytes.Equal(pending.PublicKey, peer.PublicKey) && !pending.Remote.Equal(&remote) && pending.pendingHandshake(now) {
+			n++
+		}
+	}
+	return n
+}
+
+// rejectPeer reports a handshake rejected by the limits of the config to
+// the OnReject func and the reject hook
+func (srv *Server) rejectPeer(remote Sockaddr, pubkey []byte, reason FailureReason, err error) {
+	srv.handshakeFailed(remote, pubkey, reason)
+
+	peer := NewPeer(remote)
+	peer.PublicKey = pubkey
+	if store := srv.config.Peers; store != nil {
+		peer.Name, _ = store.Lookup(pubkey)
+	}
+
+	if f := srv.config.OnReject; f != nil {
+		f(peer, err)
+	}
+	if hook := srv.config.Hooks.Reject; hook != nil {
+		srv.startHook("reject", hook, append(srv.hookEnv(peer), "REJECT_REASON="+string(reason)))
+	}
+}
+
+// getPeerByKey returns the peer with the given public key
+func (srv *Server) getPeerByKey(pubkey []byte) *Peer {
+	srv.peersMtx.RLock()
+	defer srv.peersMtx.RUnlock()
+	return srv.peersByKey[string(pubkey)]
+}
+
 // Adds a peer to the internal map without any verification
 func (srv *Server) addPeer(in *Peer) {
 	key := string(in.Remote.Raw())
 
 	peer := NewPeer(in.Remote)
 	peer.Ifname = in.Ifname
+	peer.Mode = in.Mode
 	peer.PublicKey = in.PublicKey
 	srv.peers[key] = peer
+	srv.peersByKey[string(peer.PublicKey)] = peer
 }
 
-// Calls the OnVerify hook (if exists) and sets the handshake timeout
-func (srv *Server) verifyPeer(peer *Peer) error {
-	// Call OnVerify hook
+// migratePeer moves a peer to a new remote endpoint
+func (srv *Server) migratePeer(peer *Peer, remote, local Sockaddr) error {
+	if peer.Ifname != "" {
+		if err := srv.impl.SetRemote(peer.Ifname, remote, peer.PublicKey, peer.compactHeader); err != nil {
+			return errors.Wrap(err, "unable to set remote")
+		}
+	}
+
+	log.WithFields(logrus.Fields{
+		"ifname": peer.Ifname,
+		"peer":   peer.Name,
+		"old":    peer.Remote.String(),
+		"new":    remote.String(),
+	}).Info("peer changed remote address")
+
+	previous := peer.Remote
+	srv.peersMtx.Lock()
+	delete(srv.peers, string(peer.Remote.Raw()))
+	peer.Remote = remote
+	peer.local = local
+	peer.lastSeen = time.Now()
+	srv.peers[string(remote.Raw())] = peer
+	srv.peersMtx.Unlock()
+
+	srv.emit(Event{
+		Type:      EventRoamed,
+		PublicKey: peer.PublicKey,
+		Name:      peer.Name,
+		Ifname:    peer.Ifname,
+		Remote:    remote,
+		Previous:  previous,
+	})
+	return nil
+}
+
+// Checks the peer store and verifies unknown peers with the OnVerify
+// func and the verify hook (if exist). Sets the handshake timeout on
+// success. An asynchronous verify hook returns errVerifyPending, done is
+// then called by the worker when the hook has exited.
+func (srv *Server) verifyPeer(peer *Peer, done func(error)) error {
+	if srv.isVerified(peer) {
+		srv.setHandshakeTimeout(peer)
+		return nil
+	}
+
+	hook := srv.config.Hooks.Verify
+	if srv.config.Peers != nil && srv.config.OnVerify == nil && hook == nil {
+		srv.handshakeFailed(peer.Remote, peer.PublicKey, FailureVerify)
+		return errUnknownPeer
+	}
+
+	// Call OnVerify func
 	if f := srv.config.OnVerify; f != nil {
 		if err := f(peer); err != nil {
+			srv.handshakeFailed(peer.Remote, peer.PublicKey, FailureVerify)
 			return err
 		}
 	}
 
-	// Set the handshake timeout
-	if hs := peer.handshake; hs != nil {
-		hs.timeout = time.Now().Add(time.Second * 3)
+	if hook == nil {
+		srv.setHandshakeTimeout(peer)
+		return nil
+	}
+
+	// Execute the verify hook
+	env := srv.hookEnv(peer)
+	if !hook.Async {
+		return srv.verified(peer, srv.execHook("verify", hook, env))
+	}
+
+	peer.verifying = true
+	go func() {
+		err := srv.execHook("verify", hook, env)
+		srv.call(func() {
+			peer.verifying = false
+			done(srv.verified(peer, err))
+		})
+	}()
+	return errVerifyPending
+}
+
+// isVerified reports whether the peer is known or has been accepted by
+// the verify hook recently
+func (srv *Server) isVerified(peer *Peer) bool {
+	if store := srv.config.Peers; store != nil {
+		var known bool
+		if peer.Name, known = store.Lookup(peer.PublicKey); known {
+			return true
+		}
+	}
+	return !peer.verifiedAt.IsZero() && time.Since(peer.verifiedAt) < verifyCacheTime
+}
+
+// verified records the result of the verify hook
+func (srv *Server) verified(peer *Peer, err error) error {
+	if err != nil {
+		srv.handshakeFailed(peer.Remote, peer.PublicKey, FailureVerify)
+		return err
 	}
+	peer.verifiedAt = time.Now()
+	srv.setHandshakeTimeout(peer)
 	return nil
 }
 
+func (srv *Server) setHandshakeTimeout(peer *Peer) {
+	if hs := peer.handshake; hs != nil {
+		hs.timeout = time.Now().Add(handshakeTimeout)
+	}
+}
+
 // checks the handshake timeout
 func (srv *Server) establishPeer(peer *Peer) bool {
 	hs := peer.handshake
@@ -114,16 +407,43 @@ func (srv *Server) establishPeer(peer *Peer) bool {
 // RemovePeer removes (disconnects) a peer
 func (srv *Server) RemovePeer(peer *Peer) {
 	srv.peersMtx.Lock()
-	srv.removePeerLocked(peer)
+	removed := srv.removePeerLocked(peer)
 	srv.peersMtx.Unlock()
+
+	if removed {
+		srv.releasePeer(peer)
+	}
 }
 
-// Removes a peer and its interface
-func (srv *Server) removePeerLocked(peer *Peer) {
+// Removes a peer from the maps, the caller releases it by releasePeer
+// after unlocking. Returns false if the peer has already been removed.
+func (srv *Server) removePeerLocked(peer *Peer) bool {
+	removed := false
+	if key := string(peer.Remote.Raw()); srv.peers[key] == peer {
+		delete(srv.peers, key)
+		removed = true
+	}
+	if srv.peersByKey[string(peer.PublicKey)] == peer {
+		delete(srv.peersByKey, string(peer.PublicKey))
+		removed = true
+	}
+	return removed
+}
+
+// Destroys the interface of a removed peer and releases its addresses.
+// The hooks may take a while, so the peers must not be locked.
+func (srv *Server) releasePeer(peer *Peer) {
+	if peer.session != nil {
+		srv.runHook("disestablish", srv.config.Hooks.Disestablish, peer)
+	}
 	if peer.Ifname != "" {
-		ifconfig.Destroy(peer.Ifname)
+		srv.runHook("down", srv.config.Hooks.Down, peer)
+		srv.impl.Destroy(peer.Ifname)
 	}
-	delete(srv.peers, string(peer.Remote.Raw()))
+	if f := srv.config.ReleaseAddresses; f != nil {
+		f(peer)
+	}
+	srv.emitPeer(EventRemoved, peer)
 }
 
 // Assign tunnel addresses
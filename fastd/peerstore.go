@@ -0,0 +1,58 @@
+package fastd
+
+import (
+	"errors"
+	"sync"
+)
+
+var errUnknownPeer = errors.New("unknown peer")
+
+// KnownPeer is a statically configured peer.
+type KnownPeer struct {
+	Name      string
+	PublicKey []byte
+}
+
+// PeerStore holds the known peers indexed by public key. If a server is
+// configured with a store, only known peers are accepted unless
+// OnVerify or the verify hook accepts them.
+type PeerStore struct {
+	peers map[string]string // public key → name
+	mtx   sync.RWMutex
+}
+
+// NewPeerStore returns a store with the given peers.
+func NewPeerStore(peers []KnownPeer) *PeerStore {
+	store := &PeerStore{}
+	store.Replace(peers)
+	return store
+}
+
+// Replace replaces all peers of the store. Established sessions of
+// removed peers are kept until their next handshake.
+func (store *PeerStore) Replace(peers []KnownPeer) {
+	index := make(map[string]string, len(peers))
+	for _, peer := range peers {
+		index[string(peer.PublicKey)] = peer.Name
+	}
+
+	store.mtx.Lock()
+	store.peers = index
+	store.mtx.Unlock()
+}
+
+// Lookup returns the name of the peer with the given public key.
+func (store *PeerStore) Lookup(pubkey []byte) (name string, ok bool) {
+	store.mtx.RLock()
+	defer store.mtx.RUnlock()
+
+	name, ok = store.peers[string(pubkey)]
+	return
+}
+
+// Len returns the number of known peers.
+func (store *PeerStore) Len() int {
+	store.mtx.RLock()
+	defer store.mtx.RUnlock()
+	return len(store.peers)
+}
@@ -0,0 +1,68 @@
+package fastd
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeerStore(t *testing.T) {
+	assert := assert.New(t)
+
+	store := NewPeerStore([]KnownPeer{{Name: "client", PublicKey: testClientSecret.Public()}})
+	assert.Equal(1, store.Len())
+
+	name, ok := store.Lookup(testClientSecret.Public())
+	assert.True(ok)
+	assert.Equal("client", name)
+
+	store.Replace(nil)
+	_, ok = store.Lookup(testClientSecret.Public())
+	assert.False(ok)
+	assert.Equal(0, store.Len())
+}
+
+func TestServerPeerStore(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_, restore := withTestTun()
+	defer restore()
+
+	store := NewPeerStore([]KnownPeer{{Name: "client", PublicKey: testClientSecret.Public()}})
+	verified := make(chan *Peer, 1)
+	srv, session, peer := connectTestClient(t, Config{
+		Peers: store,
+		OnVerify: func(peer *Peer) error {
+			verified <- peer
+			return errors.New("rejected")
+		},
+	}, nil)
+	defer srv.Stop()
+	defer session.Close()
+
+	// known peers are accepted without calling the hook
+	assert.Equal("client", peer.Name)
+	assert.Len(verified, 0)
+
+	// removed peers keep their session until the next handshake
+	store.Replace(nil)
+	require.NoError(session.WritePacket(nil))
+	assert.Equal(1, srv.PeersCount())
+
+	config := testClientConfig(srv.impl.(*UDPServer).connections[0].conn.LocalAddr().String())
+	config.Timeout = 100 * time.Millisecond
+	client, err := NewClient(config)
+	require.NoError(err)
+	_, err = client.Connect()
+	assert.Equal(ErrHandshakeTimeout, err)
+
+	select {
+	case peer := <-verified:
+		assert.Empty(peer.Name)
+	default:
+		t.Fatal("hook not called")
+	}
+}
@@ -0,0 +1,162 @@
+package fastd
+
+import (
+	"bytes"
+	"math"
+	"time"
+)
+
+// Reasons of dropped handshake requests, used as label of the
+// fastd_handshakes_dropped_total metric
+const (
+	dropRateLimit       = "rate_limit"
+	dropSourceRateLimit = "source_rate_limit"
+	dropPendingLimit    = "pending_limit"
+)
+
+// maxLimitedSources is the maximum number of source addresses tracked
+// by the per-source rate limit. Requests of further sources are dropped
+// until idle sources are pruned.
+const maxLimitedSources = 1 << 16
+
+// RateLimit configures a token bucket. Up to Burst requests are accepted
+// at once, the bucket refills with Rate requests per second.
+type RateLimit struct {
+	Rate  float64 // requests per second, zero disables the limit
+	Burst int     // bucket size, defaults to one
+}
+
+func (limit *RateLimit) enabled() bool {
+	return limit.Rate > 0
+}
+
+func (limit *RateLimit) burst() float64 {
+	if limit.Burst > 0 {
+		return float64(limit.Burst)
+	}
+	return 1
+}
+
+// fullAfter returns the time an empty bucket needs to refill
+func (limit *RateLimit) fullAfter() time.Duration {
+	return time.Duration(limit.burst() / limit.Rate * float64(time.Second))
+}
+
+// tokenBucket holds the tokens of a RateLimit
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(limit *RateLimit, now time.Time) *tokenBucket {
+	return &tokenBucket{tokens: limit.burst(), last: now}
+}
+
+// take refills the bucket and takes a token if available
+func (bucket *tokenBucket) take(limit *RateLimit, now time.Time) bool {
+	if elapsed := now.Sub(bucket.last); elapsed > 0 {
+		bucket.tokens = math.Min(limit.burst(), bucket.tokens+elapsed.Seconds()*limit.Rate)
+		bucket.last = now
+	}
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// handshakeLimiter limits handshake requests before any crypto is done.
+// It is owned by the worker.
+type handshakeLimiter struct {
+	global  *tokenBucket
+	sources map[string]*tokenBucket // indexed by source IP
+	pruned  time.Time
+}
+
+// allowHandshake checks the rate limits and the number of unfinished
+// handshakes for a request. It returns the reason of a dropped request.
+func (srv *Server) allowHandshake(msg *Message, pubkey []byte, now time.Time) (reason string, ok bool) {
+	limiter := &srv.limiter
+	config := &srv.config
+
+	// The source is checked first, a flooding host does not use up the
+	// tokens of others
+	if limit := &config.SourceHandshakeLimit; limit.enabled() {
+		if now.Sub(limiter.pruned) > limit.fullAfter() || len(limiter.sources) >= maxLimitedSources {
+			limiter.prune(limit, now)
+		}
+
+		key := string(msg.Src.IP.To16())
+		bucket := limiter.sources[key]
+		if bucket == nil {
+			if len(limiter.sources) >= maxLimitedSources {
+				return dropSourceRateLimit, false
+			}
+			if limiter.sources == nil {
+				limiter.sources = make(map[string]*tokenBucket)
+			}
+			bucket = newTokenBucket(limit, now)
+			limiter.sources[key] = bucket
+		}
+		if !bucket.take(limit, now) {
+			return dropSourceRateLimit, false
+		}
+	}
+
+	if limit := &config.HandshakeLimit; limit.enabled() {
+		if limiter.global == nil {
+			limiter.global = newTokenBucket(limit, now)
+		}
+		if !limiter.global.take(limit, now) {
+			return dropRateLimit, false
+		}
+	}
+
+	if max := config.MaxPendingHandshakes; max > 0 && srv.pendingHandshakes(pubkey, now) >= max {
+		return dropPendingLimit, false
+	}
+
+	return "", true
+}
+
+// prune removes the buckets of idle sources, which would be full again
+func (limiter *handshakeLimiter) prune(limit *RateLimit, now time.Time) {
+	idle := limit.fullAfter()
+	for key, bucket := range limiter.sources {
+		if now.Sub(bucket.last) >= idle {
+			delete(limiter.sources, key)
+		}
+	}
+	limiter.pruned = now
+}
+
+// pendingHandshakes returns the number of unfinished handshakes started
+// by other peers than the one with the given key
+func (srv *Server) pendingHandshakes(pubkey []byte, now time.Time) int {
+	srv.peersMtx.RLock()
+	defer srv.peersMtx.RUnlock()
+
+	n := 0
+	for key, peer := range srv.peersByKey {
+		if key != string(pubkey) && peer.pendingHandshake(now) {
+			n++
+		}
+	}
+	for _, peer := range srv.pending {
+		if !bytes.Equal(peer.PublicKey, pubkey) && peer.pendingHandshake(now) {
+			n++
+		}
+	}
+	return n
+}
+
+// pendingHandshake reports whether the peer has started a handshake that
+// is neither finished nor timed out
+func (peer *Peer) pendingHandshake(now time.Time) bool {
+	hs := peer.handshake
+	if hs == nil || hs.initiator {
+		return false
+	}
+	// the timeout is set after the verification
+	return peer.verifying || hs.timeout.After(now)
+}
@@ -0,0 +1,93 @@
+package fastd
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucket(t *testing.T) {
+	assert := assert.New(t)
+	limit := RateLimit{Rate: 2, Burst: 3}
+	now := time.Now()
+	bucket := newTokenBucket(&limit, now)
+
+	for i := 0; i < 3; i++ {
+		assert.True(bucket.take(&limit, now), i)
+	}
+	assert.False(bucket.take(&limit, now))
+
+	// refills with two tokens per second
+	now = now.Add(500 * time.Millisecond)
+	assert.True(bucket.take(&limit, now))
+	assert.False(bucket.take(&limit, now))
+
+	// up to the burst
+	now = now.Add(time.Minute)
+	for i := 0; i < 3; i++ {
+		assert.True(bucket.take(&limit, now), i)
+	}
+	assert.False(bucket.take(&limit, now))
+}
+
+func TestHandshakeRateLimit(t *testing.T) {
+	assert := assert.New(t)
+	srv := newTestServer(&testServerImpl{})
+	srv.config.SourceHandshakeLimit = RateLimit{Rate: 0.001, Burst: 2}
+	srv.config.HandshakeLimit = RateLimit{Rate: 0.001, Burst: 3}
+	dropped := srv.metrics.handshakesDropped
+
+	request := func(ip string) *Message {
+		msg := readTestmsg("null-request.dat")
+		msg.Src.IP = net.ParseIP(ip)
+		return srv.handlePacket(msg)
+	}
+
+	assert.NotNil(request("192.0.2.1"))
+	assert.NotNil(request("192.0.2.1"))
+	assert.Nil(request("192.0.2.1"))
+	assert.EqualValues(1, testutil.ToFloat64(dropped.WithLabelValues(dropSourceRateLimit)))
+
+	// other sources are limited globally
+	assert.NotNil(request("192.0.2.2"))
+	assert.Nil(request("192.0.2.3"))
+	assert.EqualValues(1, testutil.ToFloat64(dropped.WithLabelValues(dropRateLimit)))
+	assert.Len(srv.limiter.sources, 3)
+
+	// finished handshakes are not limited
+	msg := readTestmsg("null-finish.dat")
+	msg.Src.IP = net.ParseIP("192.0.2.1")
+	srv.handlePacket(msg)
+	assert.EqualValues(1, testutil.ToFloat64(dropped.WithLabelValues(dropSourceRateLimit)))
+
+	// idle sources are pruned
+	srv.limiter.prune(&srv.config.SourceHandshakeLimit, time.Now().Add(time.Hour))
+	assert.Len(srv.limiter.sources, 0)
+}
+
+func TestHandshakePendingLimit(t *testing.T) {
+	assert := assert.New(t)
+	srv := newTestServer(&testServerImpl{})
+	srv.config.MaxPendingHandshakes = 1
+
+	// another peer with an unfinished handshake
+	other := NewPeer(Sockaddr{IP: net.ParseIP("192.0.2.9"), Port: 10000})
+	other.PublicKey = testServerSecret.Public()
+	other.handshake = &Handshake{timeout: time.Now().Add(handshakeTimeout)}
+	srv.peers[string(other.Remote.Raw())] = other
+	srv.peersByKey[string(other.PublicKey)] = other
+
+	assert.Nil(srv.handlePacket(readTestmsg("null-request.dat")))
+	assert.EqualValues(1, testutil.ToFloat64(srv.metrics.handshakesDropped.WithLabelValues(dropPendingLimit)))
+	assert.Equal(1, srv.PeersCount())
+
+	// timed out handshakes are not pending
+	other.handshake.timeout = time.Now().Add(-time.Second)
+	assert.NotNil(srv.handlePacket(readTestmsg("null-request.dat")))
+
+	// repeated requests of a pending peer are accepted
+	assert.NotNil(srv.handlePacket(readTestmsg("null-request.dat")))
+}
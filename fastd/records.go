@@ -96,6 +96,27 @@ const (
 	RecordMax // RecordMax is not a field, only a const name for the number of known fields.
 )
 
+// ReferenceOrder is the order of the records in handshake messages of the
+// reference implementation. Our inofficial records follow before the
+// HMAC, which is always the last record.
+var ReferenceOrder = []TLVKey{
+	RecordHandshakeType,
+	RecordMode,
+	RecordMTU,
+	RecordVersionName,
+	RecordProtocolName,
+	RecordMethodName,
+	RecordMethodList,
+	RecordReplyCode,
+	RecordErrorDetail,
+	RecordFlags,
+	RecordSenderKey,
+	RecordRecipientKey,
+	RecordSenderHandshakeKey,
+	RecordRecipientHandshakeKey,
+	RecordAuthenticationTag,
+}
+
 // Records is an array of all possible records for a handshake packet
 type Records [RecordMax][]byte
 
@@ -0,0 +1,89 @@
+package fastd
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// replayWindowSize is the number of nonces older than the last
+	// one which are tracked
+	replayWindowSize = 64
+
+	// reorderTime is the time after the last received packet during
+	// which older packets are accepted
+	reorderTime = 10 * time.Second
+)
+
+var (
+	errDuplicatePacket = errors.New("duplicate packet")
+	errStalePacket     = errors.New("stale packet")
+)
+
+// ReplayStats counts the data packets rejected by the replay protection.
+type ReplayStats struct {
+	Duplicate uint64 // packets received before
+	Stale     uint64 // packets too old to be checked
+}
+
+// count increments the counter for a rejected packet
+func (stats *ReplayStats) count(err error) {
+	if stats == nil {
+		return
+	}
+	switch err {
+	case errDuplicatePacket:
+		atomic.AddUint64(&stats.Duplicate, 1)
+	case errStalePacket:
+		atomic.AddUint64(&stats.Stale, 1)
+	}
+}
+
+// load returns a copy of the counters
+func (stats *ReplayStats) load() ReplayStats {
+	return ReplayStats{
+		Duplicate: atomic.LoadUint64(&stats.Duplicate),
+		Stale:     atomic.LoadUint64(&stats.Stale),
+	}
+}
+
+// replayWindow tracks the nonces of received packets
+type replayWindow struct {
+	last     [nonceSize]byte // newest nonce received
+	lastTime time.Time       // time the newest nonce was received
+	seen     uint64          // bit i is set if the nonce i+1 packets older than last was received
+}
+
+// update marks the nonce as received. It returns an error if the nonce
+// has been received before or is too old.
+func (w *replayWindow) update(nonce *[nonceSize]byte, now time.Time) error {
+	age := nonceAge(&w.last, nonce)
+
+	switch {
+	case age < 0:
+		// newer packet, shift the window
+		if shift := -age; shift > replayWindowSize {
+			w.seen = 0
+		} else {
+			w.seen = w.seen<<uint(shift) | 1<<uint(shift-1)
+		}
+		w.last = *nonce
+		w.lastTime = now
+		return nil
+
+	case age == 0:
+		return errDuplicatePacket
+
+	case age > replayWindowSize || now.Sub(w.lastTime) > reorderTime:
+		return errStalePacket
+
+	default:
+		bit := uint64(1) << uint(age-1)
+		if w.seen&bit != 0 {
+			return errDuplicatePacket
+		}
+		w.seen |= bit
+		return nil
+	}
+}
@@ -0,0 +1,114 @@
+package fastd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testNonce returns the n-th nonce of the initiator
+func testNonce(n int) *[nonceSize]byte {
+	s := Session{}
+	s.sendNonce[0] = 3
+	for i := 0; i < n; i++ {
+		s.incrementNonce()
+	}
+	return &s.sendNonce
+}
+
+func TestReplayWindow(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Now()
+	w := replayWindow{}
+	w.last[0] = 1
+
+	// in order
+	assert.NoError(w.update(testNonce(0), now))
+	assert.NoError(w.update(testNonce(1), now))
+
+	// reordered
+	assert.NoError(w.update(testNonce(5), now))
+	assert.NoError(w.update(testNonce(3), now))
+	assert.NoError(w.update(testNonce(2), now))
+	assert.NoError(w.update(testNonce(4), now))
+
+	// duplicates
+	assert.Equal(errDuplicatePacket, w.update(testNonce(5), now))
+	assert.Equal(errDuplicatePacket, w.update(testNonce(3), now))
+	assert.Equal(errDuplicatePacket, w.update(testNonce(0), now))
+
+	// the window covers 64 packets
+	assert.NoError(w.update(testNonce(70), now))
+	assert.Equal(errStalePacket, w.update(testNonce(5), now))
+	assert.NoError(w.update(testNonce(6), now))
+	assert.Equal(errDuplicatePacket, w.update(testNonce(6), now))
+
+	// a large step clears the window
+	assert.NoError(w.update(testNonce(500), now))
+	assert.NoError(w.update(testNonce(499), now))
+	assert.Equal(errStalePacket, w.update(testNonce(70), now))
+
+	// older packets are only accepted shortly after the newest one
+	assert.Equal(errStalePacket, w.update(testNonce(498), now.Add(reorderTime+time.Second)))
+	assert.NoError(w.update(testNonce(501), now.Add(reorderTime+time.Second)))
+}
+
+func TestSessionReplay(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	initiator, responder := testSessions(t, "salsa2012+umac")
+	stats := ReplayStats{}
+	responder.stats = &stats
+
+	var packets [][]byte
+	for i := 0; i < 80; i++ {
+		packets = append(packets, initiator.Encrypt(nil, []byte{byte(i)}))
+	}
+
+	decrypt := func(i int) error {
+		payload, err := responder.Decrypt(nil, packets[i])
+		if err == nil {
+			require.Equal([]byte{byte(i)}, payload)
+		}
+		return err
+	}
+
+	// reordered packets
+	assert.NoError(decrypt(1))
+	assert.NoError(decrypt(0))
+	assert.NoError(decrypt(3))
+	assert.NoError(decrypt(2))
+
+	// duplicated packets
+	assert.Equal(errDuplicatePacket, decrypt(0))
+	assert.Equal(errDuplicatePacket, decrypt(3))
+
+	// stale packets
+	assert.NoError(decrypt(79))
+	assert.NoError(decrypt(15))
+	assert.Equal(errStalePacket, decrypt(10))
+
+	assert.Equal(ReplayStats{Duplicate: 2, Stale: 1}, stats.load())
+
+	// forged packets don't touch the window
+	forged := initiator.Encrypt(nil, []byte{0xff})
+	forged[len(forged)-1] ^= 1
+	_, err := responder.Decrypt(nil, forged)
+	assert.Equal(errInvalidTag, err)
+	assert.NoError(decrypt(16))
+}
+
+func TestSessionReplayNull(t *testing.T) {
+	// the null method has no nonces to check
+	initiator, responder := testSessions(t, "null")
+	pkt := initiator.Encrypt(nil, []byte{1})
+
+	for i := 0; i < 2; i++ {
+		payload, err := responder.Decrypt(nil, pkt)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{1}, payload)
+	}
+}
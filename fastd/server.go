@@ -1,23 +1,47 @@
 package fastd
 
 import (
+	"context"
 	"fmt"
+	"net"
+	"net/http"
 	"sync"
 	"time"
 
-	"github.com/digineo/fastd/ifconfig"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 )
 
 // Server is a fastd server.
 type Server struct {
-	peers    map[string]*Peer // indexed by remote endpoint
-	peersMtx sync.RWMutex
-	impl     ServerImpl
-	config   Config
-	wg       sync.WaitGroup
+	peers      map[string]*Peer // indexed by remote endpoint
+	peersByKey map[string]*Peer // indexed by public key
+	peersMtx   sync.RWMutex
+	pending    map[string]*Peer // handshakes of known keys from new endpoints, indexed by endpoint, owned by the worker
+	impl       ServerImpl
+	config     Config
+	wg         sync.WaitGroup
+	started    time.Time
+	metrics    *serverMetrics
 
-	timeoutTicker *time.Ticker
-	timeoutStop   chan struct{}
+	calls      chan func()   // functions executed by the worker
+	workerDone chan struct{} // closed when the worker has stopped
+
+	stopped  chan struct{} // closed by Stop
+	stopOnce sync.Once
+	failed   chan struct{} // closed when the transport has failed
+	failure  error
+
+	events  events
+	limiter handshakeLimiter // owned by the worker
+
+	statusListener net.Listener
+	management     *http.Server
+
+	stateStop chan struct{}
+
+	timeoutTicker     *time.Ticker
+	rehandshakeTicker *time.Ticker
 }
 
 // ServerImpl is the common interface for UDP and Kernel servers.
@@ -26,6 +50,65 @@ type ServerImpl interface {
 	Write(*Message) error // sends a message
 	Close()               // closes the server
 	Peers() []*Peer       // returns list of existing peers
+
+	Clone(remote Sockaddr, pubkey []byte, mode Mode, compactHeader bool) (string, error) // creates a tunnel interface
+	SetRemote(ifname string, remote Sockaddr, pubkey []byte, compactHeader bool) error   // changes the remote endpoint of a tunnel interface
+	Destroy(ifname string)                                                               // destroys a tunnel interface
+	Stats(ifname string) (*IfaceStats, error)                                            // returns the interface counters
+	Modes() []Mode                                                                       // returns the supported tunnel modes
+
+	Methods() []string                                // returns the supported methods in order of preference
+	SetSession(ifname string, session *Session) error // activates an established session
+
+	Errors() <-chan error // returns the channel for transport errors, a *FatalError stops the server
+}
+
+// FatalError is reported by a transport that has stopped working.
+type FatalError struct {
+	Err error
+}
+
+func (err *FatalError) Error() string {
+	return "transport failed: " + err.Err.Error()
+}
+
+// Cause returns the underlying error.
+func (err *FatalError) Cause() error {
+	return err.Err
+}
+
+// PacketError is reported by a transport for a packet that could not be
+// parsed.
+type PacketError struct {
+	Remote Sockaddr // sender of the packet, empty if unknown
+	Err    error
+}
+
+func (err *PacketError) Error() string {
+	return "malformed packet: " + err.Err.Error()
+}
+
+// Cause returns the underlying error.
+func (err *PacketError) Cause() error {
+	return err.Err
+}
+
+// Unwrap returns the underlying error.
+func (err *PacketError) Unwrap() error {
+	return err.Err
+}
+
+// sendError passes an error of a transport to the server without
+// blocking. The last slot of the channel is reserved for fatal errors,
+// malformed packets of remote hosts must not crowd them out.
+func sendError(errs chan<- error, err error) {
+	if _, fatal := err.(*FatalError); !fatal && len(errs) >= cap(errs)-1 {
+		return
+	}
+	select {
+	case errs <- err:
+	default:
+	}
 }
 
 // ServerBuilder is a func returning a server implementation. Known
@@ -54,9 +137,33 @@ func NewServer(implName string, config *Config) (srv *Server, err error) {
 	}
 
 	srv = &Server{
-		peers:  make(map[string]*Peer),
-		impl:   instance,
-		config: *config,
+		peers:      make(map[string]*Peer),
+		peersByKey: make(map[string]*Peer),
+		pending:    make(map[string]*Peer),
+		impl:       instance,
+		config:     *config,
+		started:    time.Now(),
+		metrics:    newServerMetrics(),
+		calls:      make(chan func()),
+		workerDone: make(chan struct{}),
+		stopped:    make(chan struct{}),
+		failed:     make(chan struct{}),
+	}
+
+	// Check configured methods
+	for _, method := range config.Methods {
+		if !contains(instance.Methods(), method) {
+			instance.Close()
+			return nil, fmt.Errorf("method not supported by %s implementation: %s", implName, method)
+		}
+	}
+
+	// Check configured modes
+	for _, mode := range config.Modes {
+		if !containsMode(instance.Modes(), mode) {
+			instance.Close()
+			return nil, fmt.Errorf("mode not supported by %s implementation: %v", implName, mode)
+		}
 	}
 
 	// Load existing sessions
@@ -67,37 +174,196 @@ func NewServer(implName string, config *Config) (srv *Server, err error) {
 			// session not established
 			log.WithField("ifname", peer.Ifname).
 				Info("destroying unestablished session")
-			ifconfig.Destroy(peer.Ifname)
+			instance.Destroy(peer.Ifname)
+		}
+	}
+
+	// Restore peers of the state file
+	var handshake []*Peer
+	if srv.config.StateFile != "" {
+		if handshake, err = srv.restoreState(); err != nil {
+			instance.Close()
+			return nil, err
 		}
 	}
 
-	srv.startWorker()
 	if srv.config.Timeout > 0 {
 		srv.timeoutTicker = time.NewTicker(peerCheckInterval)
-		srv.timeoutStop = make(chan struct{})
-		srv.startTimeouter()
+	}
+	if srv.config.RehandshakeInterval > 0 {
+		srv.rehandshakeTicker = time.NewTicker(rehandshakeCheckInterval)
+	}
+
+	srv.startWorker()
+	srv.startErrorHandler()
+
+	// Peers restored without session keys are asked for a handshake
+	if len(handshake) > 0 {
+		srv.call(func() {
+			for _, peer := range handshake {
+				if err := srv.startHandshake(peer); err != nil {
+					log.WithFields(logrus.Fields{
+						logrus.ErrorKey: err,
+						"remote":        peer.Remote.String(),
+					}).Error("unable to send handshake request")
+				}
+			}
+		})
+	}
+	if srv.config.StateFile != "" {
+		srv.startStateWriter()
+	}
+	if path := srv.config.StatusSocket; path != "" {
+		if err = srv.startStatusSocket(path); err != nil {
+			srv.Stop()
+			return nil, err
+		}
+	}
+	if path := srv.config.ManagementSocket; path != "" {
+		if err = srv.startManagementSocket(path); err != nil {
+			srv.Stop()
+			return nil, err
+		}
 	}
 	return
 }
 
+// Run blocks until the context is canceled, Stop is called or the
+// transport has failed. The server is stopped in all cases. Run returns
+// the *FatalError of a failed transport or nil.
+func (srv *Server) Run(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+	case <-srv.stopped:
+	case <-srv.failed:
+		srv.Stop()
+		return srv.failure
+	}
+
+	srv.Stop()
+	return nil
+}
+
 // Stop stopps all routines
 func (srv *Server) Stop() {
+	srv.stopOnce.Do(srv.stop)
+}
+
+func (srv *Server) stop() {
+	close(srv.stopped)
+	if srv.statusListener != nil {
+		srv.statusListener.Close()
+	}
+	if srv.management != nil {
+		srv.management.Close()
+	}
 	if srv.timeoutTicker != nil {
-		srv.stopTimeouter()
+		srv.timeoutTicker.Stop()
+	}
+	if srv.rehandshakeTicker != nil {
+		srv.rehandshakeTicker.Stop()
+	}
+	if srv.stateStop != nil {
+		srv.stopStateWriter()
 	}
 	srv.impl.Close()
 	srv.wg.Wait()
+	srv.closeSubscriptions()
 }
 
-// Handle incoming packets
+// Handle incoming packets and start handshakes
 func (srv *Server) startWorker() {
+	var timeout, rehandshake <-chan time.Time
+	if srv.timeoutTicker != nil {
+		timeout = srv.timeoutTicker.C
+	}
+	if srv.rehandshakeTicker != nil {
+		rehandshake = srv.rehandshakeTicker.C
+	}
+
+	srv.wg.Add(1)
+	go func() {
+		defer srv.wg.Done()
+		defer close(srv.workerDone)
+		read := srv.impl.Read()
+
+		for {
+			select {
+			case msg, ok := <-read:
+				if !ok {
+					return
+				}
+				if reply := srv.handlePacket(msg); reply != nil {
+					srv.write(reply)
+				}
+			case now := <-timeout:
+				srv.timeoutPeers(now)
+			case now := <-rehandshake:
+				srv.rehandshakePeers(now)
+			case f := <-srv.calls:
+				f()
+			}
+		}
+	}()
+}
+
+// startErrorHandler passes the errors of the transport to OnError until
+// the server is stopped
+func (srv *Server) startErrorHandler() {
+	errs := srv.impl.Errors()
+
 	srv.wg.Add(1)
 	go func() {
-		for msg := range srv.impl.Read() {
-			if reply := srv.handlePacket(msg); reply != nil {
-				srv.impl.Write(reply)
+		defer srv.wg.Done()
+
+		for {
+			select {
+			case <-srv.stopped:
+				return
+			case err := <-errs:
+				switch err := err.(type) {
+				case *FatalError:
+					srv.failure = err
+					close(srv.failed)
+					return
+				case *PacketError:
+					// sent by remote hosts, no transport failure
+					srv.handshakeFailed(err.Remote, nil, FailureMalformed)
+				default:
+					srv.reportError(err)
+				}
 			}
 		}
-		srv.wg.Done()
 	}()
 }
+
+// reportError calls the OnError callback (if exists)
+func (srv *Server) reportError(err error) {
+	if f := srv.config.OnError; f != nil {
+		f(err)
+	}
+}
+
+// write sends a handshake message and reports failures
+func (srv *Server) write(msg *Message) {
+	if err := srv.impl.Write(msg); err != nil {
+		log.WithFields(logrus.Fields{
+			logrus.ErrorKey: err,
+			"dst":           msg.Dst.String(),
+		}).Error("sending handshake failed")
+		srv.reportError(errors.Wrapf(err, "sending handshake to %v failed", msg.Dst.String()))
+	}
+}
+
+// call executes f in the worker, which owns the handshake state of the
+// peers. It returns false if the worker has stopped.
+func (srv *Server) call(f func()) bool {
+	done := make(chan struct{})
+	select {
+	case srv.calls <- func() { f(); close(done) }:
+		<-done
+		return true
+	case <-srv.workerDone:
+		return false
+	}
+}
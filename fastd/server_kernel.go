@@ -7,10 +7,12 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 	"unsafe"
 
+	"github.com/digineo/fastd/ifconfig"
 	"github.com/sirupsen/logrus"
 
 	"github.com/pkg/errors"
@@ -20,12 +22,20 @@ import (
 // DevicePath is the path to the fastd kernel device
 const DevicePath = "/dev/fastd"
 
+var errDeviceClosed = errors.New("device closed")
+
+// pollTimeout is the maximum time the reader waits for packets before
+// checking whether the server has been closed
+const pollTimeout = time.Second
+
 // KernelServer implements a fastd server using a kernel module.
 type KernelServer struct {
 	dev       *os.File      // Interface to kernel
 	recv      chan *Message // Received messages
+	errs      chan error    // transport errors
 	addresses []Sockaddr
 	cancel    chan struct{}
+	wg        sync.WaitGroup // reader goroutine
 }
 
 // NewKernelServer creates a kernel based server.
@@ -38,6 +48,7 @@ func NewKernelServer(addresses []Sockaddr) (ServerImpl, error) {
 	srv := &KernelServer{
 		dev:    dev,
 		recv:   make(chan *Message, 10),
+		errs:   make(chan error, 10),
 		cancel: make(chan struct{}),
 	}
 
@@ -56,17 +67,28 @@ func NewKernelServer(addresses []Sockaddr) (ServerImpl, error) {
 		srv.addresses = append(srv.addresses, address)
 	}
 
+	srv.wg.Add(1)
 	go func() {
+		defer srv.wg.Done()
 		for {
 			err := srv.readPackets()
-			errors.Wrap(err, "readPackets failed")
-			if err != nil {
-				select {
-				case <-srv.cancel:
-					return
-				case <-time.After(time.Second):
-					// just waiting
-				}
+			select {
+			case <-srv.cancel:
+				return
+			default:
+			}
+
+			if err == errDeviceClosed {
+				srv.reportError(&FatalError{err})
+				return
+			}
+			srv.reportError(errors.Wrap(err, "reading packets failed"))
+
+			select {
+			case <-srv.cancel:
+				return
+			case <-time.After(time.Second):
+				// just waiting
 			}
 		}
 	}()
@@ -83,12 +105,27 @@ func (srv *KernelServer) Read() chan *Message {
 	return srv.recv
 }
 
+// Errors returns the channel for transport errors.
+func (srv *KernelServer) Errors() <-chan error {
+	return srv.errs
+}
+
+// reportError passes an error to the server, it is dropped if the
+// channel is full
+func (srv *KernelServer) reportError(err error) {
+	if _, ok := err.(*PacketError); !ok {
+		log.WithError(err).Error("kernel transport failed")
+	}
+	sendError(srv.errs, err)
+}
+
 // Close closes all client connections.
 func (srv *KernelServer) Close() {
 	close(srv.cancel)
 	if srv.dev != nil {
 		srv.dev.Close()
 	}
+	srv.wg.Wait()
 	close(srv.recv)
 }
 
@@ -113,6 +150,7 @@ func (srv *KernelServer) Peers() (peers []*Peer) {
 				Ifname:    iface.Name,
 				Remote:    remote,
 				PublicKey: pubkey,
+				Mode:      ModeTUN,
 			})
 			log.WithFields(logrus.Fields{
 				"iface":  iface.Name,
@@ -124,6 +162,48 @@ func (srv *KernelServer) Peers() (peers []*Peer) {
 	return
 }
 
+// Clone creates a fastd interface in the kernel.
+func (srv *KernelServer) Clone(remote Sockaddr, pubkey []byte, mode Mode, compactHeader bool) (string, error) {
+	if mode != ModeTUN {
+		return "", fmt.Errorf("mode %v not supported by the kernel module", mode)
+	}
+	return Clone(remote, pubkey, compactHeader)
+}
+
+// SetRemote changes the remote endpoint of a fastd interface.
+func (srv *KernelServer) SetRemote(ifname string, remote Sockaddr, pubkey []byte, compactHeader bool) error {
+	return SetRemote(ifname, remote, pubkey, compactHeader)
+}
+
+// Destroy destroys a fastd interface.
+func (srv *KernelServer) Destroy(ifname string) {
+	ifconfig.Destroy(ifname)
+}
+
+// Stats returns the interface counters.
+func (srv *KernelServer) Stats(ifname string) (*IfaceStats, error) {
+	return GetStats(ifname)
+}
+
+// Modes returns the tunnel modes supported by the kernel module.
+func (srv *KernelServer) Modes() []Mode {
+	return []Mode{ModeTUN}
+}
+
+// Methods returns the methods supported by the kernel module.
+func (srv *KernelServer) Methods() []string {
+	return []string{"null"}
+}
+
+// SetSession checks the method of the session. The kernel module
+// forwards data packets as soon as the interface exists.
+func (srv *KernelServer) SetSession(ifname string, session *Session) error {
+	if session.Method() != "null" {
+		return fmt.Errorf("method %s not supported by the kernel module", session.Method())
+	}
+	return nil
+}
+
 func (srv *KernelServer) readPackets() error {
 	buf := make([]byte, 1500)
 
@@ -140,10 +220,11 @@ func (srv *KernelServer) readPackets() error {
 			data := make([]byte, n)
 			copy(data, buf[:n])
 			if err = srv.read(data); err != nil {
-				log.Errorf("%v", err)
+				log.WithError(err).Debug("malformed packet")
+				srv.reportError(&PacketError{Err: err})
 			}
 		case io.EOF:
-			num, e := unix.Poll(pollFds, 60*1000)
+			num, e := unix.Poll(pollFds, int(pollTimeout/time.Millisecond))
 
 			if e != nil {
 				// Temp error, like interrupted system call (EINTR)?
@@ -155,10 +236,18 @@ func (srv *KernelServer) readPackets() error {
 				return errors.Wrap(e, "poll failed")
 			}
 
-			// num == 0 means timeout, can be ignored here
+			// num == 0 means timeout, closing the device does not
+			// interrupt the poll
+			if num == 0 {
+				select {
+				case <-srv.cancel:
+					return errDeviceClosed
+				default:
+				}
+			}
 			if num > 0 && pollFds[0].Revents&unix.POLLHUP != 0 {
 				// disconnected
-				return fmt.Errorf("device closed")
+				return errDeviceClosed
 			}
 		default:
 			return err
@@ -168,22 +257,23 @@ func (srv *KernelServer) readPackets() error {
 }
 
 func (srv *KernelServer) read(buf []byte) error {
-	// check size
-	if len(buf) < 40 {
-		return fmt.Errorf("packet too small (%d bytes)", len(buf))
-	}
-
 	msg, err := ParseMessage(buf, true)
 	if err != nil {
-		return errors.Wrap(err, "unmarshal failed")
+		return err
 	}
 
-	srv.recv <- msg
+	select {
+	case srv.recv <- msg:
+	case <-srv.cancel:
+	}
 	return nil
 }
 
 func (srv *KernelServer) Write(msg *Message) error {
-	bytes := msg.Marshal(true)
-	_, err := srv.dev.Write(bytes)
+	bytes, err := msg.Marshal(true)
+	if err != nil {
+		return err
+	}
+	_, err = srv.dev.Write(bytes)
 	return err
 }
@@ -2,15 +2,38 @@ package fastd
 
 import (
 	"fmt"
+	"io"
 	"net"
 	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Types of data packets using the compact header extension. The higher
+// nibble of the packet type equals the IP version of the payload.
+const (
+	typeIPv4Packet = 0x40
+	typeIPv6Packet = 0x60
 )
 
-// UDPServer is a userspace stub of the fastd server
+// maxPacketSize is the size of the receive buffers
+const maxPacketSize = 65535
+
+// UDPServer is a userspace implementation of the fastd server. It
+// creates a TUN device for every peer and forwards the data packets
+// between the UDP socket and the tunnel.
 type UDPServer struct {
 	connections []UDPConn
 	recv        chan *Message // Received messages
+	errs        chan error    // transport errors
+	closed      chan struct{} // closed by Close
 	wg          sync.WaitGroup
+
+	tunnels    map[string]*udpTunnel // indexed by interface name
+	remotes    map[string]*udpTunnel // indexed by remote endpoint
+	tunnelsMtx sync.RWMutex
 }
 
 // UDPConn holds an active client connection
@@ -19,10 +42,41 @@ type UDPConn struct {
 	conn *net.UDPConn
 }
 
+var errNoSession = errors.New("session not established")
+
+// tunDevice is a network device used by the userspace data path.
+type tunDevice interface {
+	io.ReadWriteCloser
+
+	// Name returns the interface name.
+	Name() string
+}
+
+// udpTunnel connects a tunnel device with a remote endpoint
+type udpTunnel struct {
+	srv           *UDPServer
+	dev           tunDevice
+	compactHeader bool
+
+	remote     Sockaddr // changed when the peer roams
+	session    *Session // nil until the handshake is finished
+	previous   *Session // replaced session, valid until it expires
+	sessionMtx sync.RWMutex
+
+	ipackets uint64 // received packet counter
+	opackets uint64 // sent packet counter
+	ibytes   uint64 // received payload bytes
+	obytes   uint64 // sent payload bytes
+}
+
 // NewUDPServer creates a new UDP based server
 func NewUDPServer(addresses []Sockaddr) (ServerImpl, error) {
 	srv := &UDPServer{
-		recv: make(chan *Message, 10),
+		recv:    make(chan *Message, 10),
+		errs:    make(chan error, 10),
+		closed:  make(chan struct{}),
+		tunnels: make(map[string]*udpTunnel),
+		remotes: make(map[string]*udpTunnel),
 	}
 
 	for _, sa := range addresses {
@@ -40,7 +94,11 @@ func NewUDPServer(addresses []Sockaddr) (ServerImpl, error) {
 		}
 		udpconn := UDPConn{sa, conn}
 		srv.connections = append(srv.connections, udpconn)
-		go srv.readPackets(&udpconn)
+	}
+
+	for i := range srv.connections {
+		srv.wg.Add(1)
+		go srv.readPackets(&srv.connections[i])
 	}
 
 	return srv, nil
@@ -50,43 +108,200 @@ func (srv *UDPServer) Read() chan *Message {
 	return srv.recv
 }
 
-// Close closes all client connections.
+// Errors returns the channel for transport errors.
+func (srv *UDPServer) Errors() <-chan error {
+	return srv.errs
+}
+
+// reportError passes an error to the server, it is dropped if the
+// channel is full
+func (srv *UDPServer) reportError(err error) {
+	sendError(srv.errs, err)
+}
+
+// Close closes all client connections and tunnels.
 func (srv *UDPServer) Close() {
+	close(srv.closed)
 	for _, udpconn := range srv.connections {
 		udpconn.conn.Close()
 	}
+	srv.wg.Wait()
+
+	srv.tunnelsMtx.Lock()
+	for _, tun := range srv.tunnels {
+		tun.dev.Close()
+	}
+	srv.tunnels = make(map[string]*udpTunnel)
+	srv.remotes = make(map[string]*udpTunnel)
+	srv.tunnelsMtx.Unlock()
+
 	close(srv.recv)
 }
 
-// Peers returns a list of connected peers. This is stubbed and will
-// always return an empty list.
+// Peers returns a list of connected peers. Tunnels do not outlive the
+// process, so this will always return an empty list.
 func (srv *UDPServer) Peers() []*Peer {
 	return nil
 }
 
+// Clone creates a TUN or TAP device for the given remote.
+func (srv *UDPServer) Clone(remote Sockaddr, pubkey []byte, mode Mode, compactHeader bool) (string, error) {
+	dev, err := newTunDevice("fastd", mode)
+	if err != nil {
+		return "", err
+	}
+
+	tun := &udpTunnel{
+		srv:           srv,
+		dev:           dev,
+		remote:        remote,
+		compactHeader: compactHeader,
+	}
+
+	srv.tunnelsMtx.Lock()
+	srv.tunnels[dev.Name()] = tun
+	srv.remotes[string(remote.Raw())] = tun
+	srv.tunnelsMtx.Unlock()
+
+	go tun.readPackets()
+
+	return dev.Name(), nil
+}
+
+// SetRemote changes the remote endpoint of a tunnel.
+func (srv *UDPServer) SetRemote(ifname string, remote Sockaddr, pubkey []byte, compactHeader bool) error {
+	srv.tunnelsMtx.Lock()
+	defer srv.tunnelsMtx.Unlock()
+
+	tun := srv.tunnels[ifname]
+	if tun == nil {
+		return fmt.Errorf("tunnel %s not found", ifname)
+	}
+
+	delete(srv.remotes, string(tun.remote.Raw()))
+	srv.remotes[string(remote.Raw())] = tun
+
+	tun.sessionMtx.Lock()
+	tun.remote = remote
+	tun.sessionMtx.Unlock()
+
+	return nil
+}
+
+// Destroy closes the tunnel device.
+func (srv *UDPServer) Destroy(ifname string) {
+	srv.tunnelsMtx.Lock()
+	tun := srv.tunnels[ifname]
+	if tun != nil {
+		delete(srv.tunnels, ifname)
+		delete(srv.remotes, string(tun.remote.Raw()))
+	}
+	srv.tunnelsMtx.Unlock()
+
+	if tun != nil {
+		tun.dev.Close()
+	}
+}
+
+// Stats returns the packet counters of a tunnel.
+func (srv *UDPServer) Stats(ifname string) (*IfaceStats, error) {
+	srv.tunnelsMtx.RLock()
+	tun := srv.tunnels[ifname]
+	srv.tunnelsMtx.RUnlock()
+
+	if tun == nil {
+		return nil, fmt.Errorf("tunnel %s not found", ifname)
+	}
+
+	return &IfaceStats{
+		ipackets: atomic.LoadUint64(&tun.ipackets),
+		opackets: atomic.LoadUint64(&tun.opackets),
+		ibytes:   atomic.LoadUint64(&tun.ibytes),
+		obytes:   atomic.LoadUint64(&tun.obytes),
+	}, nil
+}
+
+// Modes returns the supported tunnel modes.
+func (srv *UDPServer) Modes() []Mode {
+	return []Mode{ModeTUN, ModeTAP}
+}
+
+// Methods returns all registered methods.
+func (srv *UDPServer) Methods() []string {
+	return MethodNames()
+}
+
+// SetSession activates the session of a tunnel. Data packets are
+// dropped until a session is set. The replaced session is still used to
+// decrypt packets until it expires.
+func (srv *UDPServer) SetSession(ifname string, session *Session) error {
+	srv.tunnelsMtx.RLock()
+	tun := srv.tunnels[ifname]
+	srv.tunnelsMtx.RUnlock()
+
+	if tun == nil {
+		return fmt.Errorf("tunnel %s not found", ifname)
+	}
+
+	tun.sessionMtx.Lock()
+	tun.previous = tun.session
+	tun.session = session
+	tun.sessionMtx.Unlock()
+
+	return nil
+}
+
 func (srv *UDPServer) readPackets(udpconn *UDPConn) {
-	buf := make([]byte, 1500)
+	buf := make([]byte, maxPacketSize)
+	payload := make([]byte, 0, maxPacketSize)
 
 	for {
 		n, src, err := udpconn.conn.ReadFromUDP(buf)
 		if err != nil {
-			fmt.Println("Error reading from UDP:", err)
+			srv.readFailed(udpconn, err)
 			break
 		}
-		data := make([]byte, n)
-		copy(data, buf[:n])
-		srv.read(data, udpconn.addr, src)
+		if n == 0 {
+			continue
+		}
+
+		switch typ := buf[0]; {
+		case typ == byte(TypeData), typ&0xf0 == typeIPv4Packet, typ&0xf0 == typeIPv6Packet:
+			// data packets are forwarded directly, no need to copy them
+			srv.readData(buf[:n], payload, src)
+		default:
+			data := make([]byte, n)
+			copy(data, buf[:n])
+			if err := srv.read(data, udpconn.addr, src); err != nil {
+				remote := Sockaddr{IP: src.IP, Port: uint16(src.Port)}
+				log.WithFields(logrus.Fields{
+					logrus.ErrorKey: err,
+					"src":           remote.String(),
+				}).Debug("malformed packet")
+				srv.reportError(&PacketError{Remote: remote, Err: err})
+			}
+		}
 	}
 
 	srv.wg.Done()
 }
 
-func (srv *UDPServer) read(buf []byte, dst Sockaddr, src *net.UDPAddr) error {
-	// check size
-	if len(buf) < 4 {
-		return fmt.Errorf("packet too small (%d bytes)", len(buf))
+// readFailed reports a read error unless the connection has been closed
+func (srv *UDPServer) readFailed(udpconn *UDPConn, err error) {
+	select {
+	case <-srv.closed:
+		return
+	default:
 	}
 
+	log.WithFields(logrus.Fields{
+		logrus.ErrorKey: err,
+		"bind":          udpconn.addr.String(),
+	}).Error("reading from UDP failed")
+	srv.reportError(&FatalError{errors.Wrapf(err, "reading from %v failed", udpconn.addr.String())})
+}
+
+func (srv *UDPServer) read(buf []byte, dst Sockaddr, src *net.UDPAddr) error {
 	msg, err := ParseMessage(buf, false)
 	if err != nil {
 		return err
@@ -101,6 +316,22 @@ func (srv *UDPServer) read(buf []byte, dst Sockaddr, src *net.UDPAddr) error {
 	return nil
 }
 
+// readData passes a data packet to the tunnel of the sender
+func (srv *UDPServer) readData(buf, payload []byte, src *net.UDPAddr) {
+	remote := Sockaddr{IP: src.IP, Port: uint16(src.Port)}
+
+	srv.tunnelsMtx.RLock()
+	tun := srv.remotes[string(remote.Raw())]
+	srv.tunnelsMtx.RUnlock()
+
+	if tun == nil {
+		log.WithField("src", remote.String()).Debug("data packet from unknown peer")
+		return
+	}
+
+	tun.receive(buf, payload)
+}
+
 // Find the corresponding
 func (srv *UDPServer) findConn(addr Sockaddr) *net.UDPConn {
 	for _, udpconn := range srv.connections {
@@ -118,11 +349,152 @@ func (srv *UDPServer) Write(msg *Message) error {
 		return fmt.Errorf("no local connection with address %v", msg.Src)
 	}
 
-	bytes := msg.Marshal(false)
+	bytes, err := msg.Marshal(false)
+	if err != nil {
+		return err
+	}
 	addr := net.UDPAddr{
 		Port: int(msg.Dst.Port),
 		IP:   msg.Dst.IP,
 	}
-	_, err := conn.WriteToUDP(bytes, &addr)
+	_, err = conn.WriteToUDP(bytes, &addr)
 	return err
 }
+
+// writeData sends a data packet to the given remote
+func (srv *UDPServer) writeData(remote Sockaddr, buf []byte) error {
+	conn := srv.findConn(remote)
+	if conn == nil {
+		return fmt.Errorf("no local connection for %v", remote.String())
+	}
+
+	addr := net.UDPAddr{
+		Port: int(remote.Port),
+		IP:   remote.IP,
+	}
+	_, err := conn.WriteToUDP(buf, &addr)
+	return err
+}
+
+func (tun *udpTunnel) getSession() *Session {
+	tun.sessionMtx.RLock()
+	defer tun.sessionMtx.RUnlock()
+	return tun.session
+}
+
+// decrypt decrypts a data packet with the current or the previous session
+func (tun *udpTunnel) decrypt(dst, data []byte) ([]byte, error) {
+	tun.sessionMtx.RLock()
+	session, previous := tun.session, tun.previous
+	tun.sessionMtx.RUnlock()
+
+	payload, err := session.Decrypt(dst, data)
+	if err != nil && previous != nil {
+		if payload, err2 := previous.Decrypt(dst, data); err2 == nil {
+			return payload, nil
+		}
+	}
+	return payload, err
+}
+
+// receive decrypts a data packet and writes it into the tunnel device.
+// The payload buffer is used for the decrypted packet.
+func (tun *udpTunnel) receive(buf, payload []byte) {
+	session := tun.getSession()
+	if session == nil {
+		return
+	}
+
+	var err error
+	if buf[0] != byte(TypeData) {
+		// compact header, only used without encryption
+		if !tun.compactHeader || !session.isNull() {
+			return
+		}
+		payload = buf
+	} else if payload, err = tun.decrypt(payload[:0], buf[1:]); err != nil {
+		log.WithFields(logrus.Fields{
+			logrus.ErrorKey: err,
+			"ifname":        tun.dev.Name(),
+		}).Debug("dropping data packet")
+		return
+	}
+
+	atomic.AddUint64(&tun.ipackets, 1)
+	atomic.AddUint64(&tun.ibytes, uint64(len(payload)))
+
+	if len(payload) == 0 {
+		// Keepalive packet
+		if err := tun.send(nil, nil); err != nil {
+			log.WithFields(logrus.Fields{
+				logrus.ErrorKey: err,
+				"ifname":        tun.dev.Name(),
+			}).Debug("keepalive response failed")
+		}
+		return
+	}
+
+	if _, err := tun.dev.Write(payload); err != nil {
+		log.WithFields(logrus.Fields{
+			logrus.ErrorKey: err,
+			"ifname":        tun.dev.Name(),
+		}).Error("writing to tunnel failed")
+		tun.srv.reportError(errors.Wrapf(err, "writing to %s failed", tun.dev.Name()))
+	}
+}
+
+// send encrypts the payload and sends the packet to the remote. The
+// out buffer is used for the encrypted packet.
+func (tun *udpTunnel) send(out, payload []byte) error {
+	tun.sessionMtx.RLock()
+	session, remote := tun.session, tun.remote
+	tun.sessionMtx.RUnlock()
+
+	if session == nil {
+		return errNoSession
+	}
+
+	var pkt []byte
+	if tun.compactHeader && session.isNull() && len(payload) > 0 {
+		pkt = payload
+	} else {
+		pkt = session.Encrypt(append(out[:0], byte(TypeData)), payload)
+	}
+
+	if err := tun.srv.writeData(remote, pkt); err != nil {
+		return err
+	}
+
+	atomic.AddUint64(&tun.opackets, 1)
+	atomic.AddUint64(&tun.obytes, uint64(len(payload)))
+	return nil
+}
+
+// readPackets forwards packets from the tunnel device to the remote
+// until the device is closed.
+func (tun *udpTunnel) readPackets() {
+	buf := make([]byte, maxPacketSize)
+	out := make([]byte, 0, maxPacketSize)
+
+	for {
+		n, err := tun.dev.Read(buf)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				logrus.ErrorKey: err,
+				"ifname":        tun.dev.Name(),
+			}).Debug("tunnel closed")
+			return
+		}
+		if n == 0 {
+			continue
+		}
+
+		if err := tun.send(out, buf[:n]); err != nil && err != errNoSession {
+			log.WithFields(logrus.Fields{
+				logrus.ErrorKey: err,
+				"ifname":        tun.dev.Name(),
+			}).Error("sending data packet failed")
+			tun.srv.reportError(errors.Wrapf(err, "sending data packet of %s failed", tun.dev.Name()))
+		}
+	}
+}
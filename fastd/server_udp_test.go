@@ -0,0 +1,227 @@
+package fastd
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testTun is an in-memory tunnel device
+type testTun struct {
+	name     string
+	mode     Mode        // mode requested from newTunDevice
+	toRemote chan []byte // packets to be read by the server
+	toLocal  chan []byte // packets written by the server
+	closed   chan struct{}
+	once     sync.Once
+}
+
+func newTestTun(name string) *testTun {
+	return &testTun{
+		name:     name,
+		toRemote: make(chan []byte, 10),
+		toLocal:  make(chan []byte, 10),
+		closed:   make(chan struct{}),
+	}
+}
+
+func (tun *testTun) Name() string { return tun.name }
+
+func (tun *testTun) Read(p []byte) (int, error) {
+	select {
+	case pkt := <-tun.toRemote:
+		return copy(p, pkt), nil
+	case <-tun.closed:
+		return 0, errors.New("closed")
+	}
+}
+
+func (tun *testTun) Write(p []byte) (int, error) {
+	pkt := make([]byte, len(p))
+	copy(pkt, p)
+	tun.toLocal <- pkt
+	return len(p), nil
+}
+
+func (tun *testTun) Close() error {
+	tun.once.Do(func() { close(tun.closed) })
+	return nil
+}
+
+// withTestTun replaces newTunDevice and returns a function to restore it
+func withTestTun() (*testTun, func()) {
+	tun := newTestTun("fastd0")
+	orig := newTunDevice
+	newTunDevice = func(_ string, mode Mode) (tunDevice, error) {
+		tun.mode = mode
+		return tun, nil
+	}
+	return tun, func() { newTunDevice = orig }
+}
+
+func readUDP(t *testing.T, conn *net.UDPConn) []byte {
+	buf := make([]byte, 1500)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	return buf[:n]
+}
+
+func receive(t *testing.T, ch chan []byte) []byte {
+	select {
+	case pkt := <-ch:
+		return pkt
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+	return nil
+}
+
+func TestUDPServerData(t *testing.T) {
+	assert := assert.New(t)
+	tun, restore := withTestTun()
+	defer restore()
+
+	impl, err := NewUDPServer([]Sockaddr{{IP: net.ParseIP("127.0.0.1")}})
+	require.NoError(t, err)
+	defer impl.Close()
+	srv := impl.(*UDPServer)
+
+	client, err := net.DialUDP("udp", nil, srv.connections[0].conn.LocalAddr().(*net.UDPAddr))
+	require.NoError(t, err)
+	defer client.Close()
+
+	local := client.LocalAddr().(*net.UDPAddr)
+	ifname, err := srv.Clone(Sockaddr{IP: local.IP, Port: uint16(local.Port)}, nil, ModeTUN, false)
+	require.NoError(t, err)
+	assert.Equal("fastd0", ifname)
+	require.NoError(t, srv.SetSession(ifname, &Session{method: nullMethod{}}))
+
+	// remote → tunnel
+	client.Write([]byte{byte(TypeData), 0x45, 0x01, 0x02})
+	assert.Equal([]byte{0x45, 0x01, 0x02}, receive(t, tun.toLocal))
+
+	// tunnel → remote
+	tun.toRemote <- []byte{0x60, 0x03}
+	assert.Equal([]byte{byte(TypeData), 0x60, 0x03}, readUDP(t, client))
+
+	// keepalive
+	client.Write([]byte{byte(TypeData)})
+	assert.Equal([]byte{byte(TypeData)}, readUDP(t, client))
+
+	stats, err := srv.Stats(ifname)
+	require.NoError(t, err)
+	assert.EqualValues(2, stats.ipackets)
+	assert.EqualValues(2, stats.opackets)
+
+	srv.Destroy(ifname)
+	_, err = srv.Stats(ifname)
+	assert.Error(err)
+}
+
+func TestUDPServerCompactHeader(t *testing.T) {
+	assert := assert.New(t)
+	tun, restore := withTestTun()
+	defer restore()
+
+	impl, err := NewUDPServer([]Sockaddr{{IP: net.ParseIP("127.0.0.1")}})
+	require.NoError(t, err)
+	defer impl.Close()
+	srv := impl.(*UDPServer)
+
+	client, err := net.DialUDP("udp", nil, srv.connections[0].conn.LocalAddr().(*net.UDPAddr))
+	require.NoError(t, err)
+	defer client.Close()
+
+	local := client.LocalAddr().(*net.UDPAddr)
+	ifname, err := srv.Clone(Sockaddr{IP: local.IP, Port: uint16(local.Port)}, nil, ModeTUN, true)
+	require.NoError(t, err)
+	require.NoError(t, srv.SetSession(ifname, &Session{method: nullMethod{}}))
+
+	client.Write([]byte{0x45, 0x01})
+	assert.Equal([]byte{0x45, 0x01}, receive(t, tun.toLocal))
+
+	tun.toRemote <- []byte{0x60, 0x03}
+	assert.Equal([]byte{0x60, 0x03}, readUDP(t, client))
+}
+
+func TestServerRun(t *testing.T) {
+	assert := assert.New(t)
+
+	// canceled context
+	srv, _ := startTestServer(t, Config{})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.NoError(srv.Run(ctx))
+	srv.Stop()
+
+	// non-fatal errors are passed to OnError
+	errs := make(chan error, 1)
+	srv, _ = startTestServer(t, Config{
+		OnError: func(err error) { errs <- err },
+	})
+	impl := srv.impl.(*UDPServer)
+	impl.reportError(errors.New("foo"))
+	select {
+	case err := <-errs:
+		assert.EqualError(err, "foo")
+	case <-time.After(time.Second):
+		t.Fatal("OnError not called")
+	}
+
+	// a failed transport stops the server
+	impl.connections[0].conn.Close()
+	err := srv.Run(context.Background())
+	if assert.IsType(&FatalError{}, err) {
+		assert.Contains(err.Error(), "transport failed: reading from 127.0.0.1:0 failed")
+	}
+}
+
+func TestUDPServerMalformed(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var errs []error
+	srv, remote := startTestServer(t, Config{OnError: func(err error) {
+		errs = append(errs, err)
+	}})
+	defer srv.Stop()
+	sub := srv.Subscribe()
+
+	conn, err := net.Dial("udp", remote)
+	require.NoError(err)
+	defer conn.Close()
+
+	// the length does not match
+	_, err = conn.Write([]byte{byte(TypeHandshake), 0, 0, 5})
+	require.NoError(err)
+
+	event := nextEvent(t, sub)
+	assert.Equal(EventHandshakeFailed, event.Type)
+	assert.Equal(FailureMalformed, event.Reason)
+	assert.Equal(conn.LocalAddr().String(), event.Remote.String())
+	assert.EqualValues(1, testutil.ToFloat64(srv.metrics.handshakesFailed.WithLabelValues(string(FailureMalformed))))
+
+	srv.Stop()
+	assert.Empty(errs)
+}
+
+func TestSendError(t *testing.T) {
+	assert := assert.New(t)
+	errs := make(chan error, 2)
+
+	sendError(errs, &PacketError{Err: ErrPacketTooShort})
+	sendError(errs, &PacketError{Err: ErrPacketTooShort})
+	assert.Len(errs, 1)
+
+	// the last slot is left for fatal errors
+	sendError(errs, &FatalError{errDeviceClosed})
+	assert.Len(errs, 2)
+}
@@ -0,0 +1,178 @@
+package fastd
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// nonceSize is the size of the nonce in the common method header
+	nonceSize = 6
+
+	// headerSize is the size of the common method header: the nonce,
+	// a flags byte and a reserved byte
+	headerSize = nonceSize + 2
+)
+
+var (
+	errPacketTooShort = errors.New("packet too short")
+	errInvalidNonce   = errors.New("invalid nonce")
+	errInvalidTag     = errors.New("authentication failed")
+	errSessionExpired = errors.New("session expired")
+)
+
+// Session is an established session between two peers. It encrypts and
+// decrypts the payload of data packets with the negotiated method.
+type Session struct {
+	method    Method
+	key       []byte // method key, kept for state snapshots
+	sendNonce [nonceSize]byte
+	replay    replayWindow
+	stats     *ReplayStats // counters for rejected packets, optional
+	expires   time.Time    // set when the session has been replaced
+	mtx       sync.Mutex
+}
+
+// NewSession creates a session for the given method name. The session
+// key is derived from the handshake.
+func (hs *Handshake) NewSession(method string) (*Session, error) {
+	var key []byte
+	m, err := newMethod(method, func(length int) []byte {
+		key = hs.methodKey(method, length)
+		return key
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	session := &Session{method: m, key: key}
+
+	// The initiator uses odd nonces, the responder even ones.
+	if hs.initiator {
+		session.sendNonce[0] = 3
+	} else {
+		session.sendNonce[0] = 2
+		session.replay.last[0] = 1
+	}
+
+	return session, nil
+}
+
+// Method returns the name of the negotiated method.
+func (s *Session) Method() string {
+	return s.method.Name()
+}
+
+// isNull reports whether the session uses the null method, which
+// sends the payload without a method header.
+func (s *Session) isNull() bool {
+	_, ok := s.method.(nullMethod)
+	return ok
+}
+
+// Overhead returns the number of bytes added to every payload.
+func (s *Session) Overhead() int {
+	if s.isNull() {
+		return 0
+	}
+	return headerSize + s.method.Overhead()
+}
+
+// Encrypt appends the encrypted payload including the method header to
+// dst and returns the resulting slice.
+func (s *Session) Encrypt(dst, payload []byte) []byte {
+	if s.isNull() {
+		return append(dst, payload...)
+	}
+
+	s.mtx.Lock()
+	nonce := s.sendNonce
+	s.incrementNonce()
+	s.mtx.Unlock()
+
+	dst = append(dst, nonce[:]...)
+	dst = append(dst, 0, 0) // flags and reserved byte
+	return s.method.Encrypt(dst, nonce[:], payload)
+}
+
+// Decrypt verifies and decrypts the data and appends the payload to
+// dst. It returns the resulting slice.
+func (s *Session) Decrypt(dst, data []byte) ([]byte, error) {
+	if s.isNull() {
+		return append(dst, data...), nil
+	}
+
+	if len(data) < headerSize+s.method.Overhead() {
+		return nil, errPacketTooShort
+	}
+
+	var nonce [nonceSize]byte
+	copy(nonce[:], data)
+
+	s.mtx.Lock()
+	valid := nonce[0]&1 == s.replay.last[0]&1
+	expired := !s.expires.IsZero() && time.Now().After(s.expires)
+	s.mtx.Unlock()
+	if expired {
+		return nil, errSessionExpired
+	}
+	if !valid {
+		return nil, errInvalidNonce
+	}
+
+	out, err := s.method.Decrypt(dst, nonce[:], data[headerSize:])
+	if err != nil {
+		return nil, err
+	}
+
+	// only authenticated packets may update the replay window
+	s.mtx.Lock()
+	err = s.replay.update(&nonce, time.Now())
+	s.mtx.Unlock()
+	if err != nil {
+		s.stats.count(err)
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// expireAt limits the validity of a replaced session
+func (s *Session) expireAt(t time.Time) {
+	s.mtx.Lock()
+	s.expires = t
+	s.mtx.Unlock()
+}
+
+// incrementNonce skips to the next nonce of our parity
+func (s *Session) incrementNonce() {
+	s.sendNonce[0] += 2
+
+	if s.sendNonce[0] == 0 || s.sendNonce[0] == 1 {
+		for i := 1; i < nonceSize; i++ {
+			s.sendNonce[i]++
+			if s.sendNonce[i] != 0 {
+				break
+			}
+		}
+	}
+}
+
+// nonceAge returns the number of packets the nonce is behind the last
+// received one. Negative values mean the nonce is newer.
+func nonceAge(last, nonce *[nonceSize]byte) int64 {
+	var age int64
+	for i := nonceSize - 1; i >= 0; i-- {
+		age = age*256 + int64(last[i]) - int64(nonce[i])
+	}
+	return age / 2
+}
+
+// expandNonce expands the nonce to the IV size of a cipher
+func expandNonce(nonce []byte, size int) []byte {
+	iv := make([]byte, size)
+	copy(iv, nonce)
+	iv[size-1] = 1
+	return iv
+}
@@ -0,0 +1,249 @@
+package fastd
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/chacha20"
+)
+
+// testSessions returns the sessions of both sides of a handshake
+func testSessions(t *testing.T, method string) (initiator, responder *Session) {
+	hs := Handshake{
+		prk:     extractKey([]byte("sigma")),
+		keyInfo: []byte("info"),
+	}
+
+	responder, err := hs.NewSession(method)
+	require.NoError(t, err)
+
+	hs.initiator = true
+	initiator, err = hs.NewSession(method)
+	require.NoError(t, err)
+
+	return
+}
+
+func TestSessionUnsupported(t *testing.T) {
+	_, err := (&Handshake{}).NewSession("aes128-ctr+foo")
+	assert.EqualError(t, err, "unsupported method: aes128-ctr+foo")
+}
+
+func TestSessionNull(t *testing.T) {
+	assert := assert.New(t)
+	initiator, responder := testSessions(t, "null")
+
+	assert.Equal(0, initiator.Overhead())
+	assert.Equal([]byte{1, 2, 3}, initiator.Encrypt(nil, []byte{1, 2, 3}))
+
+	payload, err := responder.Decrypt(nil, []byte{1, 2, 3})
+	assert.NoError(err)
+	assert.Equal([]byte{1, 2, 3}, payload)
+}
+
+func TestSessionMethods(t *testing.T) {
+	for _, method := range MethodNames() {
+		if method == "null" {
+			continue
+		}
+		t.Run(method, func(t *testing.T) {
+			testSessionMethod(t, method)
+		})
+	}
+}
+
+func testSessionMethod(t *testing.T, method string) {
+	assert := assert.New(t)
+	require := require.New(t)
+	initiator, responder := testSessions(t, method)
+
+	assert.Equal(method, initiator.Method())
+	assert.Equal(headerSize+16, initiator.Overhead())
+
+	payload := []byte("hello world")
+
+	// initiator → responder
+	pkt := initiator.Encrypt(nil, payload)
+	require.Len(pkt, len(payload)+initiator.Overhead())
+	assert.Equal([]byte{3, 0, 0, 0, 0, 0, 0, 0}, pkt[:headerSize])
+
+	out, err := responder.Decrypt(nil, pkt)
+	require.NoError(err)
+	assert.Equal(payload, out)
+
+	// responder → initiator
+	pkt = responder.Encrypt([]byte{byte(TypeData)}, payload)
+	assert.Equal([]byte{byte(TypeData), 2, 0, 0, 0, 0, 0, 0, 0}, pkt[:1+headerSize])
+
+	out, err = initiator.Decrypt(nil, pkt[1:])
+	require.NoError(err)
+	assert.Equal(payload, out)
+
+	// empty payload (keepalive)
+	out, err = responder.Decrypt(nil, initiator.Encrypt(nil, nil))
+	require.NoError(err)
+	assert.Empty(out)
+
+	// tampered packet
+	pkt = initiator.Encrypt(nil, payload)
+	pkt[len(pkt)-1] ^= 1
+	_, err = responder.Decrypt(nil, pkt)
+	assert.Equal(errInvalidTag, err)
+
+	// own packets have the wrong nonce parity
+	_, err = initiator.Decrypt(nil, initiator.Encrypt(nil, payload))
+	assert.Equal(errInvalidNonce, err)
+
+	// truncated packet
+	_, err = responder.Decrypt(nil, pkt[:headerSize+15])
+	assert.Equal(errPacketTooShort, err)
+}
+
+func TestSessionEncryption(t *testing.T) {
+	assert := assert.New(t)
+	payload := []byte("hello world")
+
+	initiator, _ := testSessions(t, "salsa2012+umac")
+	assert.NotContains(string(initiator.Encrypt(nil, payload)), string(payload))
+
+	// authentication only
+	initiator, _ = testSessions(t, "null+salsa2012+umac")
+	assert.Contains(string(initiator.Encrypt(nil, payload)), string(payload))
+}
+
+// The vectors of the umac methods were computed by an independent
+// implementation of the reference constructions: HKDF-SHA256 with the
+// public keys and the method name as info, Salsa20/12 with the nonce
+// expanded to 8 bytes ending with 1 and the masked UHASH tag in front of
+// the ciphertext.
+func TestSessionUMACVectors(t *testing.T) {
+	tests := []struct {
+		method string
+		key    string // first 32 bytes of the method key
+		digest string // SHA-256 of the method key
+	}{
+		{"salsa2012+umac", "db289f24ea7eb577b96575f80b8a9de4465474611baa1c2979034bc51f464283", "f55d8912ccdb6b1caffada4467b50dfa98a5dfb856f6d980d42b0758e557e1e7"},
+		{"null+salsa2012+umac", "9492b47b33ea2c46d61d1c9f793f803e4b0fb478831d8c20c94bcce7c0414a04", "c57129f2e03828d847b1a03b89109d14da39c141412a7c0a831a6b4e36e172fd"},
+	}
+
+	pubkey := func(c byte) []byte { return bytes.Repeat([]byte{c}, KEYSIZE) }
+	payload := make([]byte, 64)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	for _, test := range tests {
+		t.Run(test.method, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			hs := Handshake{
+				prk:     extractKey(pubkey('S')),
+				keyInfo: keyInfo(pubkey('A'), pubkey('B'), pubkey('X'), pubkey('Y')),
+			}
+			key := hs.methodKey(test.method, umacKeyLength)
+			digest := sha256.Sum256(key)
+			assert.Equal(test.key, hex.EncodeToString(key[:32]))
+			assert.Equal(test.digest, hex.EncodeToString(digest[:]))
+
+			pkt := readTestdata(test.method + ".dat")
+
+			responder, err := hs.NewSession(test.method)
+			require.NoError(err)
+			out, err := responder.Decrypt(nil, pkt)
+			require.NoError(err)
+			assert.Equal(payload, out)
+
+			hs.initiator = true
+			initiator, err := hs.NewSession(test.method)
+			require.NoError(err)
+			assert.Equal(pkt, initiator.Encrypt(nil, payload))
+		})
+	}
+}
+
+// aes128-gcm is checked against test cases 1 and 2 of the GCM
+// specification, whose zero IV is the expansion of the zero nonce
+func TestAES128GCMVectors(t *testing.T) {
+	assert := assert.New(t)
+	method, err := newAES128GCMMethod(make([]byte, aes128gcmKeyLength))
+	require.NoError(t, err)
+	nonce := make([]byte, nonceSize)
+
+	tests := []struct {
+		payload string
+		packet  string // tag followed by the ciphertext
+	}{
+		{"", "58e2fccefa7e3061367f1d57a4e7455a"},
+		{"00000000000000000000000000000000", "ab6e47d42cec13bdf53a67b21257bddf0388dace60b6a392f328c2b971b2fe78"},
+	}
+
+	for _, test := range tests {
+		payload, _ := hex.DecodeString(test.payload)
+		packet := method.Encrypt(nil, nonce, payload)
+		assert.Equal(test.packet, hex.EncodeToString(packet))
+
+		out, err := method.Decrypt(nil, nonce, packet)
+		assert.NoError(err)
+		assert.Equal(test.payload, hex.EncodeToString(out))
+	}
+}
+
+// The payload of the AEAD methods is encrypted by the keystream following
+// the block of the tag
+func TestAEADKeystream(t *testing.T) {
+	assert := assert.New(t)
+	key := make([]byte, chacha20poly1305KeyLength)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	nonce := []byte{1, 2, 3, 4, 5, 6}
+	payload := bytes.Repeat([]byte{0x42}, 100)
+
+	// aes128-ctr starting with the second counter block after the tag
+	method, err := newAES128GCMMethod(key[:aes128gcmKeyLength])
+	require.NoError(t, err)
+	block, _ := aes.NewCipher(key[:aes128gcmKeyLength])
+	expected := make([]byte, len(payload))
+	cipher.NewCTR(block, append(expandNonce(nonce, aes.BlockSize)[:aes.BlockSize-1], 2)).XORKeyStream(expected, payload)
+	assert.Equal(expected, method.Encrypt(nil, nonce, payload)[aeadTagSize:])
+
+	// ChaCha20 starting with block 1, block 0 is the Poly1305 key
+	method, err = newChaCha20Poly1305Method(key)
+	require.NoError(t, err)
+	stream, _ := chacha20.NewUnauthenticatedCipher(key, append(nonce, 0, 0, 0, 0, 0, 0))
+	stream.SetCounter(1)
+	stream.XORKeyStream(expected, payload)
+	assert.Equal(expected, method.Encrypt(nil, nonce, payload)[aeadTagSize:])
+}
+
+func TestRegisterMethod(t *testing.T) {
+	assert := assert.New(t)
+	names := MethodNames()
+	assert.Equal([]string{"salsa2012+umac", "chacha20-poly1305", "aes128-gcm", "null+salsa2012+umac", "null"}, names)
+
+	// replacing keeps the order
+	RegisterMethod("null", 0, newNullMethod)
+	assert.Equal(names, MethodNames())
+}
+
+func TestIncrementNonce(t *testing.T) {
+	s := Session{sendNonce: [nonceSize]byte{0xfe, 0xff, 0x01}}
+	s.incrementNonce()
+	assert.Equal(t, [nonceSize]byte{0x00, 0x00, 0x02}, s.sendNonce)
+
+	s.sendNonce = [nonceSize]byte{0xff, 0x00}
+	s.incrementNonce()
+	assert.Equal(t, [nonceSize]byte{0x01, 0x01}, s.sendNonce)
+
+	last := [nonceSize]byte{0x01, 0x01}
+	nonce := [nonceSize]byte{0xfd}
+	assert.EqualValues(t, 2, nonceAge(&last, &nonce))
+	assert.EqualValues(t, -2, nonceAge(&nonce, &last))
+}
@@ -0,0 +1,335 @@
+package fastd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/digineo/fastd/ifconfig"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultStateInterval is the default interval between state snapshots.
+const DefaultStateInterval = time.Minute
+
+// stateNonceSkip is the number of nonces skipped by a restored session.
+// Packets sent after the last snapshot must not reuse a nonce.
+const stateNonceSkip = 1 << 32
+
+// peerState is the snapshot of an established peer
+type peerState struct {
+	Remote        Sockaddr      `json:"remote"`
+	Local         Sockaddr      `json:"local"`
+	PublicKey     []byte        `json:"public_key"`
+	Name          string        `json:"name,omitempty"`
+	Ifname        string        `json:"ifname"`
+	Mode          Mode          `json:"mode"`
+	CompactHeader bool          `json:"compact_header"`
+	MTU           uint16        `json:"mtu"`
+	IPv4          AddressConfig `json:"ipv4"`
+	IPv4PrefixLen uint8         `json:"ipv4_prefix_len,omitempty"`
+	IPv6          AddressConfig `json:"ipv6"`
+	IPv6PrefixLen uint8         `json:"ipv6_prefix_len,omitempty"`
+	Vars          []byte        `json:"vars,omitempty"`
+	Established   time.Time     `json:"established"`
+	Session       *sessionState `json:"session,omitempty"` // only with Config.StateKeys
+}
+
+// sessionState is the key material of a session
+type sessionState struct {
+	Method       string `json:"method"`
+	Key          []byte `json:"key"`
+	SendNonce    []byte `json:"send_nonce"`
+	ReceiveNonce []byte `json:"receive_nonce"`
+}
+
+func (c *Config) stateInterval() time.Duration {
+	if c.StateInterval > 0 {
+		return c.StateInterval
+	}
+	return DefaultStateInterval
+}
+
+// startStateWriter writes a snapshot in every state interval
+func (srv *Server) startStateWriter() {
+	ticker := time.NewTicker(srv.config.stateInterval())
+	srv.stateStop = make(chan struct{})
+
+	srv.wg.Add(1)
+	go func() {
+		defer srv.wg.Done()
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-srv.stateStop:
+				return
+			case <-ticker.C:
+				srv.writeState()
+			}
+		}
+	}()
+}
+
+// stopStateWriter stops the writer and writes a last snapshot
+func (srv *Server) stopStateWriter() {
+	close(srv.stateStop)
+	srv.writeState()
+}
+
+// writeState replaces the state file with a snapshot of the established peers
+func (srv *Server) writeState() {
+	var states []*peerState
+	if !srv.call(func() { states = srv.snapshot() }) {
+		return
+	}
+
+	if err := writeStateFile(srv.config.StateFile, states); err != nil {
+		log.WithFields(logrus.Fields{
+			logrus.ErrorKey: err,
+			"path":          srv.config.StateFile,
+		}).Error("unable to write state")
+	}
+}
+
+// snapshot returns the state of the established peers. It is called by
+// the worker, which owns the sessions.
+func (srv *Server) snapshot() []*peerState {
+	srv.peersMtx.RLock()
+	defer srv.peersMtx.RUnlock()
+
+	states := make([]*peerState, 0, len(srv.peers))
+	for _, peer := range srv.peers {
+		if peer.session == nil {
+			continue
+		}
+
+		state := &peerState{
+			Remote:        peer.Remote,
+			Local:         peer.local,
+			PublicKey:     peer.PublicKey,
+			Name:          peer.Name,
+			Ifname:        peer.Ifname,
+			Mode:          peer.Mode,
+			CompactHeader: peer.compactHeader,
+			MTU:           peer.MTU,
+			IPv4:          peer.IPv4,
+			IPv4PrefixLen: peer.IPv4PrefixLen,
+			IPv6:          peer.IPv6,
+			IPv6PrefixLen: peer.IPv6PrefixLen,
+			Vars:          peer.Vars,
+			Established:   time.Unix(0, atomic.LoadInt64(&peer.established)),
+		}
+		if srv.config.StateKeys {
+			state.Session = peer.session.state()
+		}
+		states = append(states, state)
+	}
+	return states
+}
+
+func writeStateFile(path string, states []*peerState) error {
+	data, err := json.Marshal(states)
+	if err != nil {
+		return err
+	}
+
+	// the file may contain session keys
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func readStateFile(path string) ([]*peerState, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var states []*peerState
+	if err := json.Unmarshal(data, &states); err != nil {
+		return nil, errors.Wrapf(err, "invalid state file %s", path)
+	}
+	return states, nil
+}
+
+// restoreState recreates the peers of the state file unless the
+// implementation still has them. It returns the restored peers without
+// a session, which need a new handshake.
+func (srv *Server) restoreState() ([]*Peer, error) {
+	states, err := readStateFile(srv.config.StateFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var handshake []*Peer
+	for _, state := range states {
+		if _, exists := srv.peersByKey[string(state.PublicKey)]; exists {
+			continue
+		}
+
+		llog := log.WithFields(logrus.Fields{
+			"remote": state.Remote.String(),
+			"pubkey": fmt.Sprintf("%x", state.PublicKey),
+		})
+
+		peer, err := srv.restorePeer(state)
+		if err != nil {
+			llog.WithError(err).Error("unable to restore peer")
+			continue
+		}
+		llog.WithField("ifname", peer.Ifname).Info("restored peer")
+
+		if peer.session == nil {
+			handshake = append(handshake, peer)
+		}
+	}
+
+	return handshake, nil
+}
+
+func (srv *Server) restorePeer(state *peerState) (*Peer, error) {
+	peer := NewPeer(state.Remote)
+	peer.local = state.Local
+	peer.PublicKey = state.PublicKey
+	peer.Name = state.Name
+	peer.Mode = state.Mode
+	peer.compactHeader = state.CompactHeader
+	peer.IPv4 = state.IPv4
+	peer.IPv4PrefixLen = state.IPv4PrefixLen
+	peer.IPv6 = state.IPv6
+	peer.IPv6PrefixLen = state.IPv6PrefixLen
+	peer.Vars = state.Vars
+
+	var session *Session
+	if state.Session != nil {
+		var err error
+		if session, err = restoreSession(state.Session); err != nil {
+			return nil, err
+		}
+	}
+
+	ifname, err := srv.impl.Clone(peer.Remote, peer.PublicKey, peer.Mode, peer.compactHeader)
+	if err != nil {
+		return nil, errors.Wrap(err, "cloning failed")
+	}
+	peer.Ifname = ifname
+	srv.runHook("up", srv.config.Hooks.Up, peer)
+
+	if state.MTU != 0 {
+		if err := ifconfig.SetMTU(ifname, state.MTU); err != nil {
+			log.WithFields(logrus.Fields{
+				logrus.ErrorKey: err,
+				"ifname":        ifname,
+				"mtu":           state.MTU,
+			}).Error("unable to set MTU")
+		} else {
+			peer.MTU = state.MTU
+		}
+	}
+
+	if f := srv.config.AssignAddresses; f != nil {
+		if err := f(peer); err != nil {
+			srv.releasePeer(peer)
+			return nil, errors.Wrap(err, "unable to assign addresses")
+		}
+	}
+	peer.assignAddresses()
+
+	if session != nil {
+		session.stats = &peer.replay
+		if err := srv.impl.SetSession(ifname, session); err != nil {
+			srv.releasePeer(peer)
+			return nil, errors.Wrap(err, "unable to set session")
+		}
+		peer.session = session
+		atomic.StoreInt64(&peer.established, state.Established.UnixNano())
+		if interval := srv.config.RehandshakeInterval; interval > 0 {
+			peer.rehandshakeAt = time.Now().Add(rehandshakeDelay(interval, srv.config.RehandshakeJitter))
+		}
+		srv.runHook("establish", srv.config.Hooks.Establish, peer)
+	}
+
+	srv.peersMtx.Lock()
+	srv.peers[string(peer.Remote.Raw())] = peer
+	srv.peersByKey[string(peer.PublicKey)] = peer
+	srv.peersMtx.Unlock()
+
+	return peer, nil
+}
+
+// state returns the key material and nonces of the session
+func (s *Session) state() *sessionState {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return &sessionState{
+		Method:       s.method.Name(),
+		Key:          s.key,
+		SendNonce:    append([]byte(nil), s.sendNonce[:]...),
+		ReceiveNonce: append([]byte(nil), s.replay.last[:]...),
+	}
+}
+
+// restoreSession recreates a session of a snapshot. Its send nonce is
+// advanced by stateNonceSkip and older received nonces are rejected.
+func restoreSession(state *sessionState) (*Session, error) {
+	if len(state.SendNonce) != nonceSize || len(state.ReceiveNonce) != nonceSize {
+		return nil, errors.New("invalid nonce")
+	}
+
+	validKey := true
+	m, err := newMethod(state.Method, func(length int) []byte {
+		if validKey = len(state.Key) == length; !validKey {
+			return make([]byte, length)
+		}
+		return state.Key
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !validKey {
+		return nil, errors.New("invalid key length")
+	}
+
+	session := &Session{method: m, key: state.Key}
+	copy(session.sendNonce[:], state.SendNonce)
+	copy(session.replay.last[:], state.ReceiveNonce)
+	session.replay.lastTime = time.Now()
+	session.replay.seen = ^uint64(0)
+	session.skipNonces(stateNonceSkip)
+
+	return session, nil
+}
+
+// skipNonces advances the send nonce by n nonces of our parity
+func (s *Session) skipNonces(n uint64) {
+	var value uint64
+	for i := nonceSize - 1; i >= 0; i-- {
+		value = value<<8 | uint64(s.sendNonce[i])
+	}
+	value += 2 * n
+	for i := 0; i < nonceSize; i++ {
+		s.sendNonce[i] = byte(value)
+		value >>= 8
+	}
+}
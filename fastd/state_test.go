@@ -0,0 +1,140 @@
+package fastd
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionState(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	initiator, responder := testSessions(t, "salsa2012+umac")
+
+	sent := initiator.Encrypt(nil, []byte{1})
+	_, err := responder.Decrypt(nil, sent)
+	require.NoError(err)
+	responder.Encrypt(nil, []byte{2})
+
+	restored, err := restoreSession(responder.state())
+	require.NoError(err)
+
+	// the send nonce is advanced
+	var nonce [nonceSize]byte
+	copy(nonce[:], restored.Encrypt(nil, []byte{3}))
+	assert.EqualValues(stateNonceSkip, -nonceAge(&responder.sendNonce, &nonce))
+
+	// received packets are rejected
+	_, err = restored.Decrypt(nil, sent)
+	assert.Equal(errDuplicatePacket, err)
+
+	payload, err := restored.Decrypt(nil, initiator.Encrypt(nil, []byte{4}))
+	assert.NoError(err)
+	assert.Equal([]byte{4}, payload)
+
+	_, err = restoreSession(&sessionState{Method: "salsa2012+umac", Key: []byte{1}, SendNonce: nonce[:], ReceiveNonce: nonce[:]})
+	assert.EqualError(err, "invalid key length")
+}
+
+func TestServerState(t *testing.T) {
+	for _, keys := range []bool{true, false} {
+		t.Run(map[bool]string{true: "keys", false: "handshake"}[keys], func(t *testing.T) {
+			testServerState(t, keys)
+		})
+	}
+}
+
+func testServerState(t *testing.T, keys bool) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "fastd-state")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	config := Config{
+		StateFile: filepath.Join(dir, "state.json"),
+		StateKeys: keys,
+	}
+
+	_, restore := withTestTun()
+	srv, session, _ := connectTestClient(t, config, nil)
+	defer session.Close()
+	port := srv.impl.(*UDPServer).connections[0].conn.LocalAddr().(*net.UDPAddr).Port
+	srv.Stop()
+	restore()
+
+	// restart on the same port
+	tun, restore := withTestTun()
+	defer restore()
+	config.Bind = []Sockaddr{{IP: net.ParseIP("127.0.0.1"), Port: uint16(port)}}
+	require.NoError(config.SetServerKey(testServerSecretHex))
+	srv, err = NewServer("udp", &config)
+	require.NoError(err)
+	defer srv.Stop()
+	assert.Equal(1, srv.PeersCount())
+
+	if !keys {
+		// the server starts a handshake, which is completed while reading
+		oldKey := session.SharedKey()
+		go func() {
+			session.conn.SetReadDeadline(time.Now().Add(time.Second))
+			session.ReadPacket(nil)
+		}()
+		waitForKeyChange(t, session, oldKey)
+	}
+
+	require.NoError(session.WritePacket([]byte{0x45, 0x01}))
+	assert.Equal([]byte{0x45, 0x01}, receive(t, tun.toLocal))
+
+	if keys {
+		tun.toRemote <- []byte{0x45, 0x02}
+		session.conn.SetReadDeadline(time.Now().Add(time.Second))
+		payload, err := session.ReadPacket(nil)
+		require.NoError(err)
+		assert.Equal([]byte{0x45, 0x02}, payload)
+	}
+}
+
+// failingSessionImpl is a testServerImpl unable to set sessions
+type failingSessionImpl struct {
+	testServerImpl
+}
+
+func (impl *failingSessionImpl) SetSession(string, *Session) error {
+	return errors.New("no session")
+}
+
+func TestRestorePeerFailed(t *testing.T) {
+	assert := assert.New(t)
+	_, responder := testSessions(t, "salsa2012+umac")
+
+	impl := &failingSessionImpl{}
+	srv := newTestServer(impl)
+	var released []*Peer
+	srv.config.ReleaseAddresses = func(peer *Peer) {
+		released = append(released, peer)
+	}
+
+	peer, err := srv.restorePeer(&peerState{
+		Remote:    Sockaddr{IP: net.ParseIP("192.0.2.1"), Port: 10000},
+		PublicKey: testClientSecret.Public(),
+		Session:   responder.state(),
+	})
+	assert.Nil(peer)
+	assert.EqualError(err, "unable to set session: no session")
+
+	// the interface is destroyed and the addresses are released
+	assert.Equal([]string{"fastd0"}, impl.destroyed)
+	if assert.Len(released, 1) {
+		assert.Equal("fastd0", released[0].Ifname)
+	}
+	assert.Equal(0, srv.PeersCount())
+}
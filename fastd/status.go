@@ -0,0 +1,191 @@
+package fastd
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Status is the state of a server. Its JSON encoding is compatible with
+// the status socket of the reference implementation, times are given in
+// milliseconds.
+type Status struct {
+	Uptime     float64                `json:"uptime"`
+	Interfaces []string               `json:"interfaces"`
+	Statistics Statistics             `json:"statistics"`
+	Peers      map[string]*PeerStatus `json:"peers"` // indexed by the hex encoded public key
+}
+
+// PeerStatus is the state of a peer.
+type PeerStatus struct {
+	Name       *string           `json:"name"` // null for unknown peers
+	Address    string            `json:"address"`
+	Interface  string            `json:"interface,omitempty"`
+	MTU        uint16            `json:"mtu,omitempty"`
+	IPv4       *AddressConfig    `json:"ipv4,omitempty"`
+	IPv6       *AddressConfig    `json:"ipv6,omitempty"`
+	LastSeen   float64           `json:"last_seen"` // time since the last packet
+	Handshake  string            `json:"handshake"` // "none", "pending" or "established"
+	Connection *ConnectionStatus `json:"connection"`
+}
+
+// ConnectionStatus describes the session of an established peer.
+type ConnectionStatus struct {
+	Established float64    `json:"established"` // time since the last finished handshake
+	Method      string     `json:"method"`
+	Statistics  Statistics `json:"statistics"`
+}
+
+// Statistics are the traffic counters of the reference implementation.
+// Counters that are not tracked by us stay zero.
+type Statistics struct {
+	RX          TrafficCounter `json:"rx"`
+	RXReordered TrafficCounter `json:"rx_reordered"`
+	TX          TrafficCounter `json:"tx"`
+	TXDropped   TrafficCounter `json:"tx_dropped"`
+	TXError     TrafficCounter `json:"tx_error"`
+}
+
+// TrafficCounter counts packets and their payload bytes.
+type TrafficCounter struct {
+	Packets uint64 `json:"packets"`
+	Bytes   uint64 `json:"bytes"`
+}
+
+func (stats *Statistics) add(other *Statistics) {
+	stats.RX.Packets += other.RX.Packets
+	stats.RX.Bytes += other.RX.Bytes
+	stats.TX.Packets += other.TX.Packets
+	stats.TX.Bytes += other.TX.Bytes
+}
+
+// Status returns the state of the server and its peers. It returns nil
+// if the server has been stopped.
+func (srv *Server) Status() *Status {
+	var status *Status
+	srv.call(func() {
+		status = srv.status(time.Now())
+	})
+	return status
+}
+
+func (srv *Server) status(now time.Time) *Status {
+	srv.peersMtx.RLock()
+	defer srv.peersMtx.RUnlock()
+
+	status := &Status{
+		Uptime:     milliseconds(now.Sub(srv.started)),
+		Interfaces: []string{},
+		Peers:      make(map[string]*PeerStatus, len(srv.peers)),
+	}
+
+	for _, peer := range srv.peers {
+		ps := peer.status(srv.impl, now)
+		if ps.Connection != nil {
+			status.Statistics.add(&ps.Connection.Statistics)
+		}
+		if peer.Ifname != "" {
+			status.Interfaces = append(status.Interfaces, peer.Ifname)
+		}
+		status.Peers[hex.EncodeToString(peer.PublicKey)] = ps
+	}
+	sort.Strings(status.Interfaces)
+
+	return status
+}
+
+func (peer *Peer) status(impl ServerImpl, now time.Time) *PeerStatus {
+	ps := &PeerStatus{
+		Address:   peer.Remote.String(),
+		Interface: peer.Ifname,
+		MTU:       peer.MTU,
+		LastSeen:  milliseconds(now.Sub(peer.lastSeen)),
+		Handshake: "none",
+	}
+
+	if peer.Name != "" {
+		name := peer.Name
+		ps.Name = &name
+	}
+	if ipv4 := peer.IPv4; ipv4.LocalAddr != nil {
+		ps.IPv4 = &ipv4
+	}
+	if ipv6 := peer.IPv6; ipv6.LocalAddr != nil {
+		ps.IPv6 = &ipv6
+	}
+
+	if hs := peer.handshake; hs != nil && hs.timeout.After(now) {
+		ps.Handshake = "pending"
+	} else if peer.session != nil {
+		ps.Handshake = "established"
+	}
+
+	if peer.session != nil {
+		conn := &ConnectionStatus{
+			Established: milliseconds(peer.SessionAge()),
+			Method:      peer.session.Method(),
+		}
+		if stats, err := impl.Stats(peer.Ifname); err == nil {
+			conn.Statistics.RX = TrafficCounter{stats.ipackets, stats.ibytes}
+			conn.Statistics.TX = TrafficCounter{stats.opackets, stats.obytes}
+		}
+		ps.Connection = conn
+	}
+
+	return ps
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// startStatusSocket listens on a Unix socket and writes the status as
+// JSON to every client.
+func (srv *Server) startStatusSocket(path string) error {
+	ln, err := listenUnix(path)
+	if err != nil {
+		return errors.Wrap(err, "unable to create status socket")
+	}
+	srv.statusListener = ln
+	log.WithField("path", path).Info("status socket created")
+
+	srv.wg.Add(1)
+	go func() {
+		defer srv.wg.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			srv.writeStatus(conn)
+		}
+	}()
+	return nil
+}
+
+// listenUnix listens on a Unix socket, a stale socket is removed
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	return net.Listen("unix", path)
+}
+
+func (srv *Server) writeStatus(conn net.Conn) {
+	defer conn.Close()
+
+	status := srv.Status()
+	if status == nil {
+		return
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	if err := json.NewEncoder(conn).Encode(status); err != nil {
+		log.WithError(err).Debug("writing status failed")
+	}
+}
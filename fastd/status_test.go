@@ -0,0 +1,65 @@
+package fastd
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatusSocket(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	_, restore := withTestTun()
+	defer restore()
+
+	dir, err := ioutil.TempDir("", "fastd")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "status.sock")
+
+	srv, session, _ := connectTestClient(t, Config{
+		StatusSocket: path,
+		AssignAddresses: func(peer *Peer) error {
+			peer.IPv4.LocalAddr = net.ParseIP("10.0.0.1")
+			peer.IPv4.DestAddr = net.ParseIP("10.0.0.2")
+			return nil
+		},
+	}, nil)
+	defer session.Close()
+
+	conn, err := net.Dial("unix", path)
+	require.NoError(err)
+	defer conn.Close()
+
+	var status map[string]interface{}
+	require.NoError(json.NewDecoder(conn).Decode(&status))
+
+	assert.Contains(status, "uptime")
+	assert.Equal([]interface{}{"fastd0"}, status["interfaces"])
+
+	peers := status["peers"].(map[string]interface{})
+	require.Len(peers, 1)
+	peer := peers[hex.EncodeToString(testClientSecret.Public())].(map[string]interface{})
+	assert.Equal(session.conn.LocalAddr().String(), peer["address"])
+	assert.Equal("fastd0", peer["interface"])
+	assert.Equal("established", peer["handshake"])
+	assert.Equal(map[string]interface{}{"local": "10.0.0.1", "dest": "10.0.0.2"}, peer["ipv4"])
+	assert.NotContains(peer, "ipv6")
+
+	connection := peer["connection"].(map[string]interface{})
+	assert.Equal("salsa2012+umac", connection["method"])
+	assert.Contains(connection["statistics"], "rx_reordered")
+
+	// the socket is removed on shutdown
+	srv.Stop()
+	_, err = os.Stat(path)
+	assert.True(os.IsNotExist(err))
+	assert.Nil(srv.Status())
+}
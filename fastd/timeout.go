@@ -3,57 +3,73 @@ package fastd
 import (
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
 const peerCheckInterval = 15 * time.Second
 
-func (srv *Server) startTimeouter() {
-	srv.wg.Add(1)
+var rehandshakeCheckInterval = time.Second
 
-	go func() {
-		for {
-			select {
-			case <-srv.timeoutStop:
-				srv.wg.Done()
-				return
-			case <-srv.timeoutTicker.C:
-				srv.timeoutPeers()
-			}
-		}
-	}()
-}
+// Removes timed out peers. It is called by the worker, which owns the
+// state of the peers.
+func (srv *Server) timeoutPeers(now time.Time) {
+	var timedOut []*Peer
 
-func (srv *Server) stopTimeouter() {
-	srv.timeoutTicker.Stop()
-	srv.timeoutStop <- struct{}{}
-}
-
-// Removes timed out peers
-func (srv *Server) timeoutPeers() {
 	srv.peersMtx.Lock()
-	defer srv.peersMtx.Unlock()
-
-	now := time.Now()
-
 	for _, peer := range srv.peers {
-		if peer.hasTimeout(now, srv.config.Timeout) {
+		if peer.hasTimeout(srv.impl, now, srv.config.Timeout) {
 			log.WithFields(logrus.Fields{
 				"ifname": peer.Ifname,
 				"remote": peer.Remote.String(),
+				"peer":   peer.Name,
 			}).Info("timed out")
 			srv.removePeerLocked(peer)
+			srv.metrics.timeouts.Inc()
+			timedOut = append(timedOut, peer)
+		}
+	}
+	srv.peersMtx.Unlock()
+
+	// the hooks and the callback may take a while or use the server
+	for _, peer := range timedOut {
+		srv.emitPeer(EventTimedOut, peer)
+		srv.releasePeer(peer)
+		if f := srv.config.OnTimeout; f != nil {
+			f(peer)
+		}
+	}
+}
 
-			if f := srv.config.OnTimeout; f != nil {
-				f(peer)
-			}
+// Starts handshakes with peers whose session is due for renewal. It is
+// called by the worker, which owns the handshake state of the peers.
+func (srv *Server) rehandshakePeers(now time.Time) {
+	srv.peersMtx.RLock()
+	defer srv.peersMtx.RUnlock()
+
+	for _, peer := range srv.peers {
+		if peer.session == nil || peer.rehandshakeAt.After(now) {
+			continue
+		}
+		// unfinished handshakes are retried after the timeout
+		if hs := peer.handshake; hs != nil && hs.timeout.After(now) {
+			continue
+		}
+
+		if err := srv.startHandshake(peer); err != nil {
+			log.WithFields(logrus.Fields{
+				logrus.ErrorKey: err,
+				"remote":        peer.Remote.String(),
+				"peer":          peer.Name,
+			}).Error("unable to send handshake request")
+			srv.reportError(errors.Wrapf(err, "sending handshake to %v failed", peer.Remote.String()))
 		}
 	}
 }
 
 // Returns true if the counter has been updated
-func (peer *Peer) updateCounter(now time.Time) bool {
-	stats, err := GetStats(peer.Ifname)
+func (peer *Peer) updateCounter(impl ServerImpl, now time.Time) bool {
+	stats, err := impl.Stats(peer.Ifname)
 	if err != nil {
 		log.WithFields(logrus.Fields{
 			logrus.ErrorKey: err,
@@ -73,8 +89,8 @@ func (peer *Peer) updateCounter(now time.Time) bool {
 }
 
 // Returns whether the peer is timed out
-func (peer *Peer) hasTimeout(now time.Time, peerTimeout time.Duration) bool {
-	if peer.Ifname != "" && peer.updateCounter(now) {
+func (peer *Peer) hasTimeout(impl ServerImpl, now time.Time, peerTimeout time.Duration) bool {
+	if peer.Ifname != "" && peer.updateCounter(impl, now) {
 		return false
 	}
 
@@ -0,0 +1,31 @@
+package fastd
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTimeoutPeers(t *testing.T) {
+	assert := assert.New(t)
+	srv := newTestServer(&testServerImpl{})
+	srv.config.Timeout = time.Minute
+
+	var timedOut []*Peer
+	srv.config.OnTimeout = func(peer *Peer) {
+		timedOut = append(timedOut, peer)
+	}
+
+	now := time.Now()
+	active, _ := srv.getPeer(Sockaddr{IP: net.ParseIP("192.0.2.1"), Port: 10000}, nil, true)
+	idle, _ := srv.getPeer(Sockaddr{IP: net.ParseIP("192.0.2.2"), Port: 10000}, nil, true)
+	idle.lastSeen = now.Add(-2 * time.Minute)
+
+	srv.timeoutPeers(now)
+	assert.Equal([]*Peer{idle}, timedOut)
+	assert.Equal([]*Peer{active}, srv.GetPeers())
+	assert.EqualValues(1, testutil.ToFloat64(srv.metrics.timeouts))
+}
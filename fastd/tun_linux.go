@@ -0,0 +1,60 @@
+package fastd
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/songgao/water"
+	"github.com/vishvananda/netlink"
+)
+
+// newTunDevice creates a TUN or TAP device and brings it up. The name
+// is derived from the given prefix and the next free index.
+var newTunDevice = func(prefix string, mode Mode) (tunDevice, error) {
+	name, err := nextIfname(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	config := water.Config{DeviceType: water.TUN}
+	if mode == ModeTAP {
+		config.DeviceType = water.TAP
+	}
+	config.Name = name
+
+	iface, err := water.New(config)
+	if err != nil {
+		return nil, err
+	}
+
+	link, err := netlink.LinkByName(iface.Name())
+	if err == nil {
+		err = netlink.LinkSetUp(link)
+	}
+	if err != nil {
+		iface.Close()
+		return nil, err
+	}
+
+	return iface, nil
+}
+
+// nextIfname returns the first unused interface name with the given prefix
+func nextIfname(prefix string) (string, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return "", err
+	}
+
+	existing := make(map[string]struct{}, len(ifaces))
+	for _, iface := range ifaces {
+		existing[iface.Name] = struct{}{}
+	}
+
+	for i := 0; ; i++ {
+		name := fmt.Sprintf("%s%d", prefix, i)
+		if _, found := existing[name]; !found {
+			return name, nil
+		}
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package fastd
+
+import "errors"
+
+// newTunDevice is not supported on this platform, use the kernel
+// implementation instead.
+var newTunDevice = func(prefix string, mode Mode) (tunDevice, error) {
+	return nil, errors.New("userspace tunnels are not supported on this platform")
+}
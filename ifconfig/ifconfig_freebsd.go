@@ -25,6 +25,15 @@ func init() {
 	}
 }
 
+// Converts the given value to a syscall.Errno if it is not zero
+func retval(val C.int) error {
+	if val == 0 {
+		return nil
+	} else {
+		return syscall.Errno(val)
+	}
+}
+
 func GetDrvSpec(ifname string, cmd C.ulong, data unsafe.Pointer, len uintptr) error {
 	name := C.CString(ifname)
 	defer C.free(unsafe.Pointer(name))
@@ -1,7 +1,6 @@
 package ifconfig
 
 import (
-	"C"
 	"errors"
 	"net"
 	"unsafe"
@@ -11,11 +10,11 @@ import (
 
 var notImplemented = errors.New("not implemented")
 
-func GetDrvSpec(ifname string, cmd C.ulong, data unsafe.Pointer, len uintptr) error {
+func GetDrvSpec(ifname string, cmd uint, data unsafe.Pointer, len uintptr) error {
 	return notImplemented
 }
 
-func SetDrvSpec(ifname string, cmd C.ulong, data unsafe.Pointer, len uintptr) error {
+func SetDrvSpec(ifname string, cmd uint, data unsafe.Pointer, len uintptr) error {
 	return notImplemented
 }
 
@@ -49,7 +48,22 @@ func SetDescr(ifname string, descr string) error {
 }
 
 func SetAddrPTP(ifname string, addr, dstaddr net.IP) (err error) {
-	return notImplemented
+	link, err := netlink.LinkByName(ifname)
+	if err != nil {
+		return err
+	}
+
+	bits := 8 * net.IPv6len
+	if IsIPv4(addr) {
+		addr = addr.To4()
+		dstaddr = dstaddr.To4()
+		bits = 8 * net.IPv4len
+	}
+
+	return netlink.AddrReplace(link, &netlink.Addr{
+		IPNet: &net.IPNet{IP: addr, Mask: net.CIDRMask(bits, bits)},
+		Peer:  &net.IPNet{IP: dstaddr, Mask: net.CIDRMask(bits, bits)},
+	})
 }
 
 func SetAddr(ifname string, addr net.IP, prefixlen uint8) (err error) {
@@ -0,0 +1,83 @@
+package pool
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Lease is a persisted address assignment.
+type Lease struct {
+	PublicKey string    `json:"public_key"`     // hex encoded
+	IPv4      net.IP    `json:"ipv4,omitempty"` // local address of the network
+	IPv6      net.IP    `json:"ipv6,omitempty"` // local address of the network
+	Ifname    string    `json:"ifname,omitempty"`
+	Created   time.Time `json:"created"`
+	Updated   time.Time `json:"updated"` // time of the last change
+	Active    bool      `json:"active"`  // whether the peer has not been released
+}
+
+// readLeases reads a file with one JSON encoded lease per line. A
+// missing file contains no leases.
+func readLeases(path string) ([]Lease, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var leases []Lease
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var lease Lease
+		if err := json.Unmarshal(scanner.Bytes(), &lease); err != nil {
+			return nil, errors.Wrapf(err, "%s:%d", path, line)
+		}
+		if _, err := hex.DecodeString(lease.PublicKey); err != nil {
+			return nil, errors.Wrapf(err, "%s:%d: invalid public key", path, line)
+		}
+		leases = append(leases, lease)
+	}
+	return leases, scanner.Err()
+}
+
+// writeLeases replaces the file atomically
+func writeLeases(path string, leases []Lease) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for i := range leases {
+		if err := enc.Encode(&leases[i]); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
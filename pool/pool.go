@@ -0,0 +1,394 @@
+// Package pool assigns tunnel addresses from IPv4 and IPv6 prefixes to
+// fastd peers.
+package pool
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/digineo/fastd/fastd"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Default prefix lengths of the network of a peer
+const (
+	DefaultIPv4PrefixLen = 31
+	DefaultIPv6PrefixLen = 127
+)
+
+// DefaultLeaseTime is the default time a released lease is kept.
+const DefaultLeaseTime = 24 * time.Hour
+
+var log = logrus.WithField("prefix", "pool")
+
+// ErrExhausted is returned by Assign if a pool has no free network.
+var ErrExhausted = errors.New("address pool exhausted")
+
+// Config is the configuration of a pool.
+type Config struct {
+	IPv4          *net.IPNet // nil disables IPv4
+	IPv4PrefixLen uint8      // prefix length of a peer's network, defaults to DefaultIPv4PrefixLen
+	IPv6          *net.IPNet // nil disables IPv6
+	IPv6PrefixLen uint8      // prefix length of a peer's network, defaults to DefaultIPv6PrefixLen
+
+	LeaseFile string        // file persisting the leases, empty frees them when the peer is released
+	LeaseTime time.Duration // time a released lease is kept in the file, defaults to DefaultLeaseTime
+}
+
+// Pool hands out point-to-point networks to peers. A lease is pinned to
+// the public key of the peer until it is released. Persisted leases are
+// kept after the release and expire after the lease time. Assign and
+// Release are meant to be used as fastd.Config.AssignAddresses and
+// fastd.Config.ReleaseAddresses.
+type Pool struct {
+	ipv4      *subnets
+	ipv6      *subnets
+	leases    map[string]*lease // indexed by public key
+	leaseFile string
+	leaseTime time.Duration
+	mtx       sync.Mutex
+}
+
+// lease holds the network indexes of a peer, -1 if none is assigned
+type lease struct {
+	ipv4    int64
+	ipv6    int64
+	ifname  string
+	created time.Time
+	updated time.Time
+	active  bool
+}
+
+// New returns a pool with the leases of the lease file.
+func New(config Config) (*Pool, error) {
+	pool := &Pool{
+		leases:    make(map[string]*lease),
+		leaseFile: config.LeaseFile,
+		leaseTime: config.LeaseTime,
+	}
+	if pool.leaseTime <= 0 {
+		pool.leaseTime = DefaultLeaseTime
+	}
+
+	var err error
+	if config.IPv4 != nil {
+		if config.IPv4.IP.To4() == nil {
+			return nil, fmt.Errorf("not an IPv4 prefix: %v", config.IPv4)
+		}
+		if pool.ipv4, err = newSubnets(config.IPv4, config.IPv4PrefixLen, DefaultIPv4PrefixLen); err != nil {
+			return nil, err
+		}
+	}
+	if config.IPv6 != nil {
+		if config.IPv6.IP.To4() != nil {
+			return nil, fmt.Errorf("not an IPv6 prefix: %v", config.IPv6)
+		}
+		if pool.ipv6, err = newSubnets(config.IPv6, config.IPv6PrefixLen, DefaultIPv6PrefixLen); err != nil {
+			return nil, err
+		}
+	}
+
+	if pool.leaseFile != "" {
+		if err := pool.load(); err != nil {
+			return nil, errors.Wrap(err, "unable to load leases")
+		}
+	}
+
+	return pool, nil
+}
+
+// load reads the lease file. Active leases of the previous run are
+// considered released now, leases outside of the prefixes are dropped.
+func (pool *Pool) load() error {
+	leases, err := readLeases(pool.leaseFile)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, l := range leases {
+		key, _ := hex.DecodeString(l.PublicKey)
+		if l.Active {
+			l.Updated = now
+		}
+		entry := &lease{
+			ipv4:    pool.ipv4.reserve(l.IPv4),
+			ipv6:    pool.ipv6.reserve(l.IPv6),
+			ifname:  l.Ifname,
+			created: l.Created,
+			updated: l.Updated,
+		}
+		if entry.ipv4 < 0 && entry.ipv6 < 0 {
+			continue
+		}
+		pool.leases[string(key)] = entry
+	}
+	pool.expire(now)
+	return nil
+}
+
+// save writes the lease file (if configured)
+func (pool *Pool) save() {
+	if pool.leaseFile == "" {
+		return
+	}
+	if err := writeLeases(pool.leaseFile, pool.leasesLocked()); err != nil {
+		log.WithError(err).Error("unable to write leases")
+	}
+}
+
+// expire frees the networks of leases released before the lease time.
+// It returns whether a lease has expired.
+func (pool *Pool) expire(now time.Time) bool {
+	expired := false
+	for key, l := range pool.leases {
+		if !l.active && l.updated.Add(pool.leaseTime).Before(now) {
+			pool.free(key, l)
+			expired = true
+		}
+	}
+	return expired
+}
+
+func (pool *Pool) free(key string, l *lease) {
+	if l.ipv4 >= 0 {
+		pool.ipv4.release(l.ipv4)
+	}
+	if l.ipv6 >= 0 {
+		pool.ipv6.release(l.ipv6)
+	}
+	delete(pool.leases, key)
+}
+
+// Assign sets the addresses and prefix lengths of the peer. Peers with
+// a lease get their previous addresses. ErrExhausted is returned if a
+// network is missing, the peer keeps the network of the other pool until
+// it is released. Stale leases are expired by Assign and Release.
+func (pool *Pool) Assign(peer *fastd.Peer) (err error) {
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+
+	now := time.Now()
+	expired := pool.expire(now)
+	key := string(peer.PublicKey)
+	l := pool.leases[key]
+	changed := l == nil || !l.active || l.ifname != peer.Ifname
+	if l == nil {
+		l = &lease{ipv4: -1, ipv6: -1, created: now}
+		pool.leases[key] = l
+	}
+
+	// a network missing due to an exhausted pool is retried
+	if l.ipv4 < 0 && pool.ipv4 != nil {
+		l.ipv4 = pool.ipv4.allocate()
+		changed = changed || l.ipv4 >= 0
+	}
+	if l.ipv6 < 0 && pool.ipv6 != nil {
+		l.ipv6 = pool.ipv6.allocate()
+		changed = changed || l.ipv6 >= 0
+	}
+
+	if l.ipv4 >= 0 {
+		peer.IPv4 = pool.ipv4.addresses(l.ipv4)
+		peer.IPv4PrefixLen = pool.ipv4.prefixLen
+	} else if pool.ipv4 != nil {
+		log.WithField("pubkey", fmt.Sprintf("%x", peer.PublicKey)).Error("IPv4 pool exhausted")
+		err = errors.Wrap(ErrExhausted, "IPv4")
+	}
+	if l.ipv6 >= 0 {
+		peer.IPv6 = pool.ipv6.addresses(l.ipv6)
+		peer.IPv6PrefixLen = pool.ipv6.prefixLen
+	} else if pool.ipv6 != nil {
+		log.WithField("pubkey", fmt.Sprintf("%x", peer.PublicKey)).Error("IPv6 pool exhausted")
+		err = errors.Wrap(ErrExhausted, "IPv6")
+	}
+
+	if changed {
+		l.active = true
+		l.ifname = peer.Ifname
+		l.updated = now
+	}
+	if changed || expired {
+		pool.save()
+	}
+	return
+}
+
+// Release returns the networks of the peer to the pool. Persisted leases
+// are kept for the lease time.
+func (pool *Pool) Release(peer *fastd.Peer) {
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+
+	key := string(peer.PublicKey)
+	l := pool.leases[key]
+	if l == nil {
+		return
+	}
+
+	if pool.leaseFile == "" {
+		pool.free(key, l)
+		return
+	}
+	now := time.Now()
+	l.active = false
+	l.updated = now
+	pool.expire(now)
+	pool.save()
+}
+
+// Len returns the number of leases.
+func (pool *Pool) Len() int {
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+	return len(pool.leases)
+}
+
+// Leases returns all leases ordered by public key.
+func (pool *Pool) Leases() []Lease {
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+	return pool.leasesLocked()
+}
+
+func (pool *Pool) leasesLocked() []Lease {
+	leases := make([]Lease, 0, len(pool.leases))
+	for key, l := range pool.leases {
+		lease := Lease{
+			PublicKey: hex.EncodeToString([]byte(key)),
+			Ifname:    l.ifname,
+			Created:   l.created,
+			Updated:   l.updated,
+			Active:    l.active,
+		}
+		if l.ipv4 >= 0 {
+			lease.IPv4 = pool.ipv4.addresses(l.ipv4).LocalAddr
+		}
+		if l.ipv6 >= 0 {
+			lease.IPv6 = pool.ipv6.addresses(l.ipv6).LocalAddr
+		}
+		leases = append(leases, lease)
+	}
+
+	sort.Slice(leases, func(i, j int) bool {
+		return leases[i].PublicKey < leases[j].PublicKey
+	})
+	return leases
+}
+
+// subnets divides a prefix into networks of equal size
+type subnets struct {
+	prefix    net.IPNet
+	prefixLen uint8 // prefix length of a network
+	count     int64 // number of networks
+	next      int64 // index to try first
+	used      map[int64]bool
+}
+
+func newSubnets(prefix *net.IPNet, prefixLen, defaultLen uint8) (*subnets, error) {
+	ip := prefix.IP.To4()
+	if ip == nil {
+		ip = prefix.IP.To16()
+	}
+
+	ones, bits := prefix.Mask.Size()
+	if bits != len(ip)*8 {
+		return nil, fmt.Errorf("invalid prefix: %v", prefix)
+	}
+	if prefixLen == 0 {
+		prefixLen = defaultLen
+	}
+	if int(prefixLen) < ones || int(prefixLen) >= bits {
+		return nil, fmt.Errorf("prefix length %d out of range for %v", prefixLen, prefix)
+	}
+
+	// limit the number of networks of large IPv6 prefixes
+	n := int(prefixLen) - ones
+	if n > 62 {
+		n = 62
+	}
+
+	return &subnets{
+		prefix:    net.IPNet{IP: ip.Mask(prefix.Mask), Mask: prefix.Mask},
+		prefixLen: prefixLen,
+		count:     1 << uint(n),
+		used:      make(map[int64]bool),
+	}, nil
+}
+
+// allocate returns the index of a free network or -1 if none is left
+func (s *subnets) allocate() int64 {
+	if int64(len(s.used)) >= s.count {
+		return -1
+	}
+	for s.used[s.next] {
+		s.next = (s.next + 1) % s.count
+	}
+
+	i := s.next
+	s.used[i] = true
+	s.next = (i + 1) % s.count
+	return i
+}
+
+func (s *subnets) release(i int64) {
+	delete(s.used, i)
+}
+
+// reserve marks the network with the given local address as used. It
+// returns its index or -1 if the address is no free local address of
+// the prefix.
+func (s *subnets) reserve(ip net.IP) int64 {
+	if s == nil || ip == nil || !s.prefix.Contains(ip) {
+		return -1
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	offset := new(big.Int).SetBytes(ip)
+	offset.Sub(offset, new(big.Int).SetBytes(s.prefix.IP))
+	offset.Rsh(offset, uint(len(s.prefix.IP)*8-int(s.prefixLen)))
+	if !offset.IsInt64() || offset.Int64() >= s.count {
+		return -1
+	}
+
+	i := offset.Int64()
+	if s.used[i] || !s.addresses(i).LocalAddr.Equal(ip) {
+		return -1
+	}
+	s.used[i] = true
+	return i
+}
+
+// addresses returns the local and destination address of a network.
+// Point-to-point networks (/31 and /127) use both addresses, larger ones
+// skip the network address.
+func (s *subnets) addresses(i int64) fastd.AddressConfig {
+	bits := len(s.prefix.IP) * 8
+	first := big.NewInt(i)
+	first.Lsh(first, uint(bits-int(s.prefixLen)))
+	first.Add(first, new(big.Int).SetBytes(s.prefix.IP))
+	if int(s.prefixLen) < bits-1 {
+		first.Add(first, big.NewInt(1))
+	}
+	second := new(big.Int).Add(first, big.NewInt(1))
+
+	return fastd.AddressConfig{
+		LocalAddr: toIP(first, len(s.prefix.IP)),
+		DestAddr:  toIP(second, len(s.prefix.IP)),
+	}
+}
+
+func toIP(i *big.Int, size int) net.IP {
+	ip := make(net.IP, size)
+	b := i.Bytes()
+	copy(ip[size-len(b):], b)
+	return ip
+}
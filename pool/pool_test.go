@@ -0,0 +1,183 @@
+package pool
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/digineo/fastd/fastd"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, prefix, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return prefix
+}
+
+func TestPool(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	pool, err := New(Config{
+		IPv4: mustParseCIDR("192.0.2.0/30"),
+		IPv6: mustParseCIDR("2001:db8::/64"),
+	})
+	require.NoError(err)
+
+	a := &fastd.Peer{PublicKey: []byte("a")}
+	require.NoError(pool.Assign(a))
+	assert.Equal("192.0.2.0", a.IPv4.LocalAddr.String())
+	assert.Equal("192.0.2.1", a.IPv4.DestAddr.String())
+	assert.EqualValues(31, a.IPv4PrefixLen)
+	assert.Equal("2001:db8::", a.IPv6.LocalAddr.String())
+	assert.Equal("2001:db8::1", a.IPv6.DestAddr.String())
+	assert.EqualValues(127, a.IPv6PrefixLen)
+
+	b := &fastd.Peer{PublicKey: []byte("b")}
+	require.NoError(pool.Assign(b))
+	assert.Equal("192.0.2.2", b.IPv4.LocalAddr.String())
+	assert.Equal("2001:db8::2", b.IPv6.LocalAddr.String())
+
+	// leases are pinned to the key
+	a2 := &fastd.Peer{PublicKey: []byte("a")}
+	pool.Assign(a2)
+	assert.Equal(a.IPv4, a2.IPv4)
+	assert.Equal(a.IPv6, a2.IPv6)
+	assert.Equal(2, pool.Len())
+
+	// exhausted IPv4 pool
+	c := &fastd.Peer{PublicKey: []byte("c")}
+	err = pool.Assign(c)
+	assert.Equal(ErrExhausted, errors.Cause(err))
+	assert.EqualError(err, "IPv4: address pool exhausted")
+	assert.Nil(c.IPv4.LocalAddr)
+	assert.Equal("2001:db8::4", c.IPv6.LocalAddr.String())
+
+	// released networks are reused
+	pool.Release(a)
+	require.NoError(pool.Assign(c))
+	assert.Equal("192.0.2.0", c.IPv4.LocalAddr.String())
+	assert.Equal("2001:db8::4", c.IPv6.LocalAddr.String())
+	assert.Equal(2, pool.Len())
+}
+
+func TestPoolPrefixLen(t *testing.T) {
+	assert := assert.New(t)
+
+	pool, err := New(Config{
+		IPv4:          mustParseCIDR("10.0.0.0/24"),
+		IPv4PrefixLen: 30,
+		IPv6:          mustParseCIDR("2001:db8::/48"),
+		IPv6PrefixLen: 64,
+	})
+	assert.NoError(err)
+
+	pool.Assign(&fastd.Peer{PublicKey: []byte("a")})
+	peer := &fastd.Peer{PublicKey: []byte("b")}
+	pool.Assign(peer)
+	assert.Equal("10.0.0.5", peer.IPv4.LocalAddr.String())
+	assert.Equal("10.0.0.6", peer.IPv4.DestAddr.String())
+	assert.EqualValues(30, peer.IPv4PrefixLen)
+	assert.Equal("2001:db8:0:1::1", peer.IPv6.LocalAddr.String())
+	assert.Equal("2001:db8:0:1::2", peer.IPv6.DestAddr.String())
+}
+
+func TestPoolErrors(t *testing.T) {
+	_, err := New(Config{IPv4: mustParseCIDR("2001:db8::/64")})
+	assert.EqualError(t, err, "not an IPv4 prefix: 2001:db8::/64")
+
+	_, err = New(Config{IPv6: mustParseCIDR("10.0.0.0/8")})
+	assert.EqualError(t, err, "not an IPv6 prefix: 10.0.0.0/8")
+
+	_, err = New(Config{IPv4: mustParseCIDR("10.0.0.0/24"), IPv4PrefixLen: 16})
+	assert.EqualError(t, err, "prefix length 16 out of range for 10.0.0.0/24")
+
+	_, err = New(Config{IPv4: mustParseCIDR("10.0.0.0/24"), IPv4PrefixLen: 32})
+	assert.EqualError(t, err, "prefix length 32 out of range for 10.0.0.0/24")
+}
+
+func TestPoolLeaseFile(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "fastd-pool")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	config := Config{
+		IPv4:      mustParseCIDR("192.0.2.0/29"),
+		LeaseFile: filepath.Join(dir, "leases"),
+		LeaseTime: time.Hour,
+	}
+	pool, err := New(config)
+	require.NoError(err)
+
+	a := &fastd.Peer{PublicKey: []byte("a"), Ifname: "fastd0"}
+	b := &fastd.Peer{PublicKey: []byte("b"), Ifname: "fastd1"}
+	pool.Assign(a)
+	pool.Assign(b)
+	pool.Release(b)
+
+	// released leases are kept
+	assert.Equal(2, pool.Len())
+
+	// leases survive a restart
+	pool, err = New(config)
+	require.NoError(err)
+	leases := pool.Leases()
+	require.Len(leases, 2)
+	assert.Equal("61", leases[0].PublicKey)
+	assert.Equal("fastd0", leases[0].Ifname)
+
+	c := &fastd.Peer{PublicKey: []byte("c")}
+	pool.Assign(c)
+	assert.Equal("192.0.2.4", c.IPv4.LocalAddr.String())
+
+	b2 := &fastd.Peer{PublicKey: []byte("b")}
+	pool.Assign(b2)
+	assert.Equal(b.IPv4, b2.IPv4)
+
+	// stale leases expire
+	pool.Release(b2)
+	pool.leases["b"].updated = time.Now().Add(-2 * time.Hour)
+	d := &fastd.Peer{PublicKey: []byte("d")}
+	pool.Assign(d)
+	pool.Assign(&fastd.Peer{PublicKey: []byte("e")})
+	assert.Equal("192.0.2.6", d.IPv4.LocalAddr.String())
+	assert.Equal(4, pool.Len())
+	_, ok := pool.leases["b"]
+	assert.False(ok)
+
+	// without new keys
+	pool.Release(d)
+	pool.leases["d"].updated = time.Now().Add(-2 * time.Hour)
+	pool.Assign(c)
+	_, ok = pool.leases["d"]
+	assert.False(ok)
+	leases, err = readLeases(config.LeaseFile)
+	require.NoError(err)
+	assert.Len(leases, 3)
+}
+
+func TestReadLeases(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fastd-pool")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "leases")
+	leases, err := readLeases(path)
+	assert.NoError(t, err)
+	assert.Nil(t, leases)
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("{\"public_key\":\"00\"}\n\n{\"public_key\":\"xy\"}\n"), 0644))
+	_, err = readLeases(path)
+	assert.EqualError(t, err, path+":3: invalid public key: encoding/hex: invalid byte: U+0078 'x'")
+}